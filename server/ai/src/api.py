@@ -78,3 +78,24 @@ def learn(payload):
         payload['family']) + ".find3.ai"))
     ai_cache[payload['family']] = ai
     return {"success": True, "message": "calibrated data"}
+
+
+def reload(payload):
+    if payload is None:
+        return {'success': False, 'message': 'must provide family'}
+    if 'family' not in payload:
+        return {'success': False, 'message': 'must provide family'}
+    data_folder = '.'
+    if 'data_folder' in payload:
+        data_folder = payload['data_folder']
+
+    fname = os.path.join(data_folder, to_base58(
+        payload['family']) + ".find3.ai")
+    ai = AI(to_base58(payload['family']), data_folder)
+    logger.debug("reloading {}".format(fname))
+    try:
+        ai.load(fname)
+    except FileNotFoundError:
+        return {"success": False, "message": "could not find '{}'".format(fname)}
+    ai_cache[payload['family']] = ai
+    return {"success": True, "message": "reloaded model"}
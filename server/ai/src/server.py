@@ -36,6 +36,18 @@ def learnHandler():
     return jsonify(results)
 
 
+@app.route('/reload', methods=['POST'])
+def reloadHandler():
+    logger.debug('In  {0} {1}'.format(request.method, request.path))
+    payload = request.get_json()
+    results = api.reload(payload)
+    status_code = 200
+    if not results['success']:
+        status_code = 400
+    logger.debug('Out {0} {1} [{2}]'.format(request.method, request.path, status_code))
+    return jsonify(results)
+
+
 if __name__ == "__main__":
     app.run(
         host='0.0.0.0',
@@ -49,6 +49,8 @@ def on_new_client(conn, addr):
                         results = api.learn(query['data'])
                     elif 'classify' == query['method']:
                         results = api.classify(query['data'])
+                    elif 'reload' == query['method']:
+                        results = api.reload(query['data'])
                 elif 'get_cache' == query['method']:
                     results = api.ai_cache
 
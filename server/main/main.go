@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -13,33 +14,28 @@ import (
 	"time"
 
 	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/config"
 	"github.com/schollz/find4/server/main/src/database"
-	// "github.com/schollz/find4/server/main/src/mqtt"
+	"github.com/schollz/find4/server/main/src/logging"
+	"github.com/schollz/find4/server/main/src/mqtt"
 	"github.com/schollz/find4/server/main/src/server"
 )
 
 func main() {
 
-	signal_queue := make(chan os.Signal)
-	signal.Notify(signal_queue, syscall.SIGTERM)
-	signal.Notify(signal_queue, syscall.SIGINT)
-	go func() {
-		sig := <-signal_queue
-		log.Printf("caught sig: %+v\n", sig)
-		log.Println("Gracefully shutting down...")
-		api.Shutdown()
-		server.Shutdown()
-		log.Println("Shutting down...")
-		time.Sleep(500 * time.Millisecond)
-		os.Exit(0)
-	}()
-
+	configFile := flag.String("config", os.Getenv("FIND_CONFIG"), "YAML file with the settings, which flags and FIND_* environment variables override")
 	aiPort := flag.String("ai", "8002", "port for the AI server")
 	port := flag.String("port", "8003", "port for the data (this) server")
-	// mqttServer := flag.String("mqtt-server", "", "add MQTT server")
-	// mqttAdmin := flag.String("mqtt-admin", "admin", "name for mqtt admin")
-	// mqttPass := flag.String("mqtt-pass", "1234", "password for mqtt admin")
-	// mqttDir := flag.String("mqtt-dir", "mosquitto_config", "location for mqtt admin")
+	folds := flag.Int("folds", 3, "number of folds for cross validation during calibration")
+	minCorrect := flag.Float64("min-correct", 0, "minimum percent correct (0-1) for new models to replace the models in use")
+	logLevel := flag.String("log-level", "debug", "level of the logs: trace, debug, info, warn, error or critical")
+	wsSlow := flag.String("ws-slow", server.WebsocketDrop, "what to do with websockets that cannot keep up: 'drop' messages or 'disconnect'")
+	wsBuffer := flag.Int("ws-buffer", server.WebsocketSendBuffer, "number of messages queued for each websocket")
+	mqttServer := flag.String("mqtt-server", "", "add MQTT server")
+	mqttAdmin := flag.String("mqtt-admin", "admin", "name for mqtt admin")
+	mqttPass := flag.String("mqtt-pass", "1234", "password for mqtt admin")
+	mqttDir := flag.String("mqtt-dir", "mosquitto_config", "location for mqtt admin")
+	mqttEmbedded := flag.Bool("mqtt-embedded", false, "run an MQTT broker in the server instead of mosquitto")
 	dump := flag.String("dump", "", "family database to dump")
 	memprofile := flag.Bool("memprofile", false, "whether to profile memory")
 	var dataFolder string
@@ -47,38 +43,110 @@ func main() {
 
 	flag.Parse()
 
-	if dataFolder == "" {
-		dataFolder, _ = os.Getwd()
-		dataFolder = path.Join(dataFolder, "data")
+	settings, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the MQTT_* variables of the docker image are still read
+	for name, setting := range map[string]*string{
+		"MQTT_SERVER": &settings.MQTT.Server,
+		"MQTT_ADMIN":  &settings.MQTT.Admin,
+		"MQTT_PASS":   &settings.MQTT.Password,
+	} {
+		if os.Getenv(name) != "" {
+			*setting = os.Getenv(name)
+		}
+	}
+	// flags that are given override the config file and the environment
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ai":
+			settings.AI.Port = *aiPort
+		case "port":
+			settings.Port = *port
+		case "folds":
+			settings.Calibration.Folds = *folds
+		case "min-correct":
+			settings.Calibration.MinPercentCorrect = *minCorrect
+		case "log-level":
+			settings.LogLevel = *logLevel
+		case "ws-slow":
+			settings.Websockets.SlowPolicy = *wsSlow
+		case "ws-buffer":
+			settings.Websockets.SendBuffer = *wsBuffer
+		case "data":
+			settings.DataFolder = dataFolder
+		case "mqtt-server":
+			settings.MQTT.Server = *mqttServer
+		case "mqtt-admin":
+			settings.MQTT.Admin = *mqttAdmin
+		case "mqtt-pass":
+			settings.MQTT.Password = *mqttPass
+		case "mqtt-dir":
+			settings.MQTT.Directory = *mqttDir
+		case "mqtt-embedded":
+			settings.MQTT.Embedded = *mqttEmbedded
+		}
+	})
+	if err = settings.Validate(); err != nil {
+		log.Fatalf("bad config: %s", err)
 	}
+	config.Set(settings)
+
+	dataFolder = settings.DataFolder
 	os.MkdirAll(dataFolder, 0775)
 
+	if err = logging.SetLevel(settings.LogLevel); err != nil {
+		log.Fatal(err)
+	}
+
 	// setup folders
 	database.DataFolder = dataFolder
 	api.DataFolder = dataFolder
 
-	// mqtt.Debug = *debug
-	//
-	// if os.Getenv("MQTT_ADMIN") != "" {
-	// 	mqtt.AdminUser = os.Getenv("MQTT_ADMIN")
-	// } else {
-	// 	mqtt.AdminUser = *mqttAdmin
-	// }
-	// if os.Getenv("MQTT_PASS") != "" {
-	// 	mqtt.AdminPassword = os.Getenv("MQTT_PASS")
-	// } else {
-	// 	mqtt.AdminPassword = *mqttPass
-	// }
-	// if os.Getenv("MQTT_SERVER") != "" {
-	// 	mqtt.Server = os.Getenv("MQTT_SERVER")
-	// } else {
-	// 	mqtt.Server = *mqttServer
-	// }
-	// mqtt.MosquittoConfigDirectory = *mqttDir
+	mqtt.AdminUser = settings.MQTT.Admin
+	mqtt.AdminPassword = settings.MQTT.Password
+	mqtt.Server = settings.MQTT.Server
+	mqtt.MosquittoConfigDirectory = settings.MQTT.Directory
+	mqtt.Embedded = settings.MQTT.Embedded
+	mqtt.Listen = settings.MQTT.Listen
+	mqtt.HomeAssistant = settings.MQTT.HomeAssistant
+	mqtt.DiscoveryPrefix = settings.MQTT.DiscoveryPrefix
+	mqtt.DiscoveryPerFamily = settings.MQTT.DiscoveryPerFamily
 
-	api.AIPort = *aiPort
-	server.Port = *port
-	// server.UseMQTT = mqtt.Server != ""
+	api.AI_SERVER_ADDRESS = settings.AI.Address
+	api.AIPort = settings.AI.Port
+	api.CalibrationFolds = settings.Calibration.Folds
+	api.MinimumPercentCorrect = settings.Calibration.MinPercentCorrect
+	api.CalibrationWorkers = settings.Calibration.Workers
+	api.CalibrationCheckInterval = settings.Calibration.CheckInterval.Duration()
+	api.RSSILearningPeriod = settings.Calibration.RSSILearningPeriod.Duration()
+	api.MaxModelSnapshots = settings.Calibration.MaxSnapshots
+	api.ScannerTimeout = settings.Passive.ScannerTimeout.Duration()
+	api.PassiveStep = settings.Passive.Step.Duration()
+	api.PassiveAggregation = settings.Passive.Aggregation
+	api.RandomizedClusterPeriod = settings.Randomized.ClusterPeriod.Duration()
+	api.RandomizedMaxGap = settings.Randomized.MaxGap.Duration()
+	api.RandomizedMaxRSSIDistance = settings.Randomized.MaxRSSIDistance
+	api.PrivacyRetention = settings.Privacy.Retention.Duration()
+	api.PrivacyRotation = settings.Privacy.Rotation.Duration()
+	server.Port = settings.Port
+	server.PassiveTimeBlock = settings.Passive.TimeBlock.Duration()
+	server.PassiveFlushInterval = settings.Passive.FlushInterval.Duration()
+	server.DatabaseIdleTimeout = settings.Databases.IdleTimeout.Duration()
+	server.WebsocketSlowPolicy = settings.Websockets.SlowPolicy
+	server.WebsocketSendBuffer = settings.Websockets.SendBuffer
+	server.UseMQTT = mqtt.Server != "" || mqtt.Embedded
+
+	signal_queue := make(chan os.Signal, 1)
+	signal.Notify(signal_queue, syscall.SIGTERM)
+	signal.Notify(signal_queue, syscall.SIGINT)
+	go func() {
+		sig := <-signal_queue
+		log.Printf("caught sig: %+v\n", sig)
+		log.Println("Gracefully shutting down...")
+		os.Exit(shutdown(settings.ShutdownTimeout.Duration()))
+	}()
 
 	if *memprofile {
 		memprofilePath := path.Join(dataFolder, "memprofile")
@@ -100,14 +168,63 @@ func main() {
 			}
 		}()
 	}
-	var err error
 	if *dump != "" {
 		err = api.Dump(*dump)
 	} else {
 		err = server.Run()
+		if err == nil {
+			// the server was stopped by a signal, which exits once it is shut down
+			select {}
+		}
 	}
 	if err != nil {
 		fmt.Print("error: ")
 		fmt.Println(err)
 	}
 }
+
+// shutdown stops the server in order, so that nothing that was accepted is
+// lost. It returns a non-zero exit code if the timeout runs out first.
+func shutdown(timeout time.Duration) (code int) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// stop accepting requests
+	if err := server.Stop(ctx); err != nil {
+		log.Println("could not stop the http server:", err)
+		code = 1
+	}
+	// reverse the passive windows that are over by now, the scans of
+	// the windows that are not over yet are lost
+	server.FlushPassive()
+	// finish analyzing the fingerprints, whose predictions are written
+	// and which use the ai server
+	if err := server.StopSending(ctx); err != nil {
+		log.Println(err)
+		code = 1
+	}
+	// write what has been queued
+	if err := server.DrainDatabases(ctx); err != nil {
+		code = 1
+	}
+	// cancel queued calibrations and finish the running ones,
+	// whose models are written to the databases too
+	if err := api.StopCalibrations(ctx); err != nil {
+		log.Println(err)
+		code = 1
+	}
+	if err := server.DrainDatabases(ctx); err != nil {
+		code = 1
+	}
+	if err := server.CloseWebsockets(ctx); err != nil {
+		log.Println(err)
+	}
+	api.Shutdown()
+	server.Shutdown()
+	if code != 0 {
+		log.Println("Shutdown timed out")
+	} else {
+		log.Println("Shutting down...")
+	}
+	return
+}
@@ -24,16 +24,32 @@ type AnalysisResponse struct {
 }
 
 func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata models.LocationAnalysis, err error) {
+	return analyzeSensorData(db, s, nil)
+}
+
+// analyzeSensorData classifies the sensor data with the scratch models, or
+// with the models in use if there are none. Only the classifications of
+// the models in use are saved as predictions.
+func analyzeSensorData(db *database.Database, s models.SensorData, scratch *scratchModels) (aidata models.LocationAnalysis, err error) {
 	startAnalyze := time.Now()
+	log := logger.WithFamily(s.Family).WithRequest(s.RequestID)
 
 	aidata.Guesses = []models.LocationPrediction{}
 	aidata.LocationNames = make(map[string]string)
 
+	// the models are learned from calibrated RSSI
+	calibrations, err := db.GetRSSICalibrations()
+	if err != nil {
+		err = errors.Wrap(err, "could not get RSSI calibrations")
+		return
+	}
+	s = CalibrateRSSI(calibrations, s)
+
 	type a struct {
 		aidata models.LocationAnalysis
 		err    error
 	}
-	aChan := make(chan a)
+	aChan := make(chan a, 1)
 	go func(aChan chan a) {
 		// inquire the AI
 		aiTime := time.Now()
@@ -44,6 +60,9 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 		}
 		var p2 ClassifyPayload
 		p2.Sensor = s
+		if scratch != nil {
+			p2.Sensor.Family = scratch.aiFamily
+		}
 		p2.DataFolder = DataFolder
 		bPayload, err := json.Marshal(p2)
 		if err != nil {
@@ -52,9 +71,10 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 			return
 		}
 
-		body, err := aiSendAndRecieve(fmt.Sprintf(`{"method": "classify", "data":%v}`, string(bPayload)))
+		body, err := aiSendAndRecieve(log, fmt.Sprintf(`{"method": "classify", "request_id": %q, "data":%v}`, s.RequestID, string(bPayload)))
 		if nil != err {
 			err = errors.Wrap(err, "problem sending message to ai server")
+			aChan <- a{err: err}
 			return
 		}
 
@@ -74,7 +94,7 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 			aChan <- a{err: err}
 			return
 		}
-		logger.Debugf("[%s] python classified %s", s.Family, time.Since(aiTime))
+		log.Debugf("[%s] python classified %s", s.Family, time.Since(aiTime))
 		aChan <- a{err: err, aidata: target.Data}
 	}(aChan)
 
@@ -82,13 +102,16 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 		pl  nb1.PairList
 		err error
 	}
-	bChan := make(chan b)
+	bChan := make(chan b, 1)
 	go func(bChan chan b) {
 		// do naive bayes1 learning
 		nb1Time := time.Now()
 		nb := nb1.New()
+		if scratch != nil {
+			nb = scratch.nb1
+		}
 		pl, err := nb.Classify(db, s)
-		logger.Debugf("[%s] nb1 classified %s", s.Family, time.Since(nb1Time))
+		log.Debugf("[%s] nb1 classified %s", s.Family, time.Since(nb1Time))
 		bChan <- b{pl: pl, err: err}
 	}(bChan)
 
@@ -102,14 +125,14 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 	// 	nb2Time := time.Now()
 	// 	nbLearned2 := nb2.New()
 	// 	pl, err := nbLearned2.Classify(s)
-	// 	logger.Debugf("[%s] nb2 classified %s", s.Family, time.Since(nb2Time))
+	// 	log.Debugf("[%s] nb2 classified %s", s.Family, time.Since(nb2Time))
 	// 	cChan <- c{pl: pl, err: err}
 	// }(cChan)
 
 	aResult := <-aChan
 	if aResult.err != nil || len(aResult.aidata.Predictions) == 0 {
 		err = errors.Wrap(aResult.err, "problem with machine learning")
-		logger.Error(aResult.err)
+		log.Error(aResult.err)
 		return
 	}
 	aidata = aResult.aidata
@@ -132,7 +155,7 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 		}
 		aidata.Predictions = append(aidata.Predictions, algPrediction)
 	} else {
-		logger.Warnf("[%s] nb1 classify: %s", s.Family, bResult.err.Error())
+		log.Warnf("[%s] nb1 classify: %s", s.Family, bResult.err.Error())
 	}
 
 	// // process nb2
@@ -148,15 +171,15 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 	// 	}
 	// 	aidata.Predictions = append(aidata.Predictions, algPrediction)
 	// } else {
-	// 	logger.Warnf("[%s] nb2 classify: %s", s.Family, cResult.err.Error())
+	// 	log.Warnf("[%s] nb2 classify: %s", s.Family, cResult.err.Error())
 	// }
 
 	// var algorithmEfficacy map[string]map[string]models.BinaryStats
 	// db.Get("AlgorithmEfficacy", &algorithmEfficacy)
 	// DEBUGGING
-	calibration, err := db.GetCalibration()
+	calibration, err := db.GetActiveCalibration()
 	if err != nil {
-		logger.Warn("could not get calibration")
+		log.Warn("could not get calibration")
 	}
 	algorithmEfficacy := calibration.AlgorithmEfficacy
 	//.end
@@ -172,16 +195,21 @@ func AnalyzeSensorData(db *database.Database, s models.SensorData) (aidata model
 		}
 	}
 
+	if scratch != nil {
+		log.Debugf("[%s] analyzed in %s", s.Family, time.Since(startAnalyze))
+		return
+	}
+
 	// add prediction to the database
 	// adding predictions uses up a lot of space
 	go func() {
 		errInsert := db.AddPrediction(s.Timestamp, aidata.Guesses)
 		if errInsert != nil {
-			logger.Errorf("[%s] problem inserting: %s", s.Family, errInsert.Error())
+			log.Errorf("[%s] problem inserting: %s", s.Family, errInsert.Error())
 		}
 	}()
 
-	logger.Debugf("[%s] analyzed in %s", s.Family, time.Since(startAnalyze))
+	log.Debugf("[%s] analyzed in %s", s.Family, time.Since(startAnalyze))
 	return
 }
 
@@ -247,7 +275,7 @@ func (p PairList) Len() int           { return len(p) }
 func (p PairList) Less(i, j int) bool { return p[i].Value < p[j].Value }
 func (p PairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
-func GetByLocation(db *database.Database, family string, minutesAgoInt int, showRandomized bool, activeMinsThreshold int, minScanners int, minProbability float64, deviceCounts map[string]int) (byLocations []models.ByLocation, err error) {
+func GetByLocation(db *database.Database, family string, minutesAgoInt int, showRandomized bool, activeMinsThreshold int, minScanners int, minProbability float64, group string, deviceCounts map[string]int) (byLocations []models.ByLocation, err error) {
 	// TODO
 	// MAKE INTO SINGLE CALL
 
@@ -302,9 +330,56 @@ func GetByLocation(db *database.Database, family string, minutesAgoInt int, show
 	var rollingData models.ReverseRollingData
 	errGotRollingData := db.Get("ReverseRollingData", &rollingData)
 
+	registry, err := getDeviceRegistry(db)
+	if err != nil {
+		return
+	}
+
+	// hashed devices keep the vendor prefix and randomization of their MAC
+	private, err := privateDevices(db, devicesToCheck)
+	if err != nil {
+		return
+	}
+
+	// randomized MACs are counted once for each pseudo device, with the
+	// fingerprint of the MAC that was seen last. The MACs are clustered
+	// into pseudo devices in the background.
+	var pseudoDevices map[string]string
+	pseudoLatest := make(map[string]models.SensorData)
+	pseudoMacs := make(map[string][]string)
+	if showRandomized {
+		pseudoDevices, err = db.GetPseudoDevices(devicesToCheck)
+		if err != nil {
+			err = errors.Wrap(err, "could not get pseudo devices")
+			return
+		}
+		for _, s := range sensors {
+			id, ok := pseudoDevices[s.Device]
+			if !ok {
+				continue
+			}
+			pseudoMacs[id] = append(pseudoMacs[id], s.Device)
+			if s.Timestamp > pseudoLatest[id].Timestamp {
+				pseudoLatest[id] = s
+			}
+		}
+	}
+
 	locations := make(map[string][]models.ByLocationDevice)
 	for _, s := range sensors {
+		device := registry[s.Device]
+		if device.Ignore {
+			continue
+		}
+		if group != "" && device.Group != group {
+			continue
+		}
 		isRandomized := utils.IsMacRandomized(s.Device)
+		mac := s.Device
+		if p, ok := private[s.Device]; ok {
+			isRandomized = p.Randomized
+			mac = p.OUI + ":00:00:00"
+		}
 		if !showRandomized && isRandomized {
 			continue
 		}
@@ -316,8 +391,24 @@ func GetByLocation(db *database.Database, family string, minutesAgoInt int, show
 			logger.Warnf("missing deviceFirstTime for %s", s.Device)
 			continue
 		}
+		count := deviceCounts[s.Device]
+		firstSeen := deviceFirstTime[s.Device]
+		pseudoDevice, isPseudo := pseudoDevices[s.Device]
+		if isPseudo {
+			if pseudoLatest[pseudoDevice].Device != s.Device {
+				continue
+			}
+			count = 0
+			for _, mac := range pseudoMacs[pseudoDevice] {
+				count += deviceCounts[mac]
+				if t, ok := deviceFirstTime[mac]; ok && t.Before(firstSeen) {
+					firstSeen = t
+				}
+			}
+			sort.Strings(pseudoMacs[pseudoDevice])
+		}
 		if errGotRollingData == nil {
-			if int(deviceCounts[s.Device])*int(rollingData.TimeBlock.Seconds())/60 < activeMinsThreshold {
+			if int(count)*int(rollingData.TimeBlock.Seconds())/60 < activeMinsThreshold {
 				continue
 			}
 		}
@@ -364,18 +455,25 @@ func GetByLocation(db *database.Database, family string, minutesAgoInt int, show
 
 		dL := models.ByLocationDevice{
 			Device:      s.Device,
+			Name:        device.Name,
+			Owner:       device.Owner,
+			Group:       device.Group,
 			Timestamp:   time.Unix(0, s.Timestamp*1000000).UTC(),
 			Probability: a[0].Probability,
 			Randomized:  isRandomized,
 			NumScanners: numScanners,
-			FirstSeen:   deviceFirstTime[s.Device],
+			FirstSeen:   firstSeen,
+		}
+		if isPseudo {
+			dL.PseudoDevice = pseudoDevice
+			dL.Macs = pseudoMacs[pseudoDevice]
 		}
 		if errGotRollingData == nil {
-			dL.ActiveMins = int(deviceCounts[s.Device]) * int(rollingData.TimeBlock.Seconds()) / 60
+			dL.ActiveMins = int(count) * int(rollingData.TimeBlock.Seconds()) / 60
 		} else {
-			dL.ActiveMins = int(deviceCounts[s.Device]*30) / 60
+			dL.ActiveMins = int(count*30) / 60
 		}
-		vendor, vendorErr := utils.GetVendorFromOUI(s.Device)
+		vendor, vendorErr := utils.GetVendorFromOUI(mac)
 		if vendorErr == nil {
 			dL.Vendor = vendor
 		}
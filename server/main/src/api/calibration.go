@@ -18,49 +18,224 @@ import (
 	"github.com/schollz/find4/server/main/src/utils"
 )
 
-// Calibrate will send the sensor data for a specific family to the machine learning algorithms
+// CalibrationFolds is the number of folds used for the cross validation
+// of a calibration. Less than two folds will use a single 70:30 split.
+var CalibrationFolds = 3
+
+// MAX_CROSS_VALIDATION_DATA limits the number of fingerprints used for cross validation
+const MAX_CROSS_VALIDATION_DATA int = 1000
+
+// Calibrate will send the sensor data for a specific family to the machine learning algorithms.
+// When crossValidation is set it also determines the efficacy of each algorithm, and
+// returns once the new calibration has been saved.
 func Calibrate(db *database.Database, family string, crossValidation ...bool) (err error) {
+	learned, errLearn := learnRSSICalibrations(db)
+	if errLearn != nil {
+		logger.Warnf("[%s] could not learn RSSI calibrations: %s", family, errLearn.Error())
+	} else if len(learned) > 0 {
+		logger.Infof("[%s] learned RSSI calibrations of %d scanners", family, len(learned))
+	}
+
+	var datas []models.SensorData
+	db.GetAllForClassification(func(s []models.SensorData, errGet error) {
+		datas = s
+		err = errGet
+	})
+	if err != nil {
+		return
+	}
+	if len(datas) < 2 {
+		err = errors.New("not enough data")
+		return
+	}
+
+	if len(crossValidation) > 0 && crossValidation[0] {
+		err = crossValidate(db, family, datas)
+		return
+	}
+	err = fitModels(db, family, datas)
+	return
+}
 
-	db.GetAllForClassification(func(datas []models.SensorData, err error) {
+// crossValidate determines the efficacy of each algorithm on every fold
+// of the data, and then learns the final models from all of the data.
+func crossValidate(db *database.Database, family string, datas []models.SensorData) (err error) {
+	folds, err := splitDataIntoFolds(datas, CalibrationFolds)
+	if err != nil {
+		return
+	}
 
+	// the folds are learned by scratch models, so the models in use are
+	// only replaced once, by the models learned from all of the data
+	defer os.Remove(aiModelFile(scratchFamily(family)))
+	results := make([]foldResult, len(folds))
+	for i, fold := range folds {
+		logger.Infof("[%s] cross validation fold %d/%d (learning: %d, testing: %d)", family, i+1, len(folds), len(fold.learn), len(fold.test))
+		var scratch *scratchModels
+		scratch, err = fitScratchModels(db, family, fold.learn)
 		if err != nil {
 			return
 		}
-
-		datasLearn, datasTest, err := splitDataForLearning(datas, crossValidation...)
+		results[i], err = findBestAlgorithm(db, fold.test, scratch)
 		if err != nil {
 			return
 		}
+	}
 
-		// do the Golang naive bayes fitting
-		nb := nb1.New()
-		logger.Debugf("naive bayes1 fitting")
-		errFit := nb.Fit(db, datasLearn)
-		if errFit != nil {
-			logger.Error(errFit)
-		}
+	// the final models are learned from all of the data
+	err = fitModels(db, family, datas)
+	if err != nil {
+		return
+	}
+	calibrationID, percentCorrect, err := saveCalibration(db, results)
+	if err != nil {
+		return
+	}
+	calibrationPercentCorrect.Set(percentCorrect, family)
+	err = promoteModels(db, family, calibrationID, percentCorrect)
+	return
+}
 
-		// do the Golang naive bayes2 fitting
-		nbFit2 := nb2.New()
-		logger.Debugf("naive bayes2 fitting")
-		errFit = nbFit2.Fit(db, datasLearn)
-		if errFit != nil {
-			logger.Error(errFit)
-		}
+// fitModels fits every machine learning algorithm to the data
+func fitModels(db *database.Database, family string, datas []models.SensorData) (err error) {
+	datas, err = calibrateRSSI(db, datas)
+	if err != nil {
+		return
+	}
 
-		// do the python learning
-		err = learnFromData(family, datasLearn)
-		if err != nil {
-			panic(err)
+	// do the Golang naive bayes fitting
+	nb := nb1.New()
+	logger.Debugf("naive bayes1 fitting")
+	errFit := nb.Fit(db, datas)
+	if errFit != nil {
+		logger.Error(errFit)
+	}
+
+	// do the Golang naive bayes2 fitting
+	nbFit2 := nb2.New()
+	logger.Debugf("naive bayes2 fitting")
+	errFit = nbFit2.Fit(db, datas)
+	if errFit != nil {
+		logger.Error(errFit)
+	}
+
+	// do the python learning
+	err = learnFromData(family, datas)
+	if err != nil {
+		return
+	}
+
+	// make sure the fitted models are saved before they are used
+	db.Sync()
+	return
+}
+
+// scratchModels are the models learned from a fold of the data during
+// cross validation, which are kept apart from the models in use
+type scratchModels struct {
+	// aiFamily is the name of the python model
+	aiFamily string
+	nb1      *nb1.Algorithm
+}
+
+// scratchFamily is the name of the scratch python model of a family. It
+// cannot be the name of a family, since families are part of the URLs.
+func scratchFamily(family string) string {
+	return family + "/crossvalidation"
+}
+
+// fitScratchModels fits the machine learning algorithms that are used for
+// classifying to the data, without replacing the models in use
+func fitScratchModels(db *database.Database, family string, datas []models.SensorData) (scratch *scratchModels, err error) {
+	datas, err = calibrateRSSI(db, datas)
+	if err != nil {
+		return
+	}
+	scratch = &scratchModels{aiFamily: scratchFamily(family), nb1: nb1.New()}
+
+	logger.Debugf("naive bayes1 fitting scratch model")
+	errFit := scratch.nb1.Learn(datas)
+	if errFit != nil {
+		logger.Error(errFit)
+	}
+
+	err = learnFromData(scratch.aiFamily, datas)
+	return
+}
+
+type dataFold struct {
+	learn []models.SensorData
+	test  []models.SensorData
+}
+
+// splitDataIntoFolds splits the data into k folds, stratified by location.
+// Each fold tests on a different part of the data and learns from the rest.
+func splitDataIntoFolds(datas []models.SensorData, k int) (folds []dataFold, err error) {
+	if k < 2 {
+		datasLearn, datasTest, errSplit := splitDataForLearning(datas, true)
+		if errSplit != nil {
+			err = errSplit
 			return
 		}
+		folds = []dataFold{{learn: datasLearn, test: datasTest}}
+		return
+	}
+	if len(datas) < 2 {
+		err = errors.New("not enough data")
+		return
+	}
 
-		if len(crossValidation) > 0 && crossValidation[0] {
-			go findBestAlgorithm(db, datasTest)
-		}
+	// randomize data order
+	datas = append([]models.SensorData{}, datas...)
+	for i := range datas {
+		j := rand.Intn(i + 1)
+		datas[i], datas[j] = datas[j], datas[i]
+	}
+	if len(datas) > MAX_CROSS_VALIDATION_DATA {
+		datas = datas[:MAX_CROSS_VALIDATION_DATA]
+	}
 
-	})
+	// triage into different locations
+	dataLocations := make(map[string][]int)
+	for i := range datas {
+		dataLocations[datas[i].Location] = append(dataLocations[datas[i].Location], i)
+	}
 
+	// deal the data of each location out to the folds
+	dataFolds := make([]int, len(datas))
+	for loc := range dataLocations {
+		if len(dataLocations[loc]) < 2 {
+			logger.Debugf("skipping %s for cross validation, not enough data", loc)
+			for _, i := range dataLocations[loc] {
+				dataFolds[i] = -1
+			}
+			continue
+		}
+		for j, i := range dataLocations[loc] {
+			dataFolds[i] = j % k
+		}
+	}
+
+	for f := 0; f < k; f++ {
+		fold := dataFold{}
+		for i := range datas {
+			if dataFolds[i] == -1 {
+				continue
+			} else if dataFolds[i] == f {
+				fold.test = append(fold.test, datas[i])
+			} else {
+				fold.learn = append(fold.learn, datas[i])
+			}
+		}
+		// there are empty folds when there is less data than folds
+		if len(fold.test) == 0 || len(fold.learn) == 0 {
+			continue
+		}
+		folds = append(folds, fold)
+	}
+	if len(folds) == 0 {
+		err = errors.New("not enough data for cross validation")
+	}
 	return
 }
 
@@ -148,7 +323,7 @@ func learnFromData(family string, datas []models.SensorData) (err error) {
 		return
 	}
 
-	body, err := aiSendAndRecieve(fmt.Sprintf(`{"method": "learn", "data":%v}`, string(bPayload)))
+	body, err := aiSendAndRecieve(logger.WithFamily(family), fmt.Sprintf(`{"method": "learn", "data":%v}`, string(bPayload)))
 	if nil != err {
 		err = errors.Wrap(err, "problem sending message to ai server")
 		return
@@ -170,7 +345,17 @@ func learnFromData(family string, datas []models.SensorData) (err error) {
 	return
 }
 
-func findBestAlgorithm(db *database.Database, datas []models.SensorData) (algorithmEfficacy map[string]map[string]models.BinaryStats, err error) {
+// foldResult is the efficacy of the algorithms on a single fold of data
+type foldResult struct {
+	percentCorrect           float64
+	accuracyBreakdown        map[string]float64
+	probabilitiesOfBestGuess []float64
+	predictionAnalysis       map[string]map[string]map[string]int
+	algorithmEfficacy        map[string]map[string]models.BinaryStats
+}
+
+// findBestAlgorithm determines the efficacy of the scratch models on the data
+func findBestAlgorithm(db *database.Database, datas []models.SensorData, scratch *scratchModels) (result foldResult, err error) {
 	if len(datas) == 0 {
 		err = errors.New("no data specified")
 		return
@@ -193,7 +378,7 @@ func findBestAlgorithm(db *database.Database, datas []models.SensorData) (algori
 	for w := 0; w < workers; w++ {
 		go func(id int, jobs <-chan Job, results chan<- Result) {
 			for job := range jobs {
-				aidata, err := AnalyzeSensorData(db, job.data)
+				aidata, err := analyzeSensorData(db, job.data, scratch)
 				if err != nil {
 					logger.Warnf("%s: %+v", err.Error(), job.data)
 				}
@@ -249,7 +434,7 @@ func findBestAlgorithm(db *database.Database, datas []models.SensorData) (algori
 		locationTotals[data.Location]++
 	}
 	logger.Debugf("locationTotals: %+v", locationTotals)
-	algorithmEfficacy = make(map[string]map[string]models.BinaryStats)
+	algorithmEfficacy := make(map[string]map[string]models.BinaryStats)
 	for alg := range predictionAnalysis {
 		if _, ok := algorithmEfficacy[alg]; !ok {
 			algorithmEfficacy[alg] = make(map[string]models.BinaryStats)
@@ -309,6 +494,92 @@ func findBestAlgorithm(db *database.Database, datas []models.SensorData) (algori
 	}
 	logger.Infof("[%s] total correct: %d/%d", datas[0].Family, correct, len(aidatas))
 
+	for loc := range accuracyBreakdown {
+		accuracyBreakdown[loc] = accuracyBreakdown[loc] / accuracyBreakdownTotal[loc]
+		logger.Infof("[%s] %s accuracy: %2.0f%%", datas[0].Family, loc, accuracyBreakdown[loc]*100)
+	}
+
+	result = foldResult{
+		percentCorrect:           float64(correct) / float64(len(datas)),
+		accuracyBreakdown:        accuracyBreakdown,
+		probabilitiesOfBestGuess: ProbabilitiesOfBestGuess,
+		predictionAnalysis:       predictionAnalysis,
+		algorithmEfficacy:        algorithmEfficacy,
+	}
+	return
+}
+
+// saveCalibration combines the results of the folds into a new calibration.
+// Counts are summed over the folds and the metrics are averaged.
+func saveCalibration(db *database.Database, results []foldResult) (calibrationID int, percentCorrect float64, err error) {
+	if len(results) == 0 {
+		err = errors.New("no cross validation results")
+		return
+	}
+
+	crossValidation := models.CrossValidation{
+		Folds:               len(results),
+		PercentCorrect:      make([]float64, len(results)),
+		AccuracyBreakdownSD: make(map[string]float64),
+		InformednessSD:      make(map[string]map[string]float64),
+	}
+	ProbabilitiesOfBestGuess := []float64{}
+	predictionAnalysis := make(map[string]map[string]map[string]int)
+	locationAccuracies := make(map[string][]float64)
+	algorithmStats := make(map[string]map[string][]models.BinaryStats)
+	for i, result := range results {
+		crossValidation.PercentCorrect[i] = result.percentCorrect
+		ProbabilitiesOfBestGuess = append(ProbabilitiesOfBestGuess, result.probabilitiesOfBestGuess...)
+		for loc := range result.accuracyBreakdown {
+			locationAccuracies[loc] = append(locationAccuracies[loc], result.accuracyBreakdown[loc])
+		}
+		for alg := range result.predictionAnalysis {
+			if _, ok := predictionAnalysis[alg]; !ok {
+				predictionAnalysis[alg] = make(map[string]map[string]int)
+			}
+			for trueLoc := range result.predictionAnalysis[alg] {
+				if _, ok := predictionAnalysis[alg][trueLoc]; !ok {
+					predictionAnalysis[alg][trueLoc] = make(map[string]int)
+				}
+				for guessLoc, count := range result.predictionAnalysis[alg][trueLoc] {
+					predictionAnalysis[alg][trueLoc][guessLoc] += count
+				}
+			}
+		}
+		for alg := range result.algorithmEfficacy {
+			if _, ok := algorithmStats[alg]; !ok {
+				algorithmStats[alg] = make(map[string][]models.BinaryStats)
+			}
+			for loc, stats := range result.algorithmEfficacy[alg] {
+				algorithmStats[alg][loc] = append(algorithmStats[alg][loc], stats)
+			}
+		}
+	}
+
+	percentCorrect = average(crossValidation.PercentCorrect)
+	crossValidation.PercentCorrectSD = foldStdDev(crossValidation.PercentCorrect)
+
+	accuracyBreakdown := make(map[string]float64)
+	for loc := range locationAccuracies {
+		accuracyBreakdown[loc] = average(locationAccuracies[loc])
+		crossValidation.AccuracyBreakdownSD[loc] = foldStdDev(locationAccuracies[loc])
+	}
+
+	algorithmEfficacy := make(map[string]map[string]models.BinaryStats)
+	for alg := range algorithmStats {
+		algorithmEfficacy[alg] = make(map[string]models.BinaryStats)
+		crossValidation.InformednessSD[alg] = make(map[string]float64)
+		for loc, stats := range algorithmStats[alg] {
+			algorithmEfficacy[alg][loc] = models.AverageBinaryStats(stats)
+			informedness := make([]float64, len(stats))
+			for i := range stats {
+				informedness[i] = stats[i].Informedness
+			}
+			crossValidation.InformednessSD[alg][loc] = foldStdDev(informedness)
+		}
+	}
+	logger.Infof("percent correct over %d folds: %2.0f%% (sd %2.0f%%)", len(results), percentCorrect*100, crossValidation.PercentCorrectSD*100)
+
 	goodProbs := make([]float64, len(ProbabilitiesOfBestGuess))
 	i := 0
 	for _, v := range ProbabilitiesOfBestGuess {
@@ -333,52 +604,20 @@ func findBestAlgorithm(db *database.Database, datas []models.SensorData) (algori
 	badMean := average(badProbs)
 	badSD := stdDev(badProbs, badMean)
 
-	for loc := range accuracyBreakdown {
-		accuracyBreakdown[loc] = accuracyBreakdown[loc] / accuracyBreakdownTotal[loc]
-		logger.Infof("[%s] %s accuracy: %2.0f%%", datas[0].Family, loc, accuracyBreakdown[loc]*100)
-	}
-
-	// // TODO
-	// // Insert batched
-	// err = db.Set("ProbabilityMeans", []float64{goodMean, goodSD, badMean, badSD})
-	// if err != nil {
-	// 	logger.Error(err)
-	// }
-	// err = db.Set("ProbabilitiesOfBestGuess", ProbabilitiesOfBestGuess)
-	// if err != nil {
-	// 	logger.Error(err)
-	// }
-	// err = db.Set("PercentCorrect", float64(correct)/float64(len(datas)))
-	// if err != nil {
-	// 	logger.Error(err)
-	// }
-	// err = db.Set("AccuracyBreakdown", accuracyBreakdown)
-	// if err != nil {
-	// 	logger.Error(err)
-	// }
-	// err = db.Set("PredictionAnalysis", predictionAnalysis)
-	// if err != nil {
-	// 	logger.Error(err)
-	// }
-	// err = db.Set("AlgorithmEfficacy", algorithmEfficacy)
-	// if err != nil {
-	// 	logger.Error(err)
-	// }
 	err = db.Set("LastCalibrationTime", time.Now().UTC())
 	if err != nil {
 		logger.Error(err)
 	}
-	//.end
 
-	db.AddCalibration(
+	calibrationID, err = db.AddCalibration(
 		[]float64{goodMean, goodSD, badMean, badSD}, // ProbabilityMeans
 		ProbabilitiesOfBestGuess,                    // ProbabilitiesOfBestGuess
-		float64(correct)/float64(len(datas)),        // PercentCorrect
+		percentCorrect,                              // PercentCorrect
 		accuracyBreakdown,                           // AccuracyBreakdown
 		predictionAnalysis,                          // PredictionAnalysis
 		algorithmEfficacy,                           // AlgorithmEfficacy
+		crossValidation,                             // CrossValidation
 	)
-
 	return
 }
 
@@ -390,6 +629,15 @@ func average(xs []float64) float64 {
 	return total / float64(len(xs))
 }
 
+// foldStdDev is the standard deviation of a metric over the folds,
+// which is zero when there is only one fold
+func foldStdDev(numbers []float64) float64 {
+	if len(numbers) < 2 {
+		return 0
+	}
+	return stdDev(numbers, average(numbers))
+}
+
 func stdDev(numbers []float64, mean float64) float64 {
 	total := 0.0
 	for _, number := range numbers {
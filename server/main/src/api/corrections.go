@@ -0,0 +1,74 @@
+package api
+
+import (
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// RelabelFingerprints changes the location of the fingerprints of a device
+// within a time window and schedules a calibration with the corrected data.
+func RelabelFingerprints(db *database.Database, family string, edit models.FingerprintEdit, source string) (affected int64, err error) {
+	err = edit.Validate()
+	if err != nil {
+		return
+	}
+	if edit.NewLocation == "" {
+		err = errors.New("new location cannot be empty")
+		return
+	}
+	affected, err = db.RelabelSensors(edit, source)
+	if err != nil {
+		err = errors.Wrap(err, "could not relabel fingerprints")
+		return
+	}
+	logger.Infof("[%s] relabeled %d fingerprints of %s to %s", family, affected, edit.Device, edit.NewLocation)
+	recalibrateAfterEdit(db, family, affected)
+	return
+}
+
+// DeleteFingerprints deletes the fingerprints of a device within a
+// time window and schedules a calibration without them.
+func DeleteFingerprints(db *database.Database, family string, edit models.FingerprintEdit, source string) (affected int64, err error) {
+	err = edit.Validate()
+	if err != nil {
+		return
+	}
+	affected, err = db.DeleteSensors(edit, source)
+	if err != nil {
+		err = errors.Wrap(err, "could not delete fingerprints")
+		return
+	}
+	logger.Infof("[%s] deleted %d fingerprints of %s", family, affected, edit.Device)
+	recalibrateAfterEdit(db, family, affected)
+	return
+}
+
+// DeleteLocation deletes all fingerprints of a location and schedules
+// a calibration without them.
+func DeleteLocation(db *database.Database, family string, location string, source string) (affected int64, err error) {
+	affected, err = db.DeleteLocation(location, source)
+	if err != nil {
+		err = errors.Wrap(err, "could not delete location")
+		return
+	}
+	logger.Infof("[%s] deleted %d fingerprints of %s", family, affected, location)
+	recalibrateAfterEdit(db, family, affected)
+	return
+}
+
+// GetAuditLog returns the most recent changes to the learning data of a family
+func GetAuditLog(db *database.Database, limit int) (entries []models.AuditEntry, err error) {
+	entries, err = db.GetAuditLog(limit)
+	if err != nil {
+		err = errors.Wrap(err, "could not get audit log")
+	}
+	return
+}
+
+func recalibrateAfterEdit(db *database.Database, family string, affected int64) {
+	if affected == 0 {
+		return
+	}
+	ScheduleCalibration(db, family)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/schollz/find4/server/main/src/utils"
+)
+
+// GetDevices returns the devices of a family with their metadata, most
+// seen first. Registered devices without sensor data are listed last.
+// If group is set only the devices in that group are returned.
+func GetDevices(db *database.Database, group string) (devices []models.Device, err error) {
+	ids, err := db.GetDevices()
+	if err != nil {
+		err = errors.Wrap(err, "could not get devices")
+		return
+	}
+	registry, err := getDeviceRegistry(db)
+	if err != nil {
+		return
+	}
+
+	devices = []models.Device{}
+	seen := make(map[string]bool)
+	add := func(device models.Device) {
+		seen[device.ID] = true
+		if group != "" && device.Group != group {
+			return
+		}
+		if vendor, errVendor := utils.GetVendorFromOUI(device.ID); errVendor == nil {
+			device.Vendor = vendor
+		}
+		devices = append(devices, device)
+	}
+	for _, id := range ids {
+		device, ok := registry[id]
+		if !ok {
+			device = models.Device{ID: id}
+		}
+		add(device)
+	}
+	registered, err := db.GetDeviceMetadata()
+	if err != nil {
+		return
+	}
+	for _, device := range registered {
+		if !seen[device.ID] {
+			add(device)
+		}
+	}
+	return
+}
+
+// SetDeviceMetadata registers a device of a family, or updates its metadata
+func SetDeviceMetadata(db *database.Database, device models.Device) (saved models.Device, err error) {
+	err = device.Validate()
+	if err != nil {
+		return
+	}
+	err = db.SetDeviceMetadata(device)
+	if err != nil {
+		err = errors.Wrap(err, "could not save device")
+		return
+	}
+	saved, err = db.GetDeviceMetadataById(device.ID)
+	return
+}
+
+// IsIgnored returns whether a device is ignored in the device registry
+func IsIgnored(db *database.Database, id string) bool {
+	device, err := db.GetDeviceMetadataById(id)
+	return err == nil && device.Ignore
+}
+
+// getDeviceRegistry returns the registered devices by id
+func getDeviceRegistry(db *database.Database) (registry map[string]models.Device, err error) {
+	registry = make(map[string]models.Device)
+	devices, err := db.GetDeviceMetadata()
+	if err != nil {
+		err = errors.Wrap(err, "could not get device registry")
+		return
+	}
+	for _, device := range devices {
+		registry[device.ID] = device
+	}
+	return
+}
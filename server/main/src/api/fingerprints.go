@@ -7,19 +7,6 @@ import (
 	"github.com/schollz/find4/server/main/src/models"
 )
 
-var (
-	calibration_queue chan func()
-)
-
-func init() {
-	// make queue length of 2 to block channel
-	// this will result in rate limiting of AI calibrations.
-	calibration_queue = make(chan func(), 10)
-	// Spawn goroutines to calibrate database
-	go calibrationWorker()
-	go calibrationWorker()
-}
-
 // SaveSensorData will add sensor data to the database
 func SaveSensorData(db *database.Database, p models.SensorData) (err error) {
 	err = p.Validate()
@@ -27,6 +14,14 @@ func SaveSensorData(db *database.Database, p models.SensorData) (err error) {
 		return
 	}
 
+	// learning data can use an alias of a location
+	if p.Location != "" {
+		p.Location, err = db.ResolveLocationAlias(p.Location)
+		if err != nil {
+			return
+		}
+	}
+
 	err = db.AddSensor(p)
 	if p.GPS.Longitude != 0 && p.GPS.Latitude != 0 {
 		db.SetGPS(p)
@@ -35,7 +30,9 @@ func SaveSensorData(db *database.Database, p models.SensorData) (err error) {
 	if err != nil {
 		return
 	}
-
+	for sensorType := range p.Sensors {
+		fingerprintsIngested.Inc(p.Family, sensorType)
+	}
 	return
 }
 
@@ -45,8 +42,13 @@ func SavePrediction(db *database.Database, s models.SensorData, p models.Locatio
 	return
 }
 
-// DatabaseWorker monitors database for changes and schedules AI calibration.
-func DatabaseWorker(db *database.Database, family string) {
+// CalibrationCheckInterval is how often DatabaseWorker checks a family
+// for new learning data
+var CalibrationCheckInterval = 60 * time.Second
+
+// DatabaseWorker monitors database for changes and schedules AI calibration,
+// until stop is closed.
+func DatabaseWorker(db *database.Database, family string, stop <-chan struct{}) {
 	// defend against historic database inserts
 	var last_sensor_insert_timestamp time.Time
 	var last_sensor_count int
@@ -103,33 +105,18 @@ func DatabaseWorker(db *database.Database, family string) {
 
 		// calibrate database or pass
 		if should_calibrate {
-			// put callback function into calibration_queue
-			// this will schedule calibration with the
-			// runing calibrationWorker processes.
-			calibration_queue <- func() {
-				logger.Warnf("Calibrating %v...", family)
-				// if any errors occur they get swallowed
-				err := Calibrate(db, family, true)
-				if nil != err {
-					logger.Error(err)
-					return
-				}
-				logger.Infof("Calibration for %v complete", family)
-			}
+			// schedule calibration with the running
+			// calibrationWorker processes.
+			ScheduleCalibration(db, family)
 		} else {
 			logger.Debugf("Calibration not needed for %v", family)
 		}
 
-		time.Sleep(60 * time.Second)
-	}
-}
-
-// calibrationWorker reads from calibration_queue and runs AI calibration
-func calibrationWorker() {
-	for clbk := range calibration_queue {
-		// drain queue
-		if 0 == len(calibration_queue) {
-			clbk()
+		select {
+		case <-time.After(CalibrationCheckInterval):
+		case <-stop:
+			logger.Debugf("Stopped worker of %v", family)
+			return
 		}
 	}
 }
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// GetCalibrationHistory returns summaries of the most recent calibrations, newest first
+func GetCalibrationHistory(db *database.Database, limit int) (history []models.CalibrationSummary, err error) {
+	calibrations, err := db.GetCalibrations(limit)
+	if err != nil {
+		err = errors.Wrap(err, "could not get calibrations")
+		return
+	}
+	history = make([]models.CalibrationSummary, len(calibrations))
+	for i, calibration := range calibrations {
+		history[i] = summarizeCalibration(calibration)
+	}
+	return
+}
+
+// CompareCalibrations compares two calibrations. If either id is 0 the two
+// most recent calibrations are compared instead.
+func CompareCalibrations(db *database.Database, fromID int, toID int) (diff models.CalibrationDiff, err error) {
+	var from, to database.CalibrationModel
+	if fromID == 0 || toID == 0 {
+		var calibrations []database.CalibrationModel
+		calibrations, err = db.GetCalibrations(2)
+		if err != nil {
+			err = errors.Wrap(err, "could not get calibrations")
+			return
+		}
+		if len(calibrations) < 2 {
+			err = errors.New("need at least two calibrations to compare")
+			return
+		}
+		to, from = calibrations[0], calibrations[1]
+	} else {
+		from, err = db.GetCalibrationById(fromID)
+		if err != nil {
+			return
+		}
+		to, err = db.GetCalibrationById(toID)
+		if err != nil {
+			return
+		}
+	}
+	diff = diffCalibrations(summarizeCalibration(from), summarizeCalibration(to))
+	return
+}
+
+func summarizeCalibration(calibration database.CalibrationModel) (summary models.CalibrationSummary) {
+	summary = models.CalibrationSummary{
+		ID:                    calibration.Id,
+		CalibrationTime:       calibration.CalibrationTime,
+		PercentCorrect:        calibration.PercentCorrect,
+		PercentCorrectSD:      calibration.CrossValidation.PercentCorrectSD,
+		Folds:                 calibration.CrossValidation.Folds,
+		AccuracyBreakdown:     calibration.AccuracyBreakdown,
+		AlgorithmInformedness: make(map[string]float64),
+	}
+	if summary.AccuracyBreakdown == nil {
+		summary.AccuracyBreakdown = make(map[string]float64)
+	}
+	for alg := range calibration.AlgorithmEfficacy {
+		if len(calibration.AlgorithmEfficacy[alg]) == 0 {
+			continue
+		}
+		total := 0.0
+		for loc := range calibration.AlgorithmEfficacy[alg] {
+			total += calibration.AlgorithmEfficacy[alg][loc].Informedness
+		}
+		summary.AlgorithmInformedness[alg] = total / float64(len(calibration.AlgorithmEfficacy[alg]))
+	}
+	return
+}
+
+func diffCalibrations(from, to models.CalibrationSummary) (diff models.CalibrationDiff) {
+	diff = models.CalibrationDiff{
+		From:                  from,
+		To:                    to,
+		PercentCorrect:        models.NewCalibrationChange(from.PercentCorrect, to.PercentCorrect),
+		AccuracyBreakdown:     make(map[string]models.CalibrationChange),
+		AlgorithmInformedness: make(map[string]models.CalibrationChange),
+		AddedLocations:        []string{},
+		RemovedLocations:      []string{},
+	}
+
+	for loc := range to.AccuracyBreakdown {
+		if _, ok := from.AccuracyBreakdown[loc]; !ok {
+			diff.AddedLocations = append(diff.AddedLocations, loc)
+		}
+		diff.AccuracyBreakdown[loc] = models.NewCalibrationChange(from.AccuracyBreakdown[loc], to.AccuracyBreakdown[loc])
+	}
+	for loc := range from.AccuracyBreakdown {
+		if _, ok := to.AccuracyBreakdown[loc]; !ok {
+			diff.RemovedLocations = append(diff.RemovedLocations, loc)
+			diff.AccuracyBreakdown[loc] = models.NewCalibrationChange(from.AccuracyBreakdown[loc], 0)
+		}
+	}
+	sort.Strings(diff.AddedLocations)
+	sort.Strings(diff.RemovedLocations)
+
+	for alg := range to.AlgorithmInformedness {
+		diff.AlgorithmInformedness[alg] = models.NewCalibrationChange(from.AlgorithmInformedness[alg], to.AlgorithmInformedness[alg])
+	}
+	for alg := range from.AlgorithmInformedness {
+		if _, ok := to.AlgorithmInformedness[alg]; !ok {
+			diff.AlgorithmInformedness[alg] = models.NewCalibrationChange(from.AlgorithmInformedness[alg], 0)
+		}
+	}
+	return
+}
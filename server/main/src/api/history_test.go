@@ -0,0 +1,44 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffCalibrations(t *testing.T) {
+	from := summarizeCalibration(database.CalibrationModel{
+		Id:                1,
+		PercentCorrect:    0.5,
+		AccuracyBreakdown: map[string]float64{"kitchen": 0.5, "bedroom": 0.5},
+		AlgorithmEfficacy: map[string]map[string]models.BinaryStats{
+			"Extended Naive Bayes1": {
+				"kitchen": {Informedness: 0.2},
+				"bedroom": {Informedness: 0.4},
+			},
+		},
+	})
+	assert.InDelta(t, 0.3, from.AlgorithmInformedness["Extended Naive Bayes1"], 1e-9)
+
+	to := summarizeCalibration(database.CalibrationModel{
+		Id:                2,
+		PercentCorrect:    0.75,
+		AccuracyBreakdown: map[string]float64{"kitchen": 0.75, "office": 1},
+		AlgorithmEfficacy: map[string]map[string]models.BinaryStats{
+			"Extended Naive Bayes1": {
+				"kitchen": {Informedness: 0.5},
+			},
+		},
+	})
+
+	diff := diffCalibrations(from, to)
+	assert.InDelta(t, 0.25, diff.PercentCorrect.Delta, 1e-9)
+	assert.InDelta(t, 0.25, diff.AccuracyBreakdown["kitchen"].Delta, 1e-9)
+	assert.Equal(t, models.NewCalibrationChange(0, 1), diff.AccuracyBreakdown["office"])
+	assert.Equal(t, models.NewCalibrationChange(0.5, 0), diff.AccuracyBreakdown["bedroom"])
+	assert.Equal(t, []string{"office"}, diff.AddedLocations)
+	assert.Equal(t, []string{"bedroom"}, diff.RemovedLocations)
+	assert.InDelta(t, 0.2, diff.AlgorithmInformedness["Extended Naive Bayes1"].Delta, 1e-9)
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/schollz/find4/server/main/src/utils"
+)
+
+// MAX_FINISHED_JOBS is the number of finished jobs remembered for each family
+const MAX_FINISHED_JOBS int = 25
+
+// OnCalibrationJobDone is called whenever a calibration job succeeds or fails
+var OnCalibrationJobDone func(job models.CalibrationJob)
+
+// CalibrationWorkers is the number of calibrations that run at the same time
+var CalibrationWorkers = 2
+
+type calibrationTask struct {
+	db     *database.Database
+	family string
+	jobID  string
+}
+
+type calibrationJobs struct {
+	// family -> jobs, in the order they were queued
+	jobs    map[string][]*models.CalibrationJob
+	running map[string]*sync.Mutex
+	sync.RWMutex
+}
+
+var (
+	calibration_queue chan calibrationTask
+	jobs              calibrationJobs
+	startWorkers      sync.Once
+	// stopping is closed when the server shuts down, running
+	// counts the calibrations that are not finished yet
+	stopping        = make(chan struct{})
+	stopped         bool
+	stoppingLock    sync.Mutex
+	running         sync.WaitGroup
+	errShuttingDown = errors.New("server is shutting down")
+)
+
+func init() {
+	jobs.jobs = make(map[string][]*models.CalibrationJob)
+	jobs.running = make(map[string]*sync.Mutex)
+
+	// queue length of 10 will block the channel,
+	// which rate limits AI calibrations.
+	calibration_queue = make(chan calibrationTask, 10)
+}
+
+// add queues a new job for a family, unless one is already queued
+// for it. The returned bool reports whether a new job was made.
+func (self *calibrationJobs) add(family string) (models.CalibrationJob, bool) {
+	self.Lock()
+	defer self.Unlock()
+	for _, job := range self.jobs[family] {
+		if job.State == models.JobQueued {
+			return *job, false
+		}
+	}
+	job := &models.CalibrationJob{
+		ID:       utils.RandomString(8),
+		Family:   family,
+		State:    models.JobQueued,
+		QueuedAt: time.Now().UTC(),
+	}
+	self.jobs[family] = append(self.jobs[family], job)
+	self.prune(family)
+	return *job, true
+}
+
+// prune forgets the oldest finished jobs of a family
+func (self *calibrationJobs) prune(family string) {
+	finished := 0
+	for _, job := range self.jobs[family] {
+		if job.IsDone() {
+			finished++
+		}
+	}
+	kept := []*models.CalibrationJob{}
+	for _, job := range self.jobs[family] {
+		if job.IsDone() && finished > MAX_FINISHED_JOBS {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	self.jobs[family] = kept
+}
+
+func (self *calibrationJobs) find(family, id string) *models.CalibrationJob {
+	for _, job := range self.jobs[family] {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// get returns a copy of a job
+func (self *calibrationJobs) get(family, id string) (job models.CalibrationJob, err error) {
+	self.RLock()
+	defer self.RUnlock()
+	j := self.find(family, id)
+	if j == nil {
+		err = errors.New("no calibration job '" + id + "' for " + family)
+		return
+	}
+	job = *j
+	return
+}
+
+// list returns copies of all the known jobs of a family
+func (self *calibrationJobs) list(family string) []models.CalibrationJob {
+	self.RLock()
+	defer self.RUnlock()
+	list := make([]models.CalibrationJob, len(self.jobs[family]))
+	for i, job := range self.jobs[family] {
+		list[i] = *job
+	}
+	return list
+}
+
+func (self *calibrationJobs) start(family, id string) {
+	self.Lock()
+	defer self.Unlock()
+	if job := self.find(family, id); job != nil {
+		job.State = models.JobRunning
+		job.StartedAt = time.Now().UTC()
+	}
+}
+
+func (self *calibrationJobs) finish(family, id string, err error) (job models.CalibrationJob) {
+	self.Lock()
+	defer self.Unlock()
+	j := self.find(family, id)
+	if j == nil {
+		return
+	}
+	j.FinishedAt = time.Now().UTC()
+	j.Duration = j.FinishedAt.Sub(j.StartedAt).Seconds()
+	if err != nil {
+		j.State = models.JobFailed
+		j.Error = err.Error()
+	} else {
+		j.State = models.JobSucceeded
+	}
+	self.prune(family)
+	return *j
+}
+
+// lock returns the mutex that keeps calibrations of a family from running
+// concurrently, or from running while its models are rolled back
+func (self *calibrationJobs) lock(family string) *sync.Mutex {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.running[family]; !ok {
+		self.running[family] = &sync.Mutex{}
+	}
+	return self.running[family]
+}
+
+// ScheduleCalibration queues a calibration for the family. If a calibration
+// is already waiting in the queue for this family, that job is returned instead.
+func ScheduleCalibration(db *database.Database, family string) models.CalibrationJob {
+	stoppingLock.Lock()
+	isStopped := stopped
+	stoppingLock.Unlock()
+	if isStopped {
+		job, _ := jobs.add(family)
+		return cancelCalibration(calibrationTask{db: db, family: family, jobID: job.ID})
+	}
+	job, isNew := jobs.add(family)
+	if !isNew {
+		logger.Debugf("[%s] calibration %s already queued", family, job.ID)
+		return job
+	}
+	logger.Debugf("[%s] queued calibration %s", family, job.ID)
+	// Spawn goroutines to calibrate database, once the
+	// number of workers has been configured
+	startWorkers.Do(func() {
+		for i := 0; i < CalibrationWorkers; i++ {
+			go calibrationWorker()
+		}
+	})
+	go func() {
+		task := calibrationTask{db: db, family: family, jobID: job.ID}
+		select {
+		case calibration_queue <- task:
+		case <-stopping:
+			cancelCalibration(task)
+		}
+	}()
+	return job
+}
+
+// cancelCalibration fails a queued calibration because the server is shutting down
+func cancelCalibration(task calibrationTask) models.CalibrationJob {
+	job := jobs.finish(task.family, task.jobID, errShuttingDown)
+	logger.Warnf("[%s] cancelled calibration %s", task.family, task.jobID)
+	if OnCalibrationJobDone != nil {
+		OnCalibrationJobDone(job)
+	}
+	return job
+}
+
+// StopCalibrations cancels the queued calibrations and waits for the running
+// ones to finish, until the context is done
+func StopCalibrations(ctx context.Context) error {
+	stoppingLock.Lock()
+	if !stopped {
+		stopped = true
+		close(stopping)
+	}
+	stoppingLock.Unlock()
+
+	// cancel the calibrations that no worker has picked up
+	for queued := true; queued; {
+		select {
+		case task := <-calibration_queue:
+			cancelCalibration(task)
+		default:
+			queued = false
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("calibrations are still running: " + ctx.Err().Error())
+	}
+}
+
+// GetCalibrationJob returns the calibration job with the given id
+func GetCalibrationJob(family, id string) (models.CalibrationJob, error) {
+	return jobs.get(family, id)
+}
+
+// CalibrationPending returns whether a calibration of the family is queued or running
+func CalibrationPending(family string) bool {
+	for _, job := range jobs.list(family) {
+		if !job.IsDone() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCalibrationJobs returns the most recent calibration jobs for a family
+func GetCalibrationJobs(family string) []models.CalibrationJob {
+	return jobs.list(family)
+}
+
+// calibrationWorker reads from calibration_queue and runs AI calibration
+func calibrationWorker() {
+	for {
+		var task calibrationTask
+		select {
+		case <-stopping:
+			return
+		case task = <-calibration_queue:
+		}
+		stoppingLock.Lock()
+		if stopped {
+			stoppingLock.Unlock()
+			cancelCalibration(task)
+			continue
+		}
+		running.Add(1)
+		stoppingLock.Unlock()
+		runCalibration(task)
+	}
+}
+
+// runCalibration runs a calibration job and records how it went
+func runCalibration(task calibrationTask) {
+	defer running.Done()
+	family := task.family
+
+	lock := jobs.lock(family)
+	lock.Lock()
+	jobs.start(family, task.jobID)
+	logger.Warnf("Calibrating %v...", family)
+	err := Calibrate(task.db, family, true)
+	job := jobs.finish(family, task.jobID, err)
+	lock.Unlock()
+	calibrationSeconds.Observe(job.Duration, family)
+	calibrations.Inc(family, job.State)
+
+	if nil != err {
+		logger.Errorf("[%s] calibration %s failed: %s", family, job.ID, err.Error())
+	} else {
+		logger.Infof("Calibration for %v complete in %2.1fs", family, job.Duration)
+	}
+	if OnCalibrationJobDone != nil {
+		OnCalibrationJobDone(job)
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalibrationJobs(t *testing.T) {
+	var js calibrationJobs
+	js.jobs = make(map[string][]*models.CalibrationJob)
+	js.running = make(map[string]*sync.Mutex)
+
+	// a queued job is deduplicated
+	job1, isNew := js.add("testing")
+	assert.True(t, isNew)
+	assert.Equal(t, models.JobQueued, job1.State)
+	job2, isNew := js.add("testing")
+	assert.False(t, isNew)
+	assert.Equal(t, job1.ID, job2.ID)
+
+	// a running job is not
+	js.start("testing", job1.ID)
+	job3, isNew := js.add("testing")
+	assert.True(t, isNew)
+	assert.NotEqual(t, job1.ID, job3.ID)
+
+	job1 = js.finish("testing", job1.ID, errors.New("no data"))
+	assert.Equal(t, models.JobFailed, job1.State)
+	assert.Equal(t, "no data", job1.Error)
+	assert.True(t, job1.IsDone())
+
+	js.start("testing", job3.ID)
+	job3 = js.finish("testing", job3.ID, nil)
+	assert.Equal(t, models.JobSucceeded, job3.State)
+	assert.Len(t, js.list("testing"), 2)
+
+	_, err := js.get("testing", "missing")
+	assert.NotNil(t, err)
+	_, err = js.get("other", job1.ID)
+	assert.NotNil(t, err)
+
+	// only the most recent finished jobs are remembered
+	for i := 0; i < MAX_FINISHED_JOBS+5; i++ {
+		job, _ := js.add("testing")
+		js.start("testing", job.ID)
+		js.finish("testing", job.ID, nil)
+	}
+	assert.Len(t, js.list("testing"), MAX_FINISHED_JOBS)
+	_, err = js.get("testing", job3.ID)
+	assert.NotNil(t, err)
+}
+
+func TestStopCalibrations(t *testing.T) {
+	// the scheduler is shared with the other tests, so it is restarted after
+	defer func() {
+		stoppingLock.Lock()
+		stopping = make(chan struct{})
+		stopped = false
+		running = sync.WaitGroup{}
+		startWorkers = sync.Once{}
+		stoppingLock.Unlock()
+	}()
+
+	queued, _ := jobs.add("teststop")
+	calibration_queue <- calibrationTask{family: "teststop", jobID: queued.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, StopCalibrations(ctx))
+	job, err := GetCalibrationJob("teststop", queued.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, models.JobFailed, job.State)
+	assert.Equal(t, errShuttingDown.Error(), job.Error)
+
+	// calibrations scheduled while shutting down are not run
+	job = ScheduleCalibration(nil, "teststop")
+	assert.Equal(t, models.JobFailed, job.State)
+	assert.Equal(t, 0, len(calibration_queue))
+}
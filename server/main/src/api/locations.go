@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// SetLocationMetadata registers a location of a family, or updates its metadata.
+// A location cannot use the name or an alias of another location as an alias.
+func SetLocationMetadata(db *database.Database, location models.Location) (saved models.Location, err error) {
+	err = location.Validate()
+	if err != nil {
+		return
+	}
+	name, err := db.ResolveLocationAlias(location.Name)
+	if err != nil {
+		return
+	}
+	if name != location.Name {
+		err = errors.New(fmt.Sprintf("'%s' is already an alias of '%s'", location.Name, name))
+		return
+	}
+	for _, alias := range location.Aliases {
+		name, err = db.ResolveLocationAlias(alias)
+		if err != nil {
+			return
+		}
+		if name != alias && name != location.Name {
+			err = errors.New(fmt.Sprintf("'%s' is already an alias of '%s'", alias, name))
+			return
+		}
+		if _, errGet := db.GetLocationMetadataByName(alias); errGet == nil {
+			err = errors.New(fmt.Sprintf("'%s' is already a location", alias))
+			return
+		}
+	}
+	err = db.SetLocationMetadata(location)
+	if err != nil {
+		err = errors.Wrap(err, "could not save location")
+		return
+	}
+	saved, err = db.GetLocationMetadataByName(location.Name)
+	return
+}
+
+// RenameLocation moves the learning data of a location to a new name and
+// schedules a calibration. The old name becomes an alias of the location,
+// so learning data that still uses it is saved under the new name.
+func RenameLocation(db *database.Database, family string, oldName string, newName string, source string) (affected int64, err error) {
+	oldName = strings.TrimSpace(strings.ToLower(oldName))
+	location, errGet := db.GetLocationMetadataByName(oldName)
+	if errGet != nil {
+		location = models.Location{}
+	}
+	location.Name = newName
+	location.Aliases = append(location.Aliases, oldName)
+	err = location.Validate()
+	if err != nil {
+		return
+	}
+	if location.Name == oldName {
+		err = errors.New("location already has that name")
+		return
+	}
+	if _, errGet := db.GetLocationMetadataByName(location.Name); errGet == nil {
+		err = errors.New(fmt.Sprintf("location '%s' is already registered", location.Name))
+		return
+	}
+
+	affected, err = db.RenameLocation(oldName, location, source)
+	if err != nil {
+		err = errors.Wrap(err, "could not rename location")
+		return
+	}
+	logger.Infof("[%s] renamed %s to %s (%d fingerprints)", family, oldName, location.Name, affected)
+	recalibrateAfterEdit(db, family, affected)
+	return
+}
+
+// GetLocationMetadataFor returns the metadata of the registered locations
+// among the given names, by name
+func GetLocationMetadataFor(db *database.Database, names []string) (metadata map[string]models.Location, err error) {
+	metadata = make(map[string]models.Location)
+	locations, err := db.GetLocationMetadata()
+	if err != nil {
+		err = errors.Wrap(err, "could not get location metadata")
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	for _, location := range locations {
+		if wanted[location.Name] {
+			metadata[location.Name] = location
+		}
+	}
+	return
+}
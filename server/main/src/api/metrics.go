@@ -0,0 +1,30 @@
+package api
+
+import (
+	"github.com/schollz/find4/server/main/src/metrics"
+)
+
+var (
+	aiRequestSeconds = metrics.NewHistogram("find_ai_request_duration_seconds",
+		"Round trip time of the requests to the AI server.", metrics.DefaultBuckets)
+	aiErrors = metrics.NewCounter("find_ai_errors_total",
+		"Requests to the AI server that failed.")
+	aiPending = metrics.NewGauge("find_ai_pending_requests",
+		"Requests waiting for the AI server.")
+	calibrationSeconds = metrics.NewHistogram("find_calibration_duration_seconds",
+		"Time taken by calibrations.", []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}, "family")
+	calibrations = metrics.NewCounter("find_calibrations_total",
+		"Calibrations that finished, by state.", "family", "state")
+	calibrationPercentCorrect = metrics.NewGauge("find_calibration_percent_correct",
+		"Cross validated accuracy of the latest calibration.", "family")
+	fingerprintsIngested = metrics.NewCounter("find_fingerprints_total",
+		"Fingerprints saved, by sensor type.", "family", "sensor")
+)
+
+func init() {
+	metrics.OnCollect(func() {
+		ai_counter_lock.RLock()
+		defer ai_counter_lock.RUnlock()
+		aiPending.Set(float64(AI_PENDING))
+	})
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// PassiveAggregation is the default way to combine the RSSI of a scanner
+// in a window
+var PassiveAggregation = "last"
+
+// PassiveStep is the default step of the passive windows, which are
+// tumbling if it is zero
+var PassiveStep time.Duration
+
+// PassiveWindow is the reversed sensor data of the tracked devices in a
+// window of passive scans
+type PassiveWindow struct {
+	// Start and End are in milliseconds, the end is not included
+	Start int64
+	End   int64
+	Datas []models.SensorData
+}
+
+// observation is an RSSI that a scanner saw for a tracked device
+type observation struct {
+	timestamp int64
+	rssi      float64
+}
+
+// PassiveAggregator gathers the passive scans of a family in memory, until
+// their windows are over. Only its settings are stored in the database.
+type PassiveAggregator struct {
+	rollingData models.ReverseRollingData
+	sync.Mutex
+}
+
+// NewPassiveAggregator returns an aggregator with the passive settings of
+// a family, and the scans that they may still have
+func NewPassiveAggregator(rollingData models.ReverseRollingData) *PassiveAggregator {
+	if rollingData.DeviceLocation == nil {
+		rollingData.DeviceLocation = make(map[string]string)
+	}
+	if rollingData.DeviceGPS == nil {
+		rollingData.DeviceGPS = make(map[string]models.GPS)
+	}
+	return &PassiveAggregator{rollingData: rollingData}
+}
+
+// Add buffers a passive scan, and returns the time block of the windows
+func (a *PassiveAggregator) Add(d models.SensorData) time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	a.rollingData.Datas = append(a.rollingData.Datas, d)
+	a.rollingData.HasData = true
+	return a.rollingData.TimeBlock
+}
+
+// Flush returns the windows that are over, with the settings they were
+// reversed with. The windows end by the latest scan, or by until, in
+// milliseconds, if it is later.
+func (a *PassiveAggregator) Flush(until int64) (windows []PassiveWindow, settings models.ReverseRollingData) {
+	a.Lock()
+	defer a.Unlock()
+	windows = AggregatePassive(&a.rollingData, until)
+	settings = a.settings()
+	return
+}
+
+// Pending returns the number of scans that are buffered
+func (a *PassiveAggregator) Pending() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.rollingData.Datas)
+}
+
+// Settings returns the passive settings, without the buffered scans
+func (a *PassiveAggregator) Settings() models.ReverseRollingData {
+	a.Lock()
+	defer a.Unlock()
+	return a.settings()
+}
+
+// Update changes the passive settings, and returns them to be stored
+func (a *PassiveAggregator) Update(update func(settings *models.ReverseRollingData)) models.ReverseRollingData {
+	a.Lock()
+	defer a.Unlock()
+	update(&a.rollingData)
+	return a.settings()
+}
+
+func (a *PassiveAggregator) settings() (settings models.ReverseRollingData) {
+	settings = a.rollingData
+	settings.HasData = false
+	settings.Datas = nil
+	settings.WindowEnd = 0
+	settings.DeviceLocation = make(map[string]string)
+	for device, location := range a.rollingData.DeviceLocation {
+		settings.DeviceLocation[device] = location
+	}
+	settings.DeviceGPS = make(map[string]models.GPS)
+	for device, gps := range a.rollingData.DeviceGPS {
+		settings.DeviceGPS[device] = gps
+	}
+	return
+}
+
+// AggregatePassive returns the windows that are complete, according to the
+// timestamps of the passive scans or until if it is later, and removes the
+// scans that no later window needs. Each window is as long as the time
+// block and starts a step after the one before it.
+func AggregatePassive(rollingData *models.ReverseRollingData, until int64) (windows []PassiveWindow) {
+	timeBlock := int64(rollingData.TimeBlock / time.Millisecond)
+	step := int64(rollingData.Step / time.Millisecond)
+	if step == 0 {
+		step = int64(PassiveStep / time.Millisecond)
+	}
+	if step <= 0 || step > timeBlock {
+		step = timeBlock
+	}
+	if timeBlock <= 0 || len(rollingData.Datas) == 0 {
+		return
+	}
+	datas := rollingData.Datas
+	sort.SliceStable(datas, func(i, j int) bool {
+		return datas[i].Timestamp < datas[j].Timestamp
+	})
+	if rollingData.WindowEnd == 0 {
+		rollingData.WindowEnd = datas[0].Timestamp + timeBlock
+	}
+
+	// the latest scan shows which windows are over
+	latest := datas[len(datas)-1].Timestamp
+	if until > latest {
+		latest = until
+	}
+	for rollingData.WindowEnd <= latest {
+		start := rollingData.WindowEnd - timeBlock
+		first := sort.Search(len(datas), func(i int) bool { return datas[i].Timestamp >= start })
+		last := sort.Search(len(datas), func(i int) bool { return datas[i].Timestamp >= rollingData.WindowEnd })
+		if first == last {
+			if first == len(datas) {
+				// the later windows have no scans either
+				break
+			}
+			// skip the windows without scans
+			next := datas[first].Timestamp
+			rollingData.WindowEnd += ((next-rollingData.WindowEnd)/step + 1) * step
+			continue
+		}
+		windows = append(windows, PassiveWindow{
+			Start: start,
+			End:   rollingData.WindowEnd,
+			Datas: reverse(rollingData, datas[first:last]),
+		})
+		rollingData.WindowEnd += step
+	}
+
+	// scans before the next window are not needed anymore
+	start := rollingData.WindowEnd - timeBlock
+	first := sort.Search(len(datas), func(i int) bool { return datas[i].Timestamp >= start })
+	rollingData.Datas = append([]models.SensorData{}, datas[first:]...)
+	rollingData.HasData = len(rollingData.Datas) > 0
+	return
+}
+
+// reverse turns the scans of the scanners into sensor data of the devices
+// they saw, with the aggregated RSSI of each scanner
+func reverse(rollingData *models.ReverseRollingData, datas []models.SensorData) (reversed []models.SensorData) {
+	// tracked device -> sensor -> scanner -> observations
+	seen := make(map[string]map[string]map[string][]observation)
+	for _, data := range datas {
+		for sensor := range data.Sensors {
+			for mac, value := range data.Sensors[sensor] {
+				rssi, ok := toFloat(value)
+				if !ok {
+					continue
+				}
+				trackedDeviceName := sensor + "-" + mac
+				if _, ok := seen[trackedDeviceName]; !ok {
+					seen[trackedDeviceName] = make(map[string]map[string][]observation)
+				}
+				if _, ok := seen[trackedDeviceName][sensor]; !ok {
+					seen[trackedDeviceName][sensor] = make(map[string][]observation)
+				}
+				scanner := data.Device + "-" + sensor
+				seen[trackedDeviceName][sensor][scanner] = append(seen[trackedDeviceName][sensor][scanner], observation{data.Timestamp, rssi})
+			}
+		}
+	}
+
+	aggregation := rollingData.Aggregation
+	if aggregation == "" {
+		aggregation = PassiveAggregation
+	}
+	devices := make([]string, 0, len(seen))
+	for device := range seen {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		d := models.SensorData{
+			Family:   rollingData.Family,
+			Device:   device,
+			Sensors:  make(map[string]map[string]interface{}),
+			Location: rollingData.DeviceLocation[device],
+			GPS:      rollingData.DeviceGPS[device],
+		}
+		for sensor, scanners := range seen[device] {
+			d.Sensors[sensor] = make(map[string]interface{})
+			for scanner, observations := range scanners {
+				d.Sensors[sensor][scanner] = aggregate(aggregation, observations)
+			}
+		}
+		reversed = append(reversed, d)
+	}
+	return
+}
+
+// aggregate combines the observations of a scanner, which are in order
+func aggregate(aggregation string, observations []observation) float64 {
+	switch aggregation {
+	case "mean":
+		sum := 0.0
+		for _, o := range observations {
+			sum += o.rssi
+		}
+		return sum / float64(len(observations))
+	case "median":
+		values := make([]float64, len(observations))
+		for i, o := range observations {
+			values[i] = o.rssi
+		}
+		sort.Float64s(values)
+		if len(values)%2 == 1 {
+			return values[len(values)/2]
+		}
+		return (values[len(values)/2-1] + values[len(values)/2]) / 2
+	case "max":
+		max := observations[0].rssi
+		for _, o := range observations[1:] {
+			if o.rssi > max {
+				max = o.rssi
+			}
+		}
+		return max
+	case "count":
+		return float64(len(observations))
+	default:
+		return observations[len(observations)-1].rssi
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
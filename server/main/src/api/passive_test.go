@@ -0,0 +1,123 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func passiveScan(timestamp int64, scanner string, rssi float64) models.SensorData {
+	return models.SensorData{
+		Timestamp: timestamp,
+		Device:    scanner,
+		Sensors:   map[string]map[string]interface{}{"wifi": {"aa:bb": rssi}},
+	}
+}
+
+func TestAggregatePassive(t *testing.T) {
+	rollingData := models.ReverseRollingData{
+		Family:         "testpassive",
+		TimeBlock:      10 * time.Second,
+		DeviceLocation: map[string]string{"wifi-aa:bb": "kitchen"},
+		Datas: []models.SensorData{
+			passiveScan(1000, "pi1", -60),
+			passiveScan(5000, "pi1", -50),
+			passiveScan(3000, "pi2", -70),
+		},
+	}
+
+	// the window is not over until a later scan arrives
+	assert.Equal(t, 0, len(AggregatePassive(&rollingData, 0)))
+	assert.Equal(t, int64(11000), rollingData.WindowEnd)
+	assert.Equal(t, 3, len(rollingData.Datas))
+
+	// scans that arrive out of order are in the window of their timestamp
+	rollingData.Datas = append(rollingData.Datas, passiveScan(12000, "pi1", -40), passiveScan(8000, "pi1", -55))
+	windows := AggregatePassive(&rollingData, 0)
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, int64(1000), windows[0].Start)
+	assert.Equal(t, int64(11000), windows[0].End)
+	assert.Equal(t, 1, len(windows[0].Datas))
+	d := windows[0].Datas[0]
+	assert.Equal(t, "wifi-aa:bb", d.Device)
+	assert.Equal(t, "kitchen", d.Location)
+	assert.Equal(t, map[string]interface{}{"pi1-wifi": -55.0, "pi2-wifi": -70.0}, d.Sensors["wifi"])
+	assert.Equal(t, int64(21000), rollingData.WindowEnd)
+	assert.Equal(t, 1, len(rollingData.Datas))
+
+	// windows without scans are skipped
+	rollingData.Datas = append(rollingData.Datas, passiveScan(95000, "pi1", -45))
+	windows = AggregatePassive(&rollingData, 0)
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, int64(11000), windows[0].Start)
+	assert.Equal(t, int64(101000), rollingData.WindowEnd)
+	assert.Equal(t, 1, len(rollingData.Datas))
+
+	// the windows that are over by until do not wait for a later scan
+	windows = AggregatePassive(&rollingData, 200000)
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, int64(91000), windows[0].Start)
+	assert.Equal(t, 0, len(rollingData.Datas))
+}
+
+func TestAggregatePassiveSliding(t *testing.T) {
+	rollingData := models.ReverseRollingData{
+		TimeBlock: 10 * time.Second,
+		Step:      5 * time.Second,
+		Datas: []models.SensorData{
+			passiveScan(0, "pi1", -60),
+			passiveScan(4000, "pi1", -50),
+			passiveScan(7000, "pi1", -40),
+			passiveScan(9000, "pi1", -80),
+			passiveScan(16000, "pi1", -70),
+		},
+	}
+	var values []interface{}
+	for _, aggregation := range []string{"last", "mean", "median", "max", "count"} {
+		data := rollingData
+		data.Datas = append([]models.SensorData{}, rollingData.Datas...)
+		data.Aggregation = aggregation
+		windows := AggregatePassive(&data, 0)
+		// windows [0,10s) and [5s,15s) are over
+		assert.Equal(t, 2, len(windows))
+		assert.Equal(t, int64(5000), windows[1].Start)
+		values = append(values, windows[0].Datas[0].Sensors["wifi"]["pi1-wifi"])
+		assert.Equal(t, int64(20000), data.WindowEnd)
+		assert.Equal(t, 1, len(data.Datas))
+	}
+	assert.Equal(t, []interface{}{-80.0, -57.5, -55.0, -40.0, 4.0}, values)
+}
+
+func TestPassiveAggregator(t *testing.T) {
+	aggregator := NewPassiveAggregator(models.ReverseRollingData{TimeBlock: 10 * time.Second})
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			aggregator.Add(passiveScan(int64(i*1000), "pi1", -50))
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	assert.Equal(t, 10, aggregator.Pending())
+
+	// the settings do not have the scans
+	settings := aggregator.Update(func(settings *models.ReverseRollingData) {
+		settings.DeviceLocation["wifi-aa:bb"] = "kitchen"
+	})
+	assert.Nil(t, settings.Datas)
+	assert.False(t, settings.HasData)
+	assert.Equal(t, "kitchen", settings.DeviceLocation["wifi-aa:bb"])
+	settings.DeviceLocation["wifi-aa:bb"] = "changed"
+	assert.Equal(t, "kitchen", aggregator.Settings().DeviceLocation["wifi-aa:bb"])
+
+	aggregator.Add(passiveScan(20000, "pi1", -50))
+	windows, settings := aggregator.Flush(0)
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, "kitchen", windows[0].Datas[0].Location)
+	assert.Equal(t, 10*time.Second, settings.TimeBlock)
+	assert.Equal(t, 1, aggregator.Pending())
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/schollz/find4/server/main/src/logging"
 	"github.com/sjsafranek/pool"
 )
 
@@ -16,44 +17,58 @@ var (
 	AI_POOL           pool.Pool
 	AI_PENDING        int = 0
 	ai_counter_lock   sync.RWMutex
+	ai_pool_lock      sync.Mutex
 )
 
-func init() {
-	factory := func() (net.Conn, error) { return net.Dial("tcp", AI_SERVER_ADDRESS) }
-	pool, err := pool.NewChannelPool(4, 10, factory)
-	if nil != err {
-		panic(err)
+// getAIPool returns the pool of connections to the AI server. It is made
+// on first use, so that it connects to the address from the settings.
+func getAIPool() (pool.Pool, error) {
+	ai_pool_lock.Lock()
+	defer ai_pool_lock.Unlock()
+	if nil == AI_POOL {
+		factory := func() (net.Conn, error) { return net.Dial("tcp", AI_SERVER_ADDRESS) }
+		aiPool, err := pool.NewChannelPool(4, 10, factory)
+		if nil != err {
+			return nil, fmt.Errorf("could not connect to ai server at %s: %s", AI_SERVER_ADDRESS, err.Error())
+		}
+		AI_POOL = aiPool
 	}
-	AI_POOL = pool
+	return AI_POOL, nil
 }
 
 const RETRY_LIMIT int = 2
 
-func aiSendAndRecieveWithRetry(query string, attempt int) (string, error) {
+func aiSendAndRecieveWithRetry(log *logging.Logger, query string, attempt int) (string, error) {
 
 	if RETRY_LIMIT < attempt {
 		err := errors.New("retry limit reached")
-		logger.Error(err)
-		logger.Error(query)
+		log.Error(err)
+		log.Error(query)
 		return "", err
 	}
 
-	conn, err := AI_POOL.Get()
+	aiPool, err := getAIPool()
 	if nil != err {
-		panic(err)
+		log.Error(err)
+		return "", err
+	}
+	conn, err := aiPool.Get()
+	if nil != err {
+		log.Error(err)
+		return "", err
 	}
 	defer conn.Close()
-	logger.Debug("got socket connection")
+	log.Debug("got socket connection")
 
 	payload := fmt.Sprintf("%v\r\n", query)
 	fmt.Fprintf(conn, payload)
 
 	results, err := bufio.NewReader(conn).ReadString('\n')
 	if nil != err {
-		logger.Error(err)
+		log.Error(err)
 		attempt++
-		logger.Warn("unable to read from socket")
-		logger.Warn("removing socket from pool")
+		log.Warn("unable to read from socket")
+		log.Warn("removing socket from pool")
 		pc := conn.(*pool.PoolConn)
 		pc.MarkUnusable()
 		pc.Close()
@@ -61,7 +76,7 @@ func aiSendAndRecieveWithRetry(query string, attempt int) (string, error) {
 		// exponential backoff
 		time.Sleep(time.Duration(attempt*attempt) * time.Second)
 
-		return aiSendAndRecieveWithRetry(query, attempt)
+		return aiSendAndRecieveWithRetry(log, query, attempt)
 	}
 
 	// TODO
@@ -69,7 +84,7 @@ func aiSendAndRecieveWithRetry(query string, attempt int) (string, error) {
 	//  - retry doesn't seem to address this
 	//  - find out why sockets stop responding...
 	if pc, ok := conn.(*pool.PoolConn); !ok {
-		logger.Warn("socket is unusable, removing from pool")
+		log.Warn("socket is unusable, removing from pool")
 		pc.MarkUnusable()
 		pc.Close()
 	}
@@ -83,23 +98,33 @@ func aiSendAndRecieveWithRetry(query string, attempt int) (string, error) {
 	return results, nil
 }
 
-func aiSendAndRecieve(query string) (string, error) {
+// aiSendAndRecieve sends a query to the AI server and returns its answer.
+// The query and answer are logged with the fields of log, such as the request id.
+func aiSendAndRecieve(log *logging.Logger, query string) (string, error) {
 	// TODO
 	//  - block duplicate calls
-	logger.Tracef("IN  %v", query)
-	logger.Debug("sending message to ai server")
+	log.Tracef("IN  %v", query)
+	log.Debug("sending message to ai server")
 
 	ai_counter_lock.Lock()
 	AI_PENDING++
 	ai_counter_lock.Unlock()
 
-	results, err := aiSendAndRecieveWithRetry(query, 1)
+	start := time.Now()
+	results, err := aiSendAndRecieveWithRetry(log, query, 1)
+	aiRequestSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		aiErrors.Inc()
+		log.Warnf("ai server failed after %s: %s", time.Since(start), err.Error())
+	} else {
+		log.Debugf("ai server answered in %s", time.Since(start))
+	}
 
 	ai_counter_lock.Lock()
 	AI_PENDING--
 	ai_counter_lock.Unlock()
 
-	logger.Tracef("OUT %v", results)
+	log.Tracef("OUT %v", results)
 	return results, err
 }
 
@@ -119,6 +144,11 @@ func init() {
 }
 
 func Shutdown() {
+	ai_pool_lock.Lock()
+	defer ai_pool_lock.Unlock()
+	if nil == AI_POOL {
+		return
+	}
 	logger.Warn("Closing connection pool...")
 	AI_POOL.Close()
 }
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58/base58"
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/schollz/find4/server/main/src/utils"
+)
+
+var (
+	// PrivacyRetention is how long the fingerprints of hashed devices are
+	// kept, for the families that do not set it
+	PrivacyRetention = 24 * time.Hour
+	// PrivacyRotation is how often the key of the hashes changes, for the
+	// families that do not set it
+	PrivacyRotation = 24 * time.Hour
+)
+
+// privacyKey is the key of the keystore with the privacy mode
+const privacyKey = "Privacy"
+
+// privacyLock keeps the salt from being rotated twice at the same time
+var privacyLock sync.Mutex
+
+// salts are the keys of the hashes of the families, by family, which are
+// read from their files once and kept until they are rotated
+var salts = make(map[string]privacySalt)
+
+// GetPrivacy returns the privacy mode of a family, with the default
+// retention and rotation if it does not set them
+func GetPrivacy(db *database.Database) (privacy models.Privacy) {
+	if err := db.Get(privacyKey, &privacy); err != nil {
+		privacy = models.Privacy{}
+	}
+	if privacy.Retention == 0 {
+		privacy.Retention = PrivacyRetention
+	}
+	if privacy.Rotation == 0 {
+		privacy.Rotation = PrivacyRotation
+	}
+	return
+}
+
+// SetPrivacy enables or disables the privacy mode of a family. A retention
+// or rotation of 0 uses the default.
+func SetPrivacy(db *database.Database, enabled bool, retention time.Duration, rotation time.Duration) (privacy models.Privacy, err error) {
+	if retention < 0 || (retention > 0 && retention < time.Minute) {
+		err = errors.New("retention must be at least a minute")
+		return
+	}
+	if rotation < 0 || (rotation > 0 && rotation < time.Minute) {
+		err = errors.New("rotation must be at least a minute")
+		return
+	}
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+	if err = db.Get(privacyKey, &privacy); err != nil {
+		privacy = models.Privacy{}
+	}
+	privacy.Enabled = enabled
+	privacy.Retention = retention
+	privacy.Rotation = rotation
+	if err = db.Set(privacyKey, privacy); err != nil {
+		err = errors.Wrap(err, "could not save privacy mode")
+		return
+	}
+	db.Sync()
+	privacy = GetPrivacy(db)
+	return
+}
+
+// privacySalt is the key of the hashes of a family since Start. It is kept
+// in a file next to the models, out of the database, so that the dumps do
+// not have it.
+type privacySalt struct {
+	Salt  string    `json:"salt"`
+	Start time.Time `json:"start"`
+}
+
+// saltFile is the file with the key of the hashes of a family
+func saltFile(family string) string {
+	return path.Join(DataFolder, base58.FastBase58Encoding([]byte(family))+".find3.salt")
+}
+
+// getSalt returns the key of the hashes of a family, which is replaced
+// once it is older than the rotation, so that hashes cannot be linked
+// across rotations
+func getSalt(family string, privacy models.Privacy) (salt []byte, err error) {
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+	stored, ok := salts[family]
+	if !ok {
+		if b, errRead := ioutil.ReadFile(saltFile(family)); errRead != nil || json.Unmarshal(b, &stored) != nil {
+			stored = privacySalt{}
+		}
+	}
+	if stored.Salt != "" && time.Since(stored.Start) < privacy.Rotation {
+		salts[family] = stored
+		return hex.DecodeString(stored.Salt)
+	}
+
+	salt = make([]byte, 32)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	stored = privacySalt{Salt: hex.EncodeToString(salt), Start: time.Now().UTC()}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(saltFile(family), b, 0600); err != nil {
+		err = errors.Wrap(err, "could not save privacy salt")
+		return
+	}
+	salts[family] = stored
+	return
+}
+
+// forgetSalts forgets the keys of the hashes of the families, so that
+// they are read from their files again
+func forgetSalts(families ...string) {
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+	for _, family := range families {
+		delete(salts, family)
+	}
+}
+
+// RenameSalt renames the key of the hashes of a family
+func RenameSalt(from string, to string) (err error) {
+	forgetSalts(from, to)
+	err = os.Rename(saltFile(from), saltFile(to))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// DeleteSalt deletes the key of the hashes of a family
+func DeleteSalt(family string) (err error) {
+	forgetSalts(family)
+	err = os.Remove(saltFile(family))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// hashMAC returns the hash of a MAC with the salt
+func hashMAC(salt []byte, mac string) string {
+	h := hmac.New(sha256.New, salt)
+	h.Write([]byte(strings.ToLower(mac)))
+	return "hash-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// ouiOf returns the vendor prefix of a MAC
+func ouiOf(mac string) string {
+	octets := strings.Split(mac, ":")
+	if len(octets) != 6 {
+		return ""
+	}
+	return strings.ToLower(strings.Join(octets[:3], ":"))
+}
+
+// Anonymize replaces the MACs that a passive scanner saw by their hashes,
+// if the family is in privacy mode. The devices that are learned or in
+// the device registry keep their MACs.
+func Anonymize(db *database.Database, d models.SensorData, learning map[string]string) (anonymized models.SensorData, err error) {
+	anonymized = d
+	privacy := GetPrivacy(db)
+	if !privacy.Enabled {
+		return
+	}
+	salt, err := getSalt(d.Family, privacy)
+	if err != nil {
+		return
+	}
+	var devices []string
+	for sensorType := range d.Sensors {
+		for mac := range d.Sensors[sensorType] {
+			devices = append(devices, sensorType+"-"+mac)
+		}
+	}
+	registry, err := db.GetDeviceMetadataOf(devices)
+	if err != nil {
+		err = errors.Wrap(err, "could not get device registry")
+		return
+	}
+
+	now := time.Now().UTC()
+	var private []models.PrivateDevice
+	anonymized.Sensors = make(map[string]map[string]interface{}, len(d.Sensors))
+	for sensorType := range d.Sensors {
+		anonymized.Sensors[sensorType] = make(map[string]interface{}, len(d.Sensors[sensorType]))
+		for mac, value := range d.Sensors[sensorType] {
+			device := sensorType + "-" + mac
+			if _, ok := learning[device]; ok {
+				anonymized.Sensors[sensorType][mac] = value
+				continue
+			}
+			if _, ok := registry[device]; ok {
+				anonymized.Sensors[sensorType][mac] = value
+				continue
+			}
+			hashed := hashMAC(salt, mac)
+			anonymized.Sensors[sensorType][hashed] = value
+			private = append(private, models.PrivateDevice{
+				ID:         sensorType + "-" + hashed,
+				OUI:        ouiOf(mac),
+				Randomized: utils.IsMacRandomized(mac),
+				LastSeen:   now,
+			})
+		}
+	}
+	db.AddPrivateDevices(private)
+	return
+}
+
+// ExpirePrivate deletes the fingerprints of the hashed devices of a family
+// that are older than its retention. It returns the number of deleted
+// fingerprints.
+func ExpirePrivate(db *database.Database) (deleted int64, err error) {
+	privacy := GetPrivacy(db)
+	return db.ExpirePrivateDevices(time.Now().Add(-privacy.Retention))
+}
+
+// NextPrivateExpiry returns when the next fingerprint of a hashed device
+// of a family expires, which is zero if there are none
+func NextPrivateExpiry(db *database.Database) (next time.Time, err error) {
+	oldest, err := db.OldestPrivate()
+	if err != nil || oldest.IsZero() {
+		return
+	}
+	next = oldest.Add(GetPrivacy(db).Retention)
+	return
+}
+
+// privateDevices returns the hashed devices among the devices
+func privateDevices(db *database.Database, devices []string) (map[string]models.PrivateDevice, error) {
+	private, err := db.GetPrivateDevices(devices)
+	return private, errors.Wrap(err, "could not get private devices")
+}
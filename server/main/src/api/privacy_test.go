@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashMAC(t *testing.T) {
+	hashed := hashMAC([]byte("salt"), "AA:BB:CC:DD:EE:FF")
+	assert.Equal(t, hashed, hashMAC([]byte("salt"), "aa:bb:cc:dd:ee:ff"))
+	assert.NotEqual(t, hashed, hashMAC([]byte("other salt"), "aa:bb:cc:dd:ee:ff"))
+	assert.Equal(t, len("hash-0123456789abcdef"), len(hashed))
+	assert.Equal(t, "aa:bb:cc", ouiOf("AA:BB:CC:DD:EE:FF"))
+	assert.Equal(t, "", ouiOf("pi1"))
+}
+
+func TestAnonymize(t *testing.T) {
+	folder, err := ioutil.TempDir("", "privacy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+	DataFolder = folder
+	defer func() { DataFolder = "." }()
+
+	db, err := database.Open("privacy")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	d := models.SensorData{
+		Family: "privacy",
+		Device: "pi1",
+		Sensors: map[string]map[string]interface{}{"wifi": {
+			"88:d7:f6:a7:2a:48": -50,
+			"da:00:00:00:00:02": -60,
+			"40:4e:36:89:63:a5": -70,
+		}},
+	}
+
+	// the MACs are kept unless the family is in privacy mode
+	anonymized, err := Anonymize(db, d, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, d, anonymized)
+
+	privacy, err := SetPrivacy(db, true, time.Hour, 0)
+	assert.Nil(t, err)
+	assert.True(t, privacy.Enabled)
+	assert.Equal(t, time.Hour, privacy.Retention)
+	assert.Equal(t, PrivacyRotation, privacy.Rotation)
+	_, err = SetPrivacy(db, true, time.Second, 0)
+	assert.NotNil(t, err)
+
+	anonymized, err = Anonymize(db, d, map[string]string{"wifi-40:4e:36:89:63:a5": "desk"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(anonymized.Sensors["wifi"]))
+	assert.Equal(t, -70, anonymized.Sensors["wifi"]["40:4e:36:89:63:a5"])
+	registered, err := Anonymize(db, d, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, registered.Sensors["wifi"]["40:4e:36:89:63:a5"])
+	assert.Nil(t, db.SetDeviceMetadata(models.Device{ID: "wifi-40:4e:36:89:63:a5"}))
+	registered, err = Anonymize(db, d, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, -70, registered.Sensors["wifi"]["40:4e:36:89:63:a5"])
+	assert.Nil(t, db.DeleteDeviceMetadata("wifi-40:4e:36:89:63:a5"))
+	assert.Nil(t, anonymized.Sensors["wifi"]["88:d7:f6:a7:2a:48"])
+	assert.Equal(t, -50, d.Sensors["wifi"]["88:d7:f6:a7:2a:48"])
+
+	salt, err := getSalt("privacy", GetPrivacy(db))
+	assert.Nil(t, err)
+	hashed := "wifi-" + hashMAC(salt, "88:d7:f6:a7:2a:48")
+	randomized := "wifi-" + hashMAC(salt, "da:00:00:00:00:02")
+	db.Sync()
+	private, err := db.GetPrivateDevices([]string{hashed, randomized, "wifi-40:4e:36:89:63:a5"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(private))
+	assert.Equal(t, "88:d7:f6", private[hashed].OUI)
+	assert.False(t, private[hashed].Randomized)
+	assert.True(t, private[randomized].Randomized)
+
+	// the salt is kept until it is rotated
+	again, err := Anonymize(db, d, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, -50, again.Sensors["wifi"][hashMAC(salt, "88:d7:f6:a7:2a:48")])
+	// the salt is kept in memory, and read from its file once
+	assert.Nil(t, os.Remove(saltFile("privacy")))
+	cached, err := getSalt("privacy", GetPrivacy(db))
+	assert.Nil(t, err)
+	assert.Equal(t, salt, cached)
+	forgetSalts("privacy")
+	old, err := json.Marshal(privacySalt{Salt: hex.EncodeToString(salt), Start: time.Now().Add(-2 * PrivacyRotation)})
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(saltFile("privacy"), old, 0600))
+	rotated, err := getSalt("privacy", GetPrivacy(db))
+	assert.Nil(t, err)
+	assert.NotEqual(t, salt, rotated)
+	forgetSalts("privacy")
+	again, err = Anonymize(db, d, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, -50, again.Sensors["wifi"][hashMAC(rotated, "88:d7:f6:a7:2a:48")])
+	assert.True(t, GetPrivacy(db).Enabled)
+	assert.Equal(t, time.Hour, GetPrivacy(db).Retention)
+
+	// the salt is not in the database, which is dumped
+	db.Sync()
+	var stored map[string]interface{}
+	assert.Nil(t, db.Get(privacyKey, &stored))
+	assert.Nil(t, stored["salt"])
+	stat, err := os.Stat(saltFile("privacy"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
+
+func TestExpirePrivate(t *testing.T) {
+	folder, err := ioutil.TempDir("", "privacy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	db, err := database.Open("privacy")
+	assert.Nil(t, err)
+	defer db.Close()
+	_, err = SetPrivacy(db, true, time.Hour, 0)
+	assert.Nil(t, err)
+
+	old := time.Now().Add(-2 * time.Hour)
+	db.AddPrivateDevices([]models.PrivateDevice{
+		{ID: "wifi-hash-0000000000000001", LastSeen: old},
+		{ID: "wifi-hash-0000000000000002", LastSeen: time.Now()},
+	})
+	oldMs := old.UnixNano() / int64(time.Millisecond)
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, s := range []models.SensorData{
+		{Timestamp: oldMs, Device: "wifi-hash-0000000000000001"},
+		{Timestamp: oldMs + 1, Device: "wifi-hash-0000000000000002"},
+		{Timestamp: nowMs, Device: "wifi-hash-0000000000000002"},
+		{Timestamp: oldMs + 2, Device: "wifi-88:d7:f6:a7:2a:48"},
+	} {
+		s.Family = "privacy"
+		s.Sensors = map[string]map[string]interface{}{"wifi": {"pi1-wifi": -50 - i}}
+		assert.Nil(t, db.AddSensor(s))
+	}
+	db.Sync()
+
+	deleted, err := ExpirePrivate(db)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	// the devices that were not hashed are kept
+	datas, err := db.GetSensorsSince(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(datas))
+	assert.Equal(t, "wifi-88:d7:f6:a7:2a:48", datas[0].Device)
+	private, err := db.GetPrivateDevices([]string{"wifi-hash-0000000000000001", "wifi-hash-0000000000000002"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(private))
+}
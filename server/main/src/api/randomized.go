@@ -0,0 +1,256 @@
+package api
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/schollz/find4/server/main/src/utils"
+)
+
+var (
+	// RandomizedClusterPeriod is how far back the randomized MACs are
+	// clustered into pseudo devices
+	RandomizedClusterPeriod = time.Hour
+	// RandomizedMaxGap is the longest a device goes unseen when it changes
+	// its randomized MAC
+	RandomizedMaxGap = 2 * time.Minute
+	// RandomizedMaxRSSIDistance is the largest RMS difference, in dB, of the
+	// RSSI that the scanners saw for the old and the new MAC
+	RandomizedMaxRSSIDistance = 8.0
+)
+
+// randomizedOverlap is how long two MACs can be seen together and still
+// be one device, since the scans of a window have about the same time
+const randomizedOverlap = int64(time.Second / time.Millisecond)
+
+// macTrack is a randomized MAC, with the RSSI that each scanner saw when
+// it appeared and before it disappeared
+type macTrack struct {
+	mac         string
+	sensorType  string
+	first, last int64
+	firstRSSI   map[string]float64
+	lastRSSI    map[string]float64
+}
+
+// pseudoCluster are the MACs of one device, chained by when they appeared
+type pseudoCluster struct {
+	id   string
+	tail *macTrack
+}
+
+// pseudoDeviceID returns the id of a pseudo device that starts with a MAC,
+// like wifi-pseudo-0123456789abcdef
+func pseudoDeviceID(sensorType string, mac string) string {
+	sum := sha1.Sum([]byte(mac))
+	return sensorType + "-pseudo-" + hex.EncodeToString(sum[:8])
+}
+
+// ClusterRandomized assigns the randomized MACs seen since a timestamp,
+// in milliseconds, to pseudo devices. A MAC continues the device of a MAC
+// that stopped being seen shortly before it appeared, and that the same
+// scanners saw with about the same RSSI. MACs keep the pseudo device they
+// were assigned to. It returns the pseudo device of each MAC.
+func ClusterRandomized(db *database.Database, since int64) (pseudoDevices map[string]string, err error) {
+	datas, err := db.GetSensorsSince(since)
+	if err != nil {
+		err = errors.Wrap(err, "could not get sensors")
+		return
+	}
+	devices := make(map[string]struct{})
+	for _, d := range datas {
+		devices[d.Device] = struct{}{}
+	}
+	deviceList := make([]string, 0, len(devices))
+	for device := range devices {
+		deviceList = append(deviceList, device)
+	}
+	private, err := privateDevices(db, deviceList)
+	if err != nil {
+		return
+	}
+	tracks := trackRandomized(datas, func(device string) bool {
+		if p, ok := private[device]; ok {
+			return p.Randomized
+		}
+		return utils.IsMacRandomized(device)
+	})
+	macs := make([]string, len(tracks))
+	for i, track := range tracks {
+		macs[i] = track.mac
+	}
+	known, err := db.GetPseudoDevices(macs)
+	if err != nil {
+		err = errors.Wrap(err, "could not get pseudo devices")
+		return
+	}
+	pseudoDevices = clusterTracks(tracks, known)
+
+	assigned := make(map[string]string)
+	for mac, id := range pseudoDevices {
+		if known[mac] != id {
+			assigned[mac] = id
+		}
+	}
+	err = errors.Wrap(db.SetPseudoDevices(assigned), "could not save pseudo devices")
+	return
+}
+
+// ClusterRecentRandomized clusters the randomized MACs seen within the
+// RandomizedClusterPeriod before the last fingerprint, and forgets the
+// pseudo devices of the MACs that were not. It returns the timestamp of
+// the last fingerprint, which is zero without fingerprints.
+func ClusterRecentRandomized(db *database.Database) (last int64, err error) {
+	last, err = db.GetLastSensorTimestamp()
+	if errors.Cause(err) == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		err = errors.Wrap(err, "could not get last fingerprint")
+		return
+	}
+	since := last - int64(RandomizedClusterPeriod/time.Millisecond)
+	if _, err = ClusterRandomized(db, since); err != nil {
+		return
+	}
+	err = errors.Wrap(db.DeleteOldPseudoDevices(since), "could not delete old pseudo devices")
+	return
+}
+
+// trackRandomized returns the tracks of the randomized MACs, in the order
+// they appeared
+func trackRandomized(datas []models.SensorData, isRandomized func(device string) bool) (tracks []*macTrack) {
+	byMAC := make(map[string][]models.SensorData)
+	for _, d := range datas {
+		if isRandomized(d.Device) {
+			byMAC[d.Device] = append(byMAC[d.Device], d)
+		}
+	}
+	edge := int64(RandomizedMaxGap / time.Millisecond)
+	for mac, fingerprints := range byMAC {
+		sort.Slice(fingerprints, func(i, j int) bool {
+			return fingerprints[i].Timestamp < fingerprints[j].Timestamp
+		})
+		track := &macTrack{
+			mac:        mac,
+			sensorType: strings.SplitN(mac, "-", 2)[0],
+			first:      fingerprints[0].Timestamp,
+			last:       fingerprints[len(fingerprints)-1].Timestamp,
+		}
+		var first, last []models.SensorData
+		for _, d := range fingerprints {
+			if d.Timestamp <= track.first+edge {
+				first = append(first, d)
+			}
+			if d.Timestamp >= track.last-edge {
+				last = append(last, d)
+			}
+		}
+		track.firstRSSI = meanRSSI(first)
+		track.lastRSSI = meanRSSI(last)
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		if tracks[i].first == tracks[j].first {
+			return tracks[i].mac < tracks[j].mac
+		}
+		return tracks[i].first < tracks[j].first
+	})
+	return
+}
+
+// meanRSSI returns the mean RSSI of each scanner in the fingerprints
+func meanRSSI(datas []models.SensorData) map[string]float64 {
+	sums := make(map[string]float64)
+	counts := make(map[string]float64)
+	for _, d := range datas {
+		for sensorType := range d.Sensors {
+			for key, value := range d.Sensors[sensorType] {
+				if rssi, ok := toFloat(value); ok {
+					sums[sensorType+"/"+key] += rssi
+					counts[sensorType+"/"+key]++
+				}
+			}
+		}
+	}
+	for key := range sums {
+		sums[key] /= counts[key]
+	}
+	return sums
+}
+
+// rssiDistance is the RMS difference of the RSSI of the scanners that saw
+// both, and the number of those scanners
+func rssiDistance(a, b map[string]float64) (distance float64, common int) {
+	for key, rssi := range a {
+		if other, ok := b[key]; ok {
+			distance += (rssi - other) * (rssi - other)
+			common++
+		}
+	}
+	if common == 0 {
+		return math.Inf(1), 0
+	}
+	return math.Sqrt(distance / float64(common)), common
+}
+
+// clusterTracks chains the tracks into pseudo devices. The tracks that
+// already have a pseudo device keep it, the others continue the device
+// whose last MAC fits them best or start a new one.
+func clusterTracks(tracks []*macTrack, known map[string]string) (pseudoDevices map[string]string) {
+	pseudoDevices = make(map[string]string)
+	var clusters []*pseudoCluster
+	byID := make(map[string]*pseudoCluster)
+	maxGap := int64(RandomizedMaxGap / time.Millisecond)
+	for _, track := range tracks {
+		if id, ok := known[track.mac]; ok {
+			if cluster, ok := byID[id]; ok {
+				if track.last > cluster.tail.last {
+					cluster.tail = track
+				}
+			} else {
+				byID[id] = &pseudoCluster{id: id, tail: track}
+				clusters = append(clusters, byID[id])
+			}
+			pseudoDevices[track.mac] = id
+			continue
+		}
+
+		var best *pseudoCluster
+		bestScore := math.Inf(1)
+		for _, cluster := range clusters {
+			tail := cluster.tail
+			if tail.sensorType != track.sensorType {
+				continue
+			}
+			// a device uses one MAC at a time
+			gap := track.first - tail.last
+			if gap < -randomizedOverlap || gap > maxGap {
+				continue
+			}
+			distance, common := rssiDistance(tail.lastRSSI, track.firstRSSI)
+			if common == 0 || distance > RandomizedMaxRSSIDistance {
+				continue
+			}
+			score := distance/RandomizedMaxRSSIDistance + float64(gap)/float64(maxGap)
+			if score < bestScore {
+				best, bestScore = cluster, score
+			}
+		}
+		if best == nil {
+			best = &pseudoCluster{id: pseudoDeviceID(track.sensorType, track.mac)}
+			byID[best.id] = best
+			clusters = append(clusters, best)
+		}
+		best.tail = track
+		pseudoDevices[track.mac] = best.id
+	}
+	return
+}
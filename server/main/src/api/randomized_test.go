@@ -0,0 +1,106 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/schollz/find4/server/main/src/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomizedScan(t int64, mac string, pi1, pi2 float64) models.SensorData {
+	return models.SensorData{
+		Timestamp: t,
+		Family:    "randomized",
+		Device:    mac,
+		Sensors:   map[string]map[string]interface{}{"wifi": {"pi1-wifi": pi1, "pi2-wifi": pi2}},
+	}
+}
+
+// randomizedScans are two phones: the first changes its MAC twice, the
+// second keeps its MAC, and a vendor MAC is not clustered
+var randomizedScans = []models.SensorData{
+	randomizedScan(0, "wifi-02:00:00:00:00:01", -50, -70),
+	randomizedScan(30000, "wifi-02:00:00:00:00:01", -52, -71),
+	randomizedScan(0, "wifi-da:00:00:00:00:02", -80, -40),
+	randomizedScan(0, "wifi-00:11:22:33:44:55", -50, -70),
+	randomizedScan(90000, "wifi-06:00:00:00:00:03", -51, -69),
+	randomizedScan(150000, "wifi-06:00:00:00:00:03", -50, -70),
+	randomizedScan(180000, "wifi-da:00:00:00:00:02", -81, -41),
+	// this one appears too long after the others to continue them
+	randomizedScan(600000, "wifi-0a:00:00:00:00:04", -50, -70),
+}
+
+func TestClusterTracks(t *testing.T) {
+	tracks := trackRandomized(randomizedScans, utils.IsMacRandomized)
+	assert.Equal(t, 4, len(tracks))
+	assert.Equal(t, int64(0), tracks[0].first)
+	assert.Equal(t, int64(30000), tracks[0].last)
+	assert.Equal(t, float64(-51), tracks[0].firstRSSI["wifi/pi1-wifi"])
+
+	pseudoDevices := clusterTracks(tracks, map[string]string{})
+	assert.Equal(t, 4, len(pseudoDevices))
+	first := pseudoDeviceID("wifi", "wifi-02:00:00:00:00:01")
+	assert.Equal(t, first, pseudoDevices["wifi-02:00:00:00:00:01"])
+	assert.Equal(t, first, pseudoDevices["wifi-06:00:00:00:00:03"])
+	assert.NotEqual(t, first, pseudoDevices["wifi-da:00:00:00:00:02"])
+	assert.NotEqual(t, first, pseudoDevices["wifi-0a:00:00:00:00:04"])
+
+	// the MACs keep the pseudo devices they were assigned to
+	pseudoDevices = clusterTracks(tracks[1:], map[string]string{"wifi-06:00:00:00:00:03": first})
+	assert.Equal(t, first, pseudoDevices["wifi-06:00:00:00:00:03"])
+}
+
+func TestClusterRandomized(t *testing.T) {
+	folder, err := ioutil.TempDir("", "randomized")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	db, err := database.Open("randomized")
+	assert.Nil(t, err)
+	defer db.Close()
+	for _, s := range randomizedScans {
+		// the timestamps are unique
+		s.Timestamp += int64(len(s.Device)) + int64(s.Device[len(s.Device)-1])
+		assert.Nil(t, db.AddSensor(s))
+	}
+	db.Sync()
+
+	pseudoDevices, err := ClusterRandomized(db, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(pseudoDevices))
+	first := pseudoDevices["wifi-02:00:00:00:00:01"]
+	assert.Equal(t, first, pseudoDevices["wifi-06:00:00:00:00:03"])
+
+	// without the first MAC, the pseudo device is kept
+	pseudoDevices, err = ClusterRandomized(db, 60000)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(pseudoDevices))
+	assert.Equal(t, first, pseudoDevices["wifi-06:00:00:00:00:03"])
+
+	// the pseudo devices are saved for by_location
+	last, err := ClusterRecentRandomized(db)
+	assert.Nil(t, err)
+	lastSensor, _ := db.GetLastSensorTimestamp()
+	assert.Equal(t, lastSensor, last)
+	saved, err := db.GetPseudoDevices([]string{"wifi-02:00:00:00:00:01", "wifi-06:00:00:00:00:03"})
+	assert.Nil(t, err)
+	assert.Equal(t, first, saved["wifi-02:00:00:00:00:01"])
+	assert.Equal(t, first, saved["wifi-06:00:00:00:00:03"])
+	assert.Equal(t, len("wifi-pseudo-")+16, len(first))
+
+	// the MACs that were not seen within the period are forgotten
+	defer func(period time.Duration) { RandomizedClusterPeriod = period }(RandomizedClusterPeriod)
+	RandomizedClusterPeriod = 8 * time.Minute
+	_, err = ClusterRecentRandomized(db)
+	assert.Nil(t, err)
+	saved, err = db.GetPseudoDevices([]string{"wifi-02:00:00:00:00:01", "wifi-06:00:00:00:00:03"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"wifi-06:00:00:00:00:03": first}, saved)
+}
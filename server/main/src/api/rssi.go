@@ -0,0 +1,187 @@
+package api
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// RSSILearningPeriod is how far back the fingerprints of the reference
+// beacons are used to learn the RSSI calibrations
+var RSSILearningPeriod = 24 * time.Hour
+
+// receiverOf returns the device that measured a RSSI. Passive fingerprints
+// are keyed by SCANNER-SENSORTYPE, and are measured by the scanner. The
+// other fingerprints are measured by their device.
+func receiverOf(d models.SensorData, sensorType string, key string) (receiver string, passive bool) {
+	if strings.HasSuffix(key, "-"+sensorType) && strings.HasPrefix(d.Device, sensorType+"-") {
+		return strings.TrimSuffix(key, "-"+sensorType), true
+	}
+	return d.Device, false
+}
+
+// CalibrateRSSI returns a copy of the sensor data with the RSSI calibrations
+// of the devices and scanners that measured them. The data itself keeps
+// the raw values.
+func CalibrateRSSI(calibrations map[string]models.RSSICalibration, d models.SensorData) models.SensorData {
+	if len(calibrations) == 0 {
+		return d
+	}
+	sensors := make(map[string]map[string]interface{}, len(d.Sensors))
+	for sensorType := range d.Sensors {
+		sensors[sensorType] = make(map[string]interface{}, len(d.Sensors[sensorType]))
+		for key, value := range d.Sensors[sensorType] {
+			sensors[sensorType][key] = value
+			receiver, _ := receiverOf(d, sensorType, key)
+			calibration, ok := calibrations[receiver]
+			if !ok {
+				continue
+			}
+			if rssi, ok := toFloat(value); ok {
+				sensors[sensorType][key] = calibration.Apply(rssi)
+			}
+		}
+	}
+	d.Sensors = sensors
+	return d
+}
+
+// calibrateRSSI applies the RSSI calibrations of a family to its data
+func calibrateRSSI(db *database.Database, datas []models.SensorData) ([]models.SensorData, error) {
+	calibrations, err := db.GetRSSICalibrations()
+	if err != nil || len(calibrations) == 0 {
+		return datas, errors.Wrap(err, "could not get RSSI calibrations")
+	}
+	calibrated := make([]models.SensorData, len(datas))
+	for i := range datas {
+		calibrated[i] = CalibrateRSSI(calibrations, datas[i])
+	}
+	return calibrated, nil
+}
+
+// SetRSSICalibration sets the calibration of a device or scanner by hand,
+// which is then not learned from the reference beacons. The family is
+// calibrated again, since its models were fitted on the old calibration.
+func SetRSSICalibration(db *database.Database, family string, c models.RSSICalibration) (err error) {
+	c.Source = models.RSSIManual
+	c.Samples = 0
+	if err = c.Validate(); err != nil {
+		return
+	}
+	if err = db.SetRSSICalibrations(c); err != nil {
+		return errors.Wrap(err, "could not save RSSI calibration")
+	}
+	ScheduleCalibration(db, family)
+	return
+}
+
+// DeleteRSSICalibration removes the calibration of a device or scanner,
+// and calibrates the family again
+func DeleteRSSICalibration(db *database.Database, family string, device string) (err error) {
+	if err = db.DeleteRSSICalibration(strings.TrimSpace(strings.ToLower(device))); err != nil {
+		return errors.Wrap(err, "could not delete RSSI calibration")
+	}
+	ScheduleCalibration(db, family)
+	return
+}
+
+// LearnRSSICalibrations learns the calibrations of the passive scanners
+// from the reference beacons, and calibrates the family again if any were
+// learned
+func LearnRSSICalibrations(db *database.Database, family string) (learned []models.RSSICalibration, err error) {
+	learned, err = learnRSSICalibrations(db)
+	if err == nil && len(learned) > 0 {
+		ScheduleCalibration(db, family)
+	}
+	return
+}
+
+// learnRSSICalibrations learns the calibrations of the passive scanners
+// from the reference beacons at their location. A scanner that sees
+// beacons of different RSSI is fitted with a scale and an offset, otherwise
+// with an offset. The calibrations set by hand are kept.
+func learnRSSICalibrations(db *database.Database) (learned []models.RSSICalibration, err error) {
+	beacons, err := db.GetReferenceBeacons()
+	if err != nil || len(beacons) == 0 {
+		return
+	}
+	scanners, err := db.GetScanners()
+	if err != nil {
+		return
+	}
+	location := make(map[string]string)
+	for _, s := range scanners {
+		location[s.ID] = s.Location
+	}
+	calibrations, err := db.GetRSSICalibrations()
+	if err != nil {
+		return
+	}
+
+	// scanner -> the RSSI seen and the RSSI of the beacon
+	observed := make(map[string][][2]float64)
+	since := time.Now().Add(-RSSILearningPeriod).UnixNano() / int64(time.Millisecond)
+	for _, beacon := range beacons {
+		var datas []models.SensorData
+		datas, err = db.GetSensorsOfDevice(beacon.Device, since)
+		if err != nil {
+			return
+		}
+		for _, d := range datas {
+			for sensorType := range d.Sensors {
+				for key, value := range d.Sensors[sensorType] {
+					scanner, passive := receiverOf(d, sensorType, key)
+					if !passive || location[scanner] != beacon.Location {
+						continue
+					}
+					if rssi, ok := toFloat(value); ok {
+						observed[scanner] = append(observed[scanner], [2]float64{rssi, beacon.RSSI})
+					}
+				}
+			}
+		}
+	}
+
+	for scanner, pairs := range observed {
+		if calibrations[scanner].Source == models.RSSIManual {
+			continue
+		}
+		offset, scale := fitRSSI(pairs)
+		learned = append(learned, models.RSSICalibration{
+			Device:  scanner,
+			Offset:  offset,
+			Scale:   scale,
+			Source:  models.RSSILearned,
+			Samples: int64(len(pairs)),
+		})
+	}
+	if len(learned) > 0 {
+		err = errors.Wrap(db.SetRSSICalibrations(learned...), "could not save RSSI calibrations")
+	}
+	return
+}
+
+// fitRSSI fits reference = scale*observed + offset by least squares. The
+// scale is only fitted if the observed RSSI vary, and kept if it is positive.
+func fitRSSI(pairs [][2]float64) (offset float64, scale float64) {
+	n := float64(len(pairs))
+	var meanObserved, meanReference float64
+	for _, p := range pairs {
+		meanObserved += p[0] / n
+		meanReference += p[1] / n
+	}
+	var covariance, variance float64
+	for _, p := range pairs {
+		covariance += (p[0] - meanObserved) * (p[1] - meanReference)
+		variance += (p[0] - meanObserved) * (p[0] - meanObserved)
+	}
+	scale = 1
+	if variance > 0 && covariance/variance > 0 {
+		scale = covariance / variance
+	}
+	offset = meanReference - scale*meanObserved
+	return
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalibrateRSSI(t *testing.T) {
+	calibrations := map[string]models.RSSICalibration{
+		"phone": {Device: "phone", Offset: 5, Scale: 1},
+		"pi1":   {Device: "pi1", Offset: -10, Scale: 0.5},
+	}
+
+	// active fingerprints are measured by their device
+	d := models.SensorData{
+		Device:  "phone",
+		Sensors: map[string]map[string]interface{}{"wifi": {"aa:bb": float64(-60), "cc:dd": "x"}},
+	}
+	calibrated := CalibrateRSSI(calibrations, d)
+	assert.Equal(t, float64(-55), calibrated.Sensors["wifi"]["aa:bb"])
+	assert.Equal(t, "x", calibrated.Sensors["wifi"]["cc:dd"])
+	assert.Equal(t, float64(-60), d.Sensors["wifi"]["aa:bb"])
+
+	// passive fingerprints are measured by their scanners
+	d = models.SensorData{
+		Device:  "wifi-aa:bb",
+		Sensors: map[string]map[string]interface{}{"wifi": {"pi1-wifi": float64(-61), "pi2-wifi": float64(-70)}},
+	}
+	calibrated = CalibrateRSSI(calibrations, d)
+	assert.Equal(t, float64(-40), calibrated.Sensors["wifi"]["pi1-wifi"])
+	assert.Equal(t, float64(-70), calibrated.Sensors["wifi"]["pi2-wifi"])
+	assert.Equal(t, float64(-61), d.Sensors["wifi"]["pi1-wifi"])
+}
+
+func TestFitRSSI(t *testing.T) {
+	offset, scale := fitRSSI([][2]float64{{-50, -45}, {-52, -45}})
+	assert.InDelta(t, 6, offset, 1e-9)
+	assert.Equal(t, float64(1), scale)
+
+	offset, scale = fitRSSI([][2]float64{{-40, -30}, {-80, -50}})
+	assert.InDelta(t, 0.5, scale, 1e-9)
+	assert.InDelta(t, -10, offset, 1e-9)
+}
+
+func TestLearnRSSICalibrations(t *testing.T) {
+	folder, err := ioutil.TempDir("", "rssi")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	db, err := database.Open("rssi")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Nil(t, db.SetScanner(models.Scanner{ID: "pi1", Location: "kitchen"}))
+	assert.Nil(t, db.SetScanner(models.Scanner{ID: "pi2", Location: "kitchen"}))
+	assert.Nil(t, db.SetScanner(models.Scanner{ID: "pi3", Location: "office"}))
+	assert.Nil(t, db.SetReferenceBeacon(models.ReferenceBeacon{Device: "wifi-be:ac:00", Location: "kitchen", RSSI: -40}))
+	assert.Nil(t, db.SetRSSICalibrations(models.RSSICalibration{Device: "pi2", Offset: 3, Scale: 1, Source: models.RSSIManual}))
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, rssi := range []float64{-48, -52} {
+		assert.Nil(t, db.AddSensor(models.SensorData{
+			Timestamp: now - int64(i),
+			Family:    "rssi",
+			Device:    "wifi-be:ac:00",
+			Sensors: map[string]map[string]interface{}{"wifi": {
+				"pi1-wifi": rssi,
+				"pi2-wifi": rssi,
+				"pi3-wifi": rssi,
+			}},
+		}))
+	}
+	db.Sync()
+
+	learned, err := learnRSSICalibrations(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(learned))
+
+	// the scanner of another location and the manual calibration are kept
+	calibrations, err := db.GetRSSICalibrations()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(calibrations))
+	assert.Equal(t, models.RSSILearned, calibrations["pi1"].Source)
+	assert.InDelta(t, 10, calibrations["pi1"].Offset, 1e-9)
+	assert.Equal(t, float64(1), calibrations["pi1"].Scale)
+	assert.Equal(t, int64(2), calibrations["pi1"].Samples)
+	assert.Equal(t, models.RSSIManual, calibrations["pi2"].Source)
+	assert.Equal(t, float64(3), calibrations["pi2"].Offset)
+
+	// the raw fingerprints are kept
+	datas, err := db.GetSensorsOfDevice("wifi-be:ac:00", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(datas))
+	calibrated, err := calibrateRSSI(db, datas)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(-52), datas[0].Sensors["wifi"]["pi1-wifi"])
+	assert.Equal(t, float64(-42), calibrated[0].Sensors["wifi"]["pi1-wifi"])
+	assert.Equal(t, float64(-49), calibrated[0].Sensors["wifi"]["pi2-wifi"])
+	assert.Equal(t, float64(-52), calibrated[0].Sensors["wifi"]["pi3-wifi"])
+
+	assert.Nil(t, db.DeleteRSSICalibration("pi1"))
+	calibrations, err = db.GetRSSICalibrations()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(calibrations))
+}
+
+func TestRSSICalibrationRecalibrates(t *testing.T) {
+	folder, err := ioutil.TempDir("", "rssi")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	db, err := database.Open("rssijobs")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// the scheduler is stopped, so that the calibrations are not run
+	stoppingLock.Lock()
+	wasStopped := stopped
+	stopped = true
+	stoppingLock.Unlock()
+	defer func() {
+		stoppingLock.Lock()
+		stopped = wasStopped
+		stoppingLock.Unlock()
+	}()
+
+	// the models are fitted again on the new calibrations
+	assert.Nil(t, SetRSSICalibration(db, "rssijobs", models.RSSICalibration{Device: "pi1", Offset: 3}))
+	assert.Equal(t, 1, len(jobs.list("rssijobs")))
+	assert.Nil(t, DeleteRSSICalibration(db, "rssijobs", "PI1"))
+	assert.Equal(t, 2, len(jobs.list("rssijobs")))
+	calibrations, err := db.GetRSSICalibrations()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(calibrations))
+
+	// learning nothing does not calibrate
+	_, err = LearnRSSICalibrations(db, "rssijobs")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(jobs.list("rssijobs")))
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// ScannerTimeout is how long a scanner can go without checking in before
+// it is silent
+var ScannerTimeout = 5 * time.Minute
+
+// isSilent returns whether a scanner that has checked in has not done so
+// within the scanner timeout
+func isSilent(s models.Scanner, now time.Time) bool {
+	return !s.LastSeen.IsZero() && now.Sub(s.LastSeen) > ScannerTimeout
+}
+
+// GetScanners returns the scanners of a family, with whether they are silent
+func GetScanners(db *database.Database) (scanners []models.Scanner, err error) {
+	scanners, err = db.GetScanners()
+	if err != nil {
+		err = errors.Wrap(err, "could not get scanners")
+		return
+	}
+	now := time.Now()
+	for i := range scanners {
+		scanners[i].Silent = isSilent(scanners[i], now)
+	}
+	return
+}
+
+// SetScanner sets the name and location of a scanner of a family
+func SetScanner(db *database.Database, s models.Scanner) (saved models.Scanner, err error) {
+	err = s.Validate()
+	if err != nil {
+		return
+	}
+	err = db.SetScanner(s)
+	if err != nil {
+		err = errors.Wrap(err, "could not save scanner")
+		return
+	}
+	saved, err = db.GetScanner(s.ID)
+	return
+}
+
+// CheckScanners returns the scanners of a family that went silent or came
+// back since they were last checked
+func CheckScanners(db *database.Database) (changed []models.Scanner, err error) {
+	scanners, err := db.GetScanners()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, s := range scanners {
+		silent := isSilent(s, now)
+		if silent == s.Silent {
+			continue
+		}
+		if err = db.SetScannerSilent(s.ID, silent); err != nil {
+			return
+		}
+		s.Silent = silent
+		changed = append(changed, s)
+	}
+	return
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mr-tron/base58/base58"
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// MinimumPercentCorrect is the percent correct (0-1) that a new calibration
+// needs before its models replace the ones in use. The new models are still
+// kept as a snapshot, so they can be promoted by hand.
+var MinimumPercentCorrect = 0.0
+
+// MaxModelSnapshots is the number of model snapshots that are kept, besides
+// the active and the pinned one. Older snapshots are deleted after each
+// calibration.
+var MaxModelSnapshots = 20
+
+// GetModelSnapshots returns the model snapshots of a family, newest first
+func GetModelSnapshots(db *database.Database) (snapshots []models.ModelSnapshot, err error) {
+	snapshots, err = db.GetModelSnapshots()
+	if err != nil {
+		err = errors.Wrap(err, "could not get model snapshots")
+		return
+	}
+	active, pinned := getActiveAndPinnedSnapshots(db)
+	for i := range snapshots {
+		snapshots[i].Active = snapshots[i].ID == active
+		snapshots[i].Pinned = snapshots[i].ID == pinned
+	}
+	return
+}
+
+// RollbackModels puts the models of a snapshot back into use. They are
+// replaced again by the next calibration that is good enough.
+func RollbackModels(db *database.Database, family string, id int) (err error) {
+	lock := jobs.lock(family)
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, pinned := getActiveAndPinnedSnapshots(db)
+	if pinned != 0 && pinned != id {
+		err = errors.New(fmt.Sprintf("%s is pinned to model snapshot %d", family, pinned))
+		return
+	}
+	err = restoreModelSnapshot(db, family, id)
+	return
+}
+
+// PinModels puts the models of a snapshot into use and keeps them in use,
+// regardless of new calibrations, until the family is unpinned.
+func PinModels(db *database.Database, family string, id int) (err error) {
+	lock := jobs.lock(family)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = restoreModelSnapshot(db, family, id)
+	if err != nil {
+		return
+	}
+	err = db.Set("PinnedSnapshot", id)
+	db.Sync()
+	return
+}
+
+// UnpinModels lets new calibrations replace the models of a family again
+func UnpinModels(db *database.Database, family string) (err error) {
+	lock := jobs.lock(family)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = db.Set("PinnedSnapshot", 0)
+	db.Sync()
+	return
+}
+
+// promoteModels saves the freshly fitted models as a snapshot and decides
+// whether they stay in use. If they don't, the active models are restored.
+func promoteModels(db *database.Database, family string, calibrationID int, percentCorrect float64) (err error) {
+	active, pinned := getActiveAndPinnedSnapshots(db)
+	promote, reason, restoreID := shouldPromote(percentCorrect, active, pinned)
+
+	snapshot, err := db.AddModelSnapshot(calibrationID, percentCorrect, promote, reason)
+	if err != nil {
+		err = errors.Wrap(err, "could not save model snapshot")
+		return
+	}
+	err = copyFile(aiModelFile(family), aiSnapshotFile(family, snapshot.ID))
+	if err != nil {
+		logger.Warnf("[%s] could not keep python model for snapshot %d: %s", family, snapshot.ID, err.Error())
+	}
+
+	if !promote {
+		logger.Warnf("[%s] not promoting model snapshot %d: %s", family, snapshot.ID, reason)
+		err = restoreModelSnapshot(db, family, restoreID)
+	} else {
+		logger.Infof("[%s] promoted model snapshot %d", family, snapshot.ID)
+		err = db.Set("ActiveSnapshot", snapshot.ID)
+		db.Sync()
+	}
+	if err != nil {
+		return
+	}
+	err = deleteOldModelSnapshots(db, family)
+	return
+}
+
+// deleteOldModelSnapshots deletes the snapshots, and their python models,
+// that are older than the MaxModelSnapshots newest ones, except for the
+// active and the pinned snapshot
+func deleteOldModelSnapshots(db *database.Database, family string) (err error) {
+	active, pinned := getActiveAndPinnedSnapshots(db)
+	deleted, err := db.DeleteOldModelSnapshots(MaxModelSnapshots, active, pinned)
+	if err != nil {
+		return
+	}
+	for _, id := range deleted {
+		if errRemove := os.Remove(aiSnapshotFile(family, id)); errRemove != nil && !os.IsNotExist(errRemove) {
+			logger.Warnf("[%s] could not delete python model of snapshot %d: %s", family, id, errRemove.Error())
+		}
+	}
+	if len(deleted) > 0 {
+		logger.Debugf("[%s] deleted %d old model snapshots", family, len(deleted))
+	}
+	return
+}
+
+// shouldPromote decides whether new models replace the active ones. When
+// they don't, it returns the reason and the snapshot to restore.
+func shouldPromote(percentCorrect float64, active int, pinned int) (promote bool, reason string, restoreID int) {
+	if pinned != 0 {
+		return false, fmt.Sprintf("pinned to model snapshot %d", pinned), pinned
+	}
+	if percentCorrect < MinimumPercentCorrect && active != 0 {
+		return false, fmt.Sprintf("percent correct of %2.0f%% is below the minimum of %2.0f%%", percentCorrect*100, MinimumPercentCorrect*100), active
+	}
+	return true, "", 0
+}
+
+// restoreModelSnapshot puts the naive bayes models and the python model
+// of a snapshot back into use
+func restoreModelSnapshot(db *database.Database, family string, id int) (err error) {
+	snapshot, err := db.GetModelSnapshot(id)
+	if err != nil {
+		return
+	}
+	err = copyFile(aiSnapshotFile(family, snapshot.ID), aiModelFile(family))
+	if err != nil {
+		err = errors.Wrap(err, "could not restore python model")
+		return
+	}
+	err = db.RestoreModelSnapshot(snapshot.ID)
+	if err != nil {
+		err = errors.Wrap(err, "could not restore naive bayes models")
+		return
+	}
+	err = reloadAI(family)
+	if err != nil {
+		return
+	}
+	logger.Infof("[%s] restored model snapshot %d", family, snapshot.ID)
+	return
+}
+
+func getActiveAndPinnedSnapshots(db *database.Database) (active int, pinned int) {
+	// the keys do not exist until the first snapshot is made
+	db.Get("ActiveSnapshot", &active)
+	db.Get("PinnedSnapshot", &pinned)
+	return
+}
+
+// aiModelFile is the python model that is used for classification
+func aiModelFile(family string) string {
+	return path.Join(DataFolder, base58.FastBase58Encoding([]byte(family))+".find3.ai")
+}
+
+// aiSnapshotFile is the copy of the python model kept for a snapshot
+func aiSnapshotFile(family string, id int) string {
+	return path.Join(DataFolder, fmt.Sprintf("%s.%d.find3.ai", base58.FastBase58Encoding([]byte(family)), id))
+}
+
+// RenameModels renames the python models of a family and of its snapshots
+func RenameModels(from string, to string) (err error) {
+	files := []string{aiModelFile(from)}
+	snapshots, _ := filepath.Glob(path.Join(DataFolder, base58.FastBase58Encoding([]byte(from))+".*.find3.ai"))
+	files = append(files, snapshots...)
+	prefix := base58.FastBase58Encoding([]byte(from)) + "."
+	for _, file := range files {
+		if _, errStat := os.Stat(file); errStat != nil {
+			continue
+		}
+		renamed := path.Join(path.Dir(file), base58.FastBase58Encoding([]byte(to))+"."+strings.TrimPrefix(path.Base(file), prefix))
+		if err = os.Rename(file, renamed); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return
+	}
+	err = out.Close()
+	return
+}
+
+// reloadAI makes the AI server load the python model of a family from disk
+func reloadAI(family string) (err error) {
+	type Payload struct {
+		Family     string `json:"family"`
+		DataFolder string `json:"data_folder"`
+	}
+	bPayload, err := json.Marshal(Payload{Family: family, DataFolder: DataFolder})
+	if err != nil {
+		return
+	}
+
+	body, err := aiSendAndRecieve(logger.WithFamily(family), fmt.Sprintf(`{"method": "reload", "data":%v}`, string(bPayload)))
+	if nil != err {
+		err = errors.Wrap(err, "problem sending message to ai server")
+		return
+	}
+
+	var target AnalysisResponse
+	err = json.Unmarshal([]byte(body), &target)
+	if err != nil {
+		err = errors.Wrap(err, "problem decoding response")
+		return
+	}
+	if !target.Success {
+		err = errors.New("failed in AI server: " + target.Message)
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldPromote(t *testing.T) {
+	defer func(minimum float64) { MinimumPercentCorrect = minimum }(MinimumPercentCorrect)
+	MinimumPercentCorrect = 0.5
+
+	promote, _, _ := shouldPromote(0.8, 2, 0)
+	assert.True(t, promote)
+
+	// bad models are not promoted over the active ones
+	promote, reason, restoreID := shouldPromote(0.3, 2, 0)
+	assert.False(t, promote)
+	assert.NotEmpty(t, reason)
+	assert.Equal(t, 2, restoreID)
+
+	// unless there are no models to fall back to
+	promote, _, _ = shouldPromote(0.3, 0, 0)
+	assert.True(t, promote)
+
+	// pinned models are always kept
+	promote, _, restoreID = shouldPromote(0.8, 2, 1)
+	assert.False(t, promote)
+	assert.Equal(t, 1, restoreID)
+}
+
+func TestDeleteOldModelSnapshots(t *testing.T) {
+	folder, err := ioutil.TempDir("", "snapshots")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+	DataFolder = folder
+	defer func() { DataFolder = "." }()
+	defer func(max int) { MaxModelSnapshots = max }(MaxModelSnapshots)
+	MaxModelSnapshots = 2
+
+	db, err := database.Open("snapshots")
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 1; i <= 5; i++ {
+		snapshot, err := db.AddModelSnapshot(i, 0.5, true, "")
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(aiSnapshotFile("snapshots", snapshot.ID), []byte("model"), 0644))
+	}
+	assert.Nil(t, db.Set("ActiveSnapshot", 1))
+	assert.Nil(t, db.Set("PinnedSnapshot", 2))
+	db.Sync()
+
+	// the newest, the active and the pinned snapshots are kept
+	assert.Nil(t, deleteOldModelSnapshots(db, "snapshots"))
+	snapshots, err := db.GetModelSnapshots()
+	assert.Nil(t, err)
+	ids := []int{}
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.ID)
+	}
+	assert.Equal(t, []int{5, 4, 2, 1}, ids)
+	_, err = os.Stat(aiSnapshotFile("snapshots", 3))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(aiSnapshotFile("snapshots", 2))
+	assert.Nil(t, err)
+}
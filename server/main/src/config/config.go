@@ -0,0 +1,399 @@
+// Package config reads the settings of the server from a YAML file,
+// with environment variables to override them.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of the environment variables that override
+// the settings, such as FIND_PORT or FIND_CALIBRATION_WORKERS
+const EnvPrefix = "FIND"
+
+// Config are the settings of the server
+type Config struct {
+	// Port is the port of the data (this) server
+	Port string `yaml:"port" json:"port"`
+	// DataFolder is where the databases are stored
+	DataFolder string `yaml:"data_folder" json:"data_folder"`
+	LogLevel   string `yaml:"log_level" json:"log_level"`
+	// ShutdownTimeout is how long the server waits for its queues and
+	// calibrations when it is stopped
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+
+	AI struct {
+		// Address is the address of the socket of the AI server
+		Address string `yaml:"address" json:"address"`
+		// Port is the port of the HTTP API of the AI server
+		Port string `yaml:"port" json:"port"`
+	} `yaml:"ai" json:"ai"`
+
+	Calibration struct {
+		// Folds are the folds of cross validation
+		Folds int `yaml:"folds" json:"folds"`
+		// MinPercentCorrect is the accuracy (0-1) that new models
+		// need to replace the models in use
+		MinPercentCorrect float64 `yaml:"min_percent_correct" json:"min_percent_correct"`
+		// Workers is the number of calibrations that run at the same time
+		Workers int `yaml:"workers" json:"workers"`
+		// CheckInterval is how often families are checked for new learning data
+		CheckInterval Duration `yaml:"check_interval" json:"check_interval"`
+		// RSSILearningPeriod is how far back the reference beacons are used
+		// to learn the RSSI calibrations of the scanners
+		RSSILearningPeriod Duration `yaml:"rssi_learning_period" json:"rssi_learning_period"`
+		// MaxSnapshots is the number of model snapshots that are kept,
+		// besides the active and the pinned one
+		MaxSnapshots int `yaml:"max_snapshots" json:"max_snapshots"`
+	} `yaml:"calibration" json:"calibration"`
+
+	Databases struct {
+		// IdleTimeout is how long the database of a family stays open
+		// after it was last used, 0 keeps them open
+		IdleTimeout Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	} `yaml:"databases" json:"databases"`
+
+	Passive struct {
+		// TimeBlock is the default window to gather passive scans in
+		TimeBlock Duration `yaml:"time_block" json:"time_block"`
+		// Step is how far the window slides, zero for windows that do not overlap
+		Step Duration `yaml:"step" json:"step"`
+		// Aggregation is "last", "mean", "median", "max" or "count", for the
+		// RSSI that a scanner saw for a device in a window
+		Aggregation string `yaml:"aggregation" json:"aggregation"`
+		// FlushInterval is how often the windows that are over are reversed
+		FlushInterval Duration `yaml:"flush_interval" json:"flush_interval"`
+		// ScannerTimeout is how long a scanner can be quiet before it is silent
+		ScannerTimeout Duration `yaml:"scanner_timeout" json:"scanner_timeout"`
+	} `yaml:"passive" json:"passive"`
+
+	Randomized struct {
+		// ClusterPeriod is how far back randomized MACs are clustered
+		// into pseudo devices
+		ClusterPeriod Duration `yaml:"cluster_period" json:"cluster_period"`
+		// MaxGap is the longest a device goes unseen when it changes its MAC
+		MaxGap Duration `yaml:"max_gap" json:"max_gap"`
+		// MaxRSSIDistance is the largest RMS difference in dB of the RSSI
+		// of the old and the new MAC
+		MaxRSSIDistance float64 `yaml:"max_rssi_distance" json:"max_rssi_distance"`
+	} `yaml:"randomized" json:"randomized"`
+
+	Privacy struct {
+		// Retention is how long the fingerprints of hashed devices are kept,
+		// for the families in privacy mode that do not set it
+		Retention Duration `yaml:"retention" json:"retention"`
+		// Rotation is how often the key of the hashes changes
+		Rotation Duration `yaml:"rotation" json:"rotation"`
+	} `yaml:"privacy" json:"privacy"`
+
+	Websockets struct {
+		// SendBuffer is the number of messages queued for each websocket
+		SendBuffer int `yaml:"send_buffer" json:"send_buffer"`
+		// SlowPolicy is "drop" or "disconnect", for websockets that cannot keep up
+		SlowPolicy string `yaml:"slow_policy" json:"slow_policy"`
+	} `yaml:"websockets" json:"websockets"`
+
+	MQTT struct {
+		// Embedded runs a broker in the server instead of using mosquitto
+		Embedded bool `yaml:"embedded" json:"embedded"`
+		// Listen is the address of the embedded broker
+		Listen    string `yaml:"listen" json:"listen"`
+		Server    string `yaml:"server" json:"server"`
+		Admin     string `yaml:"admin" json:"admin"`
+		Password  string `yaml:"password" json:"password"`
+		Directory string `yaml:"directory" json:"directory"`
+		// HomeAssistant publishes discovery messages for the registered devices
+		HomeAssistant   bool   `yaml:"home_assistant" json:"home_assistant"`
+		DiscoveryPrefix string `yaml:"discovery_prefix" json:"discovery_prefix"`
+		// DiscoveryPerFamily puts the discovery prefix under each family, so
+		// that the family can read it, instead of sharing it for the admin
+		DiscoveryPerFamily bool `yaml:"discovery_per_family" json:"discovery_per_family"`
+	} `yaml:"mqtt" json:"mqtt"`
+}
+
+// Default returns the default settings
+func Default() (c Config) {
+	c.Port = "8003"
+	c.LogLevel = "debug"
+	c.ShutdownTimeout = Duration(30 * time.Second)
+	c.AI.Address = "localhost:7005"
+	c.AI.Port = "8002"
+	c.Calibration.Folds = 3
+	c.Calibration.Workers = 2
+	c.Calibration.CheckInterval = Duration(60 * time.Second)
+	c.Calibration.RSSILearningPeriod = Duration(24 * time.Hour)
+	c.Calibration.MaxSnapshots = 20
+	c.Databases.IdleTimeout = Duration(30 * time.Minute)
+	c.Passive.TimeBlock = Duration(90 * time.Second)
+	c.Passive.Aggregation = "last"
+	c.Passive.FlushInterval = Duration(5 * time.Second)
+	c.Passive.ScannerTimeout = Duration(5 * time.Minute)
+	c.Randomized.ClusterPeriod = Duration(time.Hour)
+	c.Randomized.MaxGap = Duration(2 * time.Minute)
+	c.Randomized.MaxRSSIDistance = 8
+	c.Privacy.Retention = Duration(24 * time.Hour)
+	c.Privacy.Rotation = Duration(24 * time.Hour)
+	c.Websockets.SendBuffer = 32
+	c.Websockets.SlowPolicy = "drop"
+	c.MQTT.Listen = ":1883"
+	c.MQTT.Admin = "admin"
+	c.MQTT.Password = "1234"
+	c.MQTT.Directory = "mosquitto_config"
+	c.MQTT.HomeAssistant = true
+	c.MQTT.DiscoveryPrefix = "homeassistant"
+	c.MQTT.DiscoveryPerFamily = true
+	return
+}
+
+// Load returns the default settings, overridden by the YAML file
+// (if it is given) and then by the environment variables
+func Load(file string) (c Config, err error) {
+	c = Default()
+	if file != "" {
+		var b []byte
+		b, err = ioutil.ReadFile(file)
+		if err != nil {
+			err = errors.Wrap(err, "could not read config")
+			return
+		}
+		err = yaml.UnmarshalStrict(b, &c)
+		if err != nil {
+			err = errors.Wrap(err, "could not parse config")
+			return
+		}
+	}
+	err = applyEnv(reflect.ValueOf(&c).Elem(), EnvPrefix)
+	if err != nil {
+		return
+	}
+	if c.DataFolder == "" {
+		c.DataFolder, _ = os.Getwd()
+		c.DataFolder = path.Join(c.DataFolder, "data")
+	}
+	return
+}
+
+// applyEnv sets the settings that have an environment variable, which is
+// named after the prefix and the yaml key, such as FIND_AI_ADDRESS
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(field, value); err != nil {
+			return errors.Wrapf(err, "could not use %s", name)
+		}
+	}
+	return nil
+}
+
+func setValue(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return errors.Errorf("unsupported setting type %s", field.Kind())
+	}
+	return nil
+}
+
+// Validate returns an error for the first setting that is not valid
+func (c Config) Validate() error {
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		return errors.Errorf("port '%s' is not valid", c.Port)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "trace", "debug", "info", "warn", "warning", "error", "critical":
+	default:
+		return errors.Errorf("log_level '%s' is not valid", c.LogLevel)
+	}
+	if c.ShutdownTimeout.Duration() < time.Second {
+		return errors.New("shutdown_timeout must be at least 1s")
+	}
+	if c.AI.Address == "" {
+		return errors.New("ai address cannot be empty")
+	}
+	if c.Calibration.Folds < 1 {
+		return errors.New("calibration folds must be at least 1")
+	}
+	if c.Calibration.MinPercentCorrect < 0 || c.Calibration.MinPercentCorrect > 1 {
+		return errors.New("calibration min_percent_correct must be between 0 and 1")
+	}
+	if c.Calibration.Workers < 1 {
+		return errors.New("calibration workers must be at least 1")
+	}
+	if c.Calibration.CheckInterval.Duration() < time.Second {
+		return errors.New("calibration check_interval must be at least 1s")
+	}
+	if c.Calibration.RSSILearningPeriod.Duration() < time.Minute {
+		return errors.New("calibration rssi_learning_period must be at least 1m")
+	}
+	if c.Calibration.MaxSnapshots < 1 {
+		return errors.New("calibration max_snapshots must be at least 1")
+	}
+	if c.Databases.IdleTimeout < 0 {
+		return errors.New("databases idle_timeout cannot be negative")
+	}
+	if c.Passive.TimeBlock.Duration() < time.Second {
+		return errors.New("passive time_block must be at least 1s")
+	}
+	if c.Passive.Step < 0 || c.Passive.Step > c.Passive.TimeBlock {
+		return errors.New("passive step must be between 0 and time_block")
+	}
+	switch c.Passive.Aggregation {
+	case "last", "mean", "median", "max", "count":
+	default:
+		return errors.Errorf("passive aggregation '%s' must be last, mean, median, max or count", c.Passive.Aggregation)
+	}
+	if c.Passive.FlushInterval.Duration() < 100*time.Millisecond {
+		return errors.New("passive flush_interval must be at least 100ms")
+	}
+	if c.Passive.ScannerTimeout.Duration() < time.Second {
+		return errors.New("passive scanner_timeout must be at least 1s")
+	}
+	if c.Randomized.ClusterPeriod.Duration() < time.Minute {
+		return errors.New("randomized cluster_period must be at least 1m")
+	}
+	if c.Randomized.MaxGap < 0 || c.Randomized.MaxGap > c.Randomized.ClusterPeriod {
+		return errors.New("randomized max_gap must be between 0 and cluster_period")
+	}
+	if c.Randomized.MaxRSSIDistance <= 0 {
+		return errors.New("randomized max_rssi_distance must be positive")
+	}
+	if c.Privacy.Retention.Duration() < time.Minute {
+		return errors.New("privacy retention must be at least 1m")
+	}
+	if c.Privacy.Rotation.Duration() < time.Minute {
+		return errors.New("privacy rotation must be at least 1m")
+	}
+	if c.Websockets.SendBuffer < 1 {
+		return errors.New("websockets send_buffer must be at least 1")
+	}
+	if c.Websockets.SlowPolicy != "drop" && c.Websockets.SlowPolicy != "disconnect" {
+		return errors.Errorf("websockets slow_policy '%s' must be 'drop' or 'disconnect'", c.Websockets.SlowPolicy)
+	}
+	if c.MQTT.Embedded && c.MQTT.Listen == "" {
+		return errors.New("mqtt listen cannot be empty for the embedded broker")
+	}
+	// the embedded broker is reachable by everyone who can reach the server
+	if c.MQTT.Embedded && (c.MQTT.Password == "" || c.MQTT.Password == Default().MQTT.Password) {
+		return errors.New("mqtt password must be changed from the default for the embedded broker")
+	}
+	if c.MQTT.HomeAssistant && c.MQTT.DiscoveryPrefix == "" {
+		return errors.New("mqtt discovery_prefix cannot be empty for home_assistant")
+	}
+	return nil
+}
+
+// Redacted returns the settings without the secrets, to show them
+func (c Config) Redacted() Config {
+	if c.MQTT.Password != "" {
+		c.MQTT.Password = "********"
+	}
+	return c
+}
+
+var (
+	current = Default()
+	lock    sync.RWMutex
+)
+
+// Set sets the settings that are in effect
+func Set(c Config) {
+	lock.Lock()
+	defer lock.Unlock()
+	current = c
+}
+
+// Get returns the settings that are in effect
+func Get() Config {
+	lock.RLock()
+	defer lock.RUnlock()
+	return current
+}
+
+// Duration is a time.Duration that is written as a string, such as "90s"
+type Duration time.Duration
+
+// Duration returns the time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// UnmarshalYAML reads a duration such as "90s"
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalYAML writes the duration as a string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", d.String())), nil
+}
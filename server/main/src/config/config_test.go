@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`
+port: "8080"
+data_folder: /tmp/data
+calibration:
+  folds: 5
+  check_interval: 2m
+passive:
+  time_block: 30s
+`)
+	f.Close()
+
+	os.Setenv("FIND_CALIBRATION_WORKERS", "4")
+	os.Setenv("FIND_PORT", "9090")
+	defer os.Unsetenv("FIND_CALIBRATION_WORKERS")
+	defer os.Unsetenv("FIND_PORT")
+
+	c, err := Load(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "9090", c.Port)
+	assert.Equal(t, "/tmp/data", c.DataFolder)
+	assert.Equal(t, 5, c.Calibration.Folds)
+	assert.Equal(t, 4, c.Calibration.Workers)
+	assert.Equal(t, 2*time.Minute, c.Calibration.CheckInterval.Duration())
+	assert.Equal(t, 30*time.Second, c.Passive.TimeBlock.Duration())
+	assert.Equal(t, "localhost:7005", c.AI.Address)
+	assert.Nil(t, c.Validate())
+
+	os.Setenv("FIND_PASSIVE_TIME_BLOCK", "soon")
+	defer os.Unsetenv("FIND_PASSIVE_TIME_BLOCK")
+	_, err = Load(f.Name())
+	assert.NotNil(t, err)
+}
+
+func TestLoadUnknownSetting(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("calibration:\n  fold: 5\n")
+	f.Close()
+
+	_, err = Load(f.Name())
+	assert.NotNil(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Default().Validate())
+
+	c := Default()
+	c.Port = "99999"
+	assert.NotNil(t, c.Validate())
+
+	c = Default()
+	c.Calibration.MinPercentCorrect = 1.5
+	assert.NotNil(t, c.Validate())
+
+	c = Default()
+	c.Websockets.SlowPolicy = "wait"
+	assert.NotNil(t, c.Validate())
+
+	c = Default()
+	c.LogLevel = "loud"
+	assert.NotNil(t, c.Validate())
+
+	// the embedded broker needs another admin password
+	c = Default()
+	c.MQTT.Embedded = true
+	assert.NotNil(t, c.Validate())
+	c.MQTT.Password = "s3cret"
+	assert.Nil(t, c.Validate())
+}
+
+func TestRedacted(t *testing.T) {
+	c := Default()
+	b, err := json.Marshal(c.Redacted())
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), c.MQTT.Password)
+	assert.Contains(t, string(b), `"time_block":"1m30s"`)
+	assert.Equal(t, "1234", c.MQTT.Password)
+}
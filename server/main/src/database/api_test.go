@@ -2,7 +2,6 @@ package database
 
 import (
 	"encoding/json"
-	"os"
 	"strconv"
 	"testing"
 
@@ -10,9 +9,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func init() {
-	Debug(false)
-}
 func TestAddSensor(t *testing.T) {
 	var s1 models.SensorData
 	var s2 models.SensorData
@@ -24,28 +20,43 @@ func TestAddSensor(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
+	defer useTempFolder(t)()
 	db, _ := Open("testing")
 	defer db.Close()
 	err = db.AddSensor(s1)
 	assert.Nil(t, err)
 	err = db.AddSensor(s2)
 	assert.Nil(t, err)
+	db.Sync()
 
 	s1test, err := db.GetSensorFromTime(s1.Timestamp)
 	assert.Nil(t, err)
-	assert.Equal(t, s1test, s1)
+	assertFromFingerprint(t, s1, s1test)
 
 	sLatest, err := db.GetLatest(s2.Device)
 	assert.Nil(t, err)
-	assert.Equal(t, s2, sLatest)
+	assertFromFingerprint(t, s2, sLatest)
 
-	sPrepared, err := db.GetAllFromPreparedQuery("select * from sensors where timestamp = ?", s1.Timestamp)
+	sQueried, err := db.GetAllFromQuery("SELECT "+SENSOR_SQL+" FROM sensors WHERE timestamp = ?", s1.Timestamp)
 	assert.Nil(t, err)
-	assert.Equal(t, s1, sPrepared[0])
+	assert.Equal(t, 1, len(sQueried))
+	assertFromFingerprint(t, s1, sQueried[0])
+}
+
+// assertFromFingerprint checks that a row of the sensors is from a
+// fingerprint. The row of a timestamp has one of its sensor types.
+func assertFromFingerprint(t *testing.T, expected models.SensorData, actual models.SensorData) {
+	assert.Equal(t, expected.Timestamp, actual.Timestamp)
+	assert.Equal(t, expected.Device, actual.Device)
+	assert.Equal(t, expected.Location, actual.Location)
+	assert.Equal(t, 1, len(actual.Sensors))
+	for sensorType := range actual.Sensors {
+		assert.Equal(t, expected.Sensors[sensorType], actual.Sensors[sensorType])
+	}
 }
 
 func TestGetAllForClassification(t *testing.T) {
-	os.Remove("test.csv")
+	defer useTempFolder(t)()
 
 	var err error
 	var s models.SensorData
@@ -58,9 +69,12 @@ func TestGetAllForClassification(t *testing.T) {
 	err = db.AddSensor(s)
 	assert.Nil(t, err)
 
-	ss, err := db.GetAllForClassification()
-	assert.Equal(t, 2, len(ss))
-	assert.Nil(t, err)
+	db.Sync()
+
+	db.GetAllForClassification(func(ss []models.SensorData, err error) {
+		assert.Equal(t, 2, len(ss))
+		assert.Nil(t, err)
+	})
 
 }
 
@@ -69,7 +83,6 @@ func BenchmarkAddSensor(b *testing.B) {
 	json.Unmarshal([]byte(j), &s)
 	db, _ := Open("testing")
 	defer db.Close()
-	db.Debug(false)
 
 	for i := 0; i < b.N; i++ {
 		s.Timestamp = int64(i)
@@ -88,7 +101,6 @@ func BenchmarkGetSensor(b *testing.B) {
 	}
 	db, _ := Open("testing")
 	defer db.Close()
-	db.Debug(false)
 	err = db.AddSensor(s)
 	b.ResetTimer()
 
@@ -102,7 +114,6 @@ func BenchmarkGetSensor(b *testing.B) {
 func BenchmarkKeystoreSet(b *testing.B) {
 	db, _ := Open("testing")
 	defer db.Close()
-	db.Debug(false)
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -116,7 +127,6 @@ func BenchmarkKeystoreSet(b *testing.B) {
 func BenchmarkKeystoreOpenAndSet(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		db, _ := Open("testing")
-		db.Debug(false)
 		err := db.Set("human:"+strconv.Itoa(i), Human{"Dante", 5.4})
 		if err != nil {
 			panic(err)
@@ -128,7 +138,6 @@ func BenchmarkKeystoreOpenAndSet(b *testing.B) {
 func BenchmarkKeystoreGet(b *testing.B) {
 	db, _ := Open("testing")
 	defer db.Close()
-	db.Debug(false)
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -144,7 +153,6 @@ func BenchmarkGetLatest(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 		db, _ := Open("testing")
-		db.Debug(false)
 		db.GetLatest(s1.Device)
 		db.Close()
 	}
@@ -3,6 +3,7 @@ package database
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	// "math"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -80,14 +82,14 @@ func (self *Database) prepareAndRunQueryWithCallback(query string, clbk func(*sq
 	return clbk(rows)
 }
 
-func (self *Database) runQuery(query string, eachRow func(*sql.Rows) error) error {
+func (self *Database) runQuery(query string, eachRow func(*sql.Rows) error, args ...interface{}) error {
 	stmt, err := self.PrepareQuery(query)
 	if nil != err {
 		return err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query()
+	rows, err := stmt.Query(args...)
 	if nil != err {
 		return err
 	}
@@ -136,10 +138,10 @@ func (self *Database) Select(clbk func(string, *Database) error) error {
 	defer reader.Close()
 
 	// run callback
-	logger.Tracef("Running SELECT query %v", query_id)
+	self.logger.Tracef("Running SELECT query %v", query_id)
 	t1 := time.Now()
 	err = clbk(query_id, reader)
-	logger.Tracef("Finished SELECT query %v %v", query_id, time.Since(t1))
+	self.logger.Tracef("Finished SELECT query %v %v", query_id, time.Since(t1))
 	return err
 }
 
@@ -170,7 +172,7 @@ func (self *Database) Insert(query string, executor func(*sql.Stmt) error) error
 }
 
 func (self *Database) insert(query_id string, query string, executor func(*sql.Stmt) error) error {
-	logger.Tracef("%v %v", query_id, query)
+	self.logger.Tracef("%v %v", query_id, query)
 
 	tx, err := self.db.Begin()
 	if nil != err {
@@ -216,9 +218,8 @@ func (self *Database) Set(key string, value interface{}) error {
 }
 
 // AddCalibration inserts calibration data as single transaction in a single row
-// TODO
-// INSERT AND GET AS A SINGLE TRANSACTION
-func (self *Database) AddCalibration(ProbabilityMeans []float64, ProbabilitiesOfBestGuess interface{}, PercentCorrect float64, AccuracyBreakdown interface{}, PredictionAnalysis interface{}, AlgorithmEfficacy interface{}) error {
+// and returns the id of the new calibration.
+func (self *Database) AddCalibration(ProbabilityMeans []float64, ProbabilitiesOfBestGuess interface{}, PercentCorrect float64, AccuracyBreakdown interface{}, PredictionAnalysis interface{}, AlgorithmEfficacy interface{}, CrossValidation interface{}) (int, error) {
 
 	// GoLang doesnt support NaN for json.Marshal
 	// Don't return on error...
@@ -258,29 +259,43 @@ func (self *Database) AddCalibration(ProbabilityMeans []float64, ProbabilitiesOf
 		logger.Warn(err)
 		// return err
 	}
+	cross_validation, err := json.Marshal(CrossValidation)
+	if err != nil {
+		logger.Warn(err)
+		// return err
+	}
 
-	self.insertAsync(func(query_id string) {
-		self.insert(query_id, `
+	// insert synchronously so the calibration is available once this returns
+	var id int64
+	var errInsert error
+	self.insertSync(func(query_id string) {
+		errInsert = self.insert(query_id, `
 			INSERT OR REPLACE INTO calibrations(
 				probability_means,
 				probabilities_of_best_guess,
 				percent_correct,
 				accuracy_breakdown,
 				prediction_analysis,
-				algorithm_efficacy
+				algorithm_efficacy,
+				cross_validation
 			)
-			VALUES (?, ?, ?, ?, ?, ?)`, func(stmt *sql.Stmt) error {
-			_, err = stmt.Exec(
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, func(stmt *sql.Stmt) error {
+			result, err := stmt.Exec(
 				string(probability_means),
 				string(probabilities_of_best_guess),
 				string(percent_correct),
 				string(accuracy_breakdown),
 				string(prediction_analysis),
-				string(algorithm_efficacy))
+				string(algorithm_efficacy),
+				string(cross_validation))
+			if err != nil {
+				return err
+			}
+			id, err = result.LastInsertId()
 			return err
 		})
 	})
-	return nil
+	return int(id), errInsert
 }
 
 // GetCalibration
@@ -292,7 +307,7 @@ func (self *Database) GetCalibration() (CalibrationModel, error) {
 		return self.queryRow(`
 		SELECT `+CALIBRATION_SQL+`
 		FROM calibrations
-		ORDER BY calibration_time DESC
+		ORDER BY calibration_time DESC, id DESC
 		LIMIT 1
 		`, func(row *sql.Row) error {
 			return row.Scan(&result)
@@ -314,6 +329,318 @@ func (self *Database) GetCalibration() (CalibrationModel, error) {
 	return calibration, err
 }
 
+// GetActiveCalibration returns the calibration of the models that are in use.
+// This is the latest calibration unless a model snapshot has been promoted.
+func (self *Database) GetActiveCalibration() (CalibrationModel, error) {
+	var calibration CalibrationModel
+	var result string
+
+	err := self.Select(func(query_id string, db *Database) error {
+		return self.queryRow(`
+		SELECT `+CALIBRATION_SQL+`
+		FROM calibrations
+		ORDER BY
+			id = IFNULL((
+				SELECT model_snapshots.calibration_id
+				FROM model_snapshots, keystore
+				WHERE keystore.key = 'ActiveSnapshot'
+				AND model_snapshots.id = CAST(keystore.value AS INTEGER)
+			), -1) DESC,
+			calibration_time DESC,
+			id DESC
+		LIMIT 1
+		`, func(row *sql.Row) error {
+			return row.Scan(&result)
+		})
+	})
+
+	if nil != err {
+		return calibration, err
+	}
+
+	err = json.Unmarshal([]byte(result), &calibration)
+	return calibration, err
+}
+
+// GetCalibrations returns the most recent calibrations, newest first
+func (self *Database) GetCalibrations(limit int) ([]CalibrationModel, error) {
+	var calibrations []CalibrationModel
+	var result string
+
+	err := self.Select(func(query_id string, db *Database) error {
+		return self.queryRow(`
+		SELECT '[' ||
+			(SELECT IFNULL(GROUP_CONCAT(calibration), '') FROM (
+				SELECT `+CALIBRATION_SQL+` AS calibration
+				FROM calibrations
+				ORDER BY id DESC
+				LIMIT ?
+			))
+		|| ']'`, func(row *sql.Row) error {
+			return row.Scan(&result)
+		}, limit)
+	})
+
+	if nil != err {
+		return calibrations, err
+	}
+
+	// unmarshal outside of select to close database faster
+	err = json.Unmarshal([]byte(result), &calibrations)
+	if nil != err {
+		return calibrations, err
+	}
+	sort.Slice(calibrations, func(i, j int) bool {
+		return calibrations[i].Id > calibrations[j].Id
+	})
+	return calibrations, err
+}
+
+// GetCalibrationById returns the calibration with the given id
+func (self *Database) GetCalibrationById(id int) (CalibrationModel, error) {
+	var calibration CalibrationModel
+	var result string
+
+	err := self.Select(func(query_id string, db *Database) error {
+		return self.queryRow(`
+		SELECT `+CALIBRATION_SQL+`
+		FROM calibrations
+		WHERE id = ?
+		`, func(row *sql.Row) error {
+			return row.Scan(&result)
+		}, id)
+	})
+
+	if nil != err {
+		if err == sql.ErrNoRows {
+			err = errors.New(fmt.Sprintf("calibration %d does not exist", id))
+		}
+		return calibration, err
+	}
+
+	err = json.Unmarshal([]byte(result), &calibration)
+	return calibration, err
+}
+
+// MODEL_SNAPSHOT_COLUMNS are the columns scanned by scanModelSnapshot
+const MODEL_SNAPSHOT_COLUMNS = `id, IFNULL(calibration_id, 0), IFNULL(percent_correct, 0), promoted, IFNULL(reason, ''), create_at`
+
+func scanModelSnapshot(scanner interface {
+	Scan(dest ...interface{}) error
+}) (snapshot models.ModelSnapshot, err error) {
+	err = scanner.Scan(
+		&snapshot.ID,
+		&snapshot.CalibrationID,
+		&snapshot.PercentCorrect,
+		&snapshot.Promoted,
+		&snapshot.Reason,
+		&snapshot.CreateAt)
+	return
+}
+
+// AddModelSnapshot saves a copy of the naive bayes models that are
+// currently in the keystore, along with the calibration they belong to
+// and the RSSI calibrations they were fitted on.
+func (self *Database) AddModelSnapshot(calibrationID int, percentCorrect float64, promoted bool, reason string) (models.ModelSnapshot, error) {
+	calibrations, err := self.GetRSSICalibrations()
+	if err != nil {
+		return models.ModelSnapshot{}, err
+	}
+	rssi := []models.RSSICalibration{}
+	for _, c := range calibrations {
+		rssi = append(rssi, c)
+	}
+	bRSSI, err := json.Marshal(rssi)
+	if err != nil {
+		return models.ModelSnapshot{}, err
+	}
+	var id int64
+	var errInsert error
+	self.insertSync(func(query_id string) {
+		errInsert = self.insert(query_id, `
+			INSERT INTO model_snapshots(
+				calibration_id,
+				percent_correct,
+				promoted,
+				reason,
+				nb1,
+				nb2,
+				rssi_calibrations
+			)
+			VALUES (?, ?, ?, ?,
+				(SELECT value FROM keystore WHERE key = 'NB1'),
+				(SELECT value FROM keystore WHERE key = 'NB2'),
+				?)`, func(stmt *sql.Stmt) error {
+			result, err := stmt.Exec(calibrationID, percentCorrect, promoted, reason, string(bRSSI))
+			if err != nil {
+				return err
+			}
+			id, err = result.LastInsertId()
+			return err
+		})
+	})
+	if errInsert != nil {
+		return models.ModelSnapshot{}, errInsert
+	}
+	return self.GetModelSnapshot(int(id))
+}
+
+// GetModelSnapshot returns the model snapshot with the given id
+func (self *Database) GetModelSnapshot(id int) (models.ModelSnapshot, error) {
+	var snapshot models.ModelSnapshot
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.queryRow(`
+		SELECT `+MODEL_SNAPSHOT_COLUMNS+`
+		FROM model_snapshots
+		WHERE id = ?`, func(row *sql.Row) (err error) {
+			snapshot, err = scanModelSnapshot(row)
+			return err
+		}, id)
+	})
+	if err == sql.ErrNoRows {
+		err = errors.New(fmt.Sprintf("model snapshot %d does not exist", id))
+	}
+	return snapshot, err
+}
+
+// GetModelSnapshots returns all model snapshots, newest first
+func (self *Database) GetModelSnapshots() ([]models.ModelSnapshot, error) {
+	snapshots := []models.ModelSnapshot{}
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.runQuery(`
+		SELECT `+MODEL_SNAPSHOT_COLUMNS+`
+		FROM model_snapshots
+		ORDER BY id DESC`,
+			func(rows *sql.Rows) error {
+				snapshot, err := scanModelSnapshot(rows)
+				if nil != err {
+					return err
+				}
+				snapshots = append(snapshots, snapshot)
+				return nil
+			})
+	})
+	return snapshots, err
+}
+
+// DeleteOldModelSnapshots deletes the model snapshots that are not among
+// the newest ones, except for the snapshots to keep. It returns the ids of
+// the deleted snapshots.
+func (self *Database) DeleteOldModelSnapshots(newest int, keep ...int) (deleted []int, err error) {
+	self.insertSync(func(query_id string) {
+		var tx *sql.Tx
+		tx, err = self.db.Begin()
+		if err != nil {
+			return
+		}
+		err = func() (err error) {
+			rows, err := tx.Query(`SELECT id FROM model_snapshots
+				WHERE id NOT IN (SELECT id FROM model_snapshots ORDER BY id DESC LIMIT ?)`, newest)
+			if err != nil {
+				return
+			}
+			kept := make(map[int]bool)
+			for _, id := range keep {
+				kept[id] = true
+			}
+			for rows.Next() {
+				var id int
+				if err = rows.Scan(&id); err != nil {
+					rows.Close()
+					return
+				}
+				if !kept[id] {
+					deleted = append(deleted, id)
+				}
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return
+			}
+			for _, id := range deleted {
+				if _, err = tx.Exec("DELETE FROM model_snapshots WHERE id = ?", id); err != nil {
+					return
+				}
+			}
+			return
+		}()
+		if err != nil {
+			tx.Rollback()
+			deleted = nil
+			err = errors.Wrap(err, "could not delete model snapshots")
+			return
+		}
+		err = tx.Commit()
+	})
+	return
+}
+
+// RestoreModelSnapshot puts the naive bayes models of a snapshot back
+// into the keystore, and the RSSI calibrations they were fitted on, and
+// marks the snapshot as the active one. Snapshots from before the RSSI
+// calibrations were saved keep the current ones.
+func (self *Database) RestoreModelSnapshot(id int) (err error) {
+	_, err = self.GetModelSnapshot(id)
+	if err != nil {
+		return
+	}
+	var bRSSI sql.NullString
+	err = self.Select(func(query_id string, db *Database) error {
+		return db.queryRow("SELECT rssi_calibrations FROM model_snapshots WHERE id = ?", func(row *sql.Row) error {
+			return row.Scan(&bRSSI)
+		}, id)
+	})
+	if err != nil {
+		return
+	}
+	var rssi []models.RSSICalibration
+	if bRSSI.Valid {
+		if err = json.Unmarshal([]byte(bRSSI.String), &rssi); err != nil {
+			return
+		}
+	}
+	self.insertSync(func(query_id string) {
+		if bRSSI.Valid {
+			err = self.insert(query_id, "DELETE FROM rssi_calibrations", func(stmt *sql.Stmt) error {
+				_, err := stmt.Exec()
+				return err
+			})
+			if err != nil {
+				return
+			}
+			err = self.insert(query_id, "INSERT INTO rssi_calibrations(id, rssi_offset, rssi_scale, source, samples) VALUES (?, ?, ?, ?, ?)", func(stmt *sql.Stmt) error {
+				for _, c := range rssi {
+					if _, err := stmt.Exec(c.Device, c.Offset, c.Scale, c.Source, c.Samples); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+		}
+		for _, key := range []string{"NB1", "NB2"} {
+			err = self.insert(query_id, `
+				INSERT OR REPLACE INTO keystore(key, value)
+				SELECT ?, `+strings.ToLower(key)+`
+				FROM model_snapshots
+				WHERE id = ? AND `+strings.ToLower(key)+` IS NOT NULL`, func(stmt *sql.Stmt) error {
+				_, err := stmt.Exec(key, id)
+				return err
+			})
+			if err != nil {
+				return
+			}
+		}
+		err = self.insert(query_id, "INSERT OR REPLACE INTO keystore(key,value) VALUES (?, ?)", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec("ActiveSnapshot", strconv.Itoa(id))
+			return err
+		})
+	})
+	return
+}
+
 /*
 // SetLearning
 func (self *Database) SetLearning(algo string, data interface{}) error {
@@ -449,17 +776,24 @@ func (self *Database) AddSensor(s models.SensorData) (err error) {
 		location_id = s.Location
 	}
 
+	log := self.logger.WithRequest(s.RequestID)
+	log.Tracef("queued sensor data of %s (%d pending)", device_id, self.GetPending())
 	self.insertAsync(func(query_id string) {
-		self.insert(query_id, "INSERT OR REPLACE INTO sensors(timestamp, deviceid, locationid, sensor_type, sensor) VALUES (?, ?, ?, ?, ?)", func(stmt *sql.Stmt) error {
+		err := self.insert(query_id, "INSERT OR REPLACE INTO sensors(timestamp, deviceid, locationid, sensor_type, sensor) VALUES (?, ?, ?, ?, ?)", func(stmt *sql.Stmt) error {
 			for sensor_type, sensor := range s.Sensors {
 				data, _ := json.Marshal(sensor)
-				_, err = stmt.Exec(s.Timestamp, device_id, location_id, sensor_type, string(data))
+				_, err := stmt.Exec(s.Timestamp, device_id, location_id, sensor_type, string(data))
 				if err != nil {
 					return err
 				}
 			}
 			return nil
 		})
+		if err != nil {
+			log.Errorf("%v could not insert sensor data of %s: %s", query_id, device_id, err.Error())
+		} else {
+			log.Tracef("%v inserted sensor data of %s", query_id, device_id)
+		}
 	})
 	return
 }
@@ -746,7 +1080,10 @@ func (self *Database) GetDevices() ([]string, error) {
 func (self *Database) GetLocations() ([]string, error) {
 	var locations []string
 	err := self.Select(func(query_id string, db *Database) error {
-		return db.runQuery(`SELECT DISTINCT locationid FROM location_predictions`,
+		return db.runQuery(`
+		SELECT locationid FROM location_predictions
+		UNION
+		SELECT name FROM locations`,
 			func(rows *sql.Rows) error {
 				var name string
 				err := rows.Scan(&name)
@@ -789,21 +1126,499 @@ func GetFamilies() (families []string) {
 }
 
 // DeleteLocation deletes sensors that have a locationid
-func (self *Database) DeleteLocation(location_id string) error {
-	var err error
-	self.insertAsync(func(query_id string) {
-		stmt, err := self.PrepareQuery("DELETE FROM sensors WHERE locationid = ?")
+func (self *Database) DeleteLocation(location_id string, source string) (int64, error) {
+	return self.editSensors(models.AuditEntry{
+		Action:   models.AuditDelete,
+		Location: location_id,
+		Source:   source,
+	}, "DELETE FROM sensors WHERE locationid = ?", location_id)
+}
+
+// RelabelSensors sets the location of the sensors selected by the edit
+func (self *Database) RelabelSensors(edit models.FingerprintEdit, source string) (int64, error) {
+	where, args := sensorEditFilter(edit)
+	return self.editSensors(models.AuditEntry{
+		Action:      models.AuditRelabel,
+		Device:      edit.Device,
+		Location:    edit.Location,
+		NewLocation: edit.NewLocation,
+		From:        edit.From,
+		To:          edit.To,
+		Source:      source,
+	}, "UPDATE sensors SET locationid = ? WHERE "+where, append([]interface{}{edit.NewLocation}, args...)...)
+}
+
+// DeleteSensors deletes the sensors selected by the edit
+func (self *Database) DeleteSensors(edit models.FingerprintEdit, source string) (int64, error) {
+	where, args := sensorEditFilter(edit)
+	return self.editSensors(models.AuditEntry{
+		Action:   models.AuditDelete,
+		Device:   edit.Device,
+		Location: edit.Location,
+		From:     edit.From,
+		To:       edit.To,
+		Source:   source,
+	}, "DELETE FROM sensors WHERE "+where, args...)
+}
+
+func sensorEditFilter(edit models.FingerprintEdit) (where string, args []interface{}) {
+	where = "deviceid = ? AND timestamp BETWEEN ? AND ?"
+	args = []interface{}{edit.Device, edit.From, edit.To}
+	if edit.Location != "" {
+		where += " AND locationid = ?"
+		args = append(args, edit.Location)
+	}
+	return
+}
+
+// editSensors runs a query that changes the sensors and records it in the
+// audit log, as a single transaction. It returns the number of changed rows.
+func (self *Database) editSensors(entry models.AuditEntry, query string, args ...interface{}) (int64, error) {
+	return self.auditedTransaction(entry, func(tx *sql.Tx) (int64, error) {
+		logger.Trace(query)
+		result, err := tx.Exec(query, args...)
+		if nil != err {
+			return 0, err
+		}
+		return result.RowsAffected()
+	})
+}
+
+// auditedTransaction runs the changes and records them in the audit log,
+// as a single transaction. It returns the number of changed rows.
+func (self *Database) auditedTransaction(entry models.AuditEntry, changes func(*sql.Tx) (int64, error)) (affected int64, err error) {
+	self.insertSync(func(query_id string) {
+		logger.Tracef("%v audited %s", query_id, entry.Action)
+		var tx *sql.Tx
+		tx, err = self.db.Begin()
 		if nil != err {
 			return
 		}
+		err = func() error {
+			affected, err = changes(tx)
+			if nil != err {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO audit_log(
+					action,
+					deviceid,
+					locationid,
+					new_locationid,
+					from_time,
+					to_time,
+					affected,
+					source
+				)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				entry.Action,
+				entry.Device,
+				entry.Location,
+				entry.NewLocation,
+				entry.From,
+				entry.To,
+				affected,
+				entry.Source)
+			return err
+		}()
+		if nil != err {
+			if err_rollback := tx.Rollback(); nil != err_rollback {
+				logger.Error(err_rollback)
+			}
+			return
+		}
+		err = tx.Commit()
+	})
+	return
+}
+
+// GetAuditLog returns the most recent changes to the learning data, newest first
+func (self *Database) GetAuditLog(limit int) ([]models.AuditEntry, error) {
+	entries := []models.AuditEntry{}
+	err := self.Select(func(query_id string, db *Database) error {
+		stmt, err := db.PrepareQuery(`
+		SELECT
+			id,
+			action,
+			IFNULL(deviceid, ''),
+			IFNULL(locationid, ''),
+			IFNULL(new_locationid, ''),
+			IFNULL(from_time, 0),
+			IFNULL(to_time, 0),
+			IFNULL(affected, 0),
+			IFNULL(source, ''),
+			create_at
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT ?`)
+		if nil != err {
+			return err
+		}
 		defer stmt.Close()
 
-		_, err = stmt.Exec(location_id)
+		rows, err := stmt.Query(limit)
 		if nil != err {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var entry models.AuditEntry
+			err = rows.Scan(
+				&entry.ID,
+				&entry.Action,
+				&entry.Device,
+				&entry.Location,
+				&entry.NewLocation,
+				&entry.From,
+				&entry.To,
+				&entry.Affected,
+				&entry.Source,
+				&entry.CreateAt)
+			if nil != err {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return rows.Err()
+	})
+	return entries, err
+}
+
+// LOCATION_COLUMNS are the columns scanned by scanLocation
+const LOCATION_COLUMNS = `
+	name,
+	IFNULL(display_name, ''),
+	IFNULL(aliases, '[]'),
+	IFNULL(floor, ''),
+	IFNULL(building, ''),
+	IFNULL(x, 0),
+	IFNULL(y, 0),
+	IFNULL(lat, 0),
+	IFNULL(lon, 0),
+	IFNULL(polygon, '[]'),
+	IFNULL(tags, '[]'),
+	create_at,
+	update_at`
+
+func scanLocation(scanner interface {
+	Scan(dest ...interface{}) error
+}) (location models.Location, err error) {
+	var aliases, polygon, tags string
+	err = scanner.Scan(
+		&location.Name,
+		&location.DisplayName,
+		&aliases,
+		&location.Floor,
+		&location.Building,
+		&location.X,
+		&location.Y,
+		&location.Latitude,
+		&location.Longitude,
+		&polygon,
+		&tags,
+		&location.CreateAt,
+		&location.UpdateAt)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(aliases), &location.Aliases)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(polygon), &location.Polygon)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(tags), &location.Tags)
+	return
+}
+
+// GetLocationMetadata returns the metadata of all registered locations
+func (self *Database) GetLocationMetadata() ([]models.Location, error) {
+	locations := []models.Location{}
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.runQuery(`SELECT `+LOCATION_COLUMNS+` FROM locations ORDER BY name`,
+			func(rows *sql.Rows) error {
+				location, err := scanLocation(rows)
+				if nil != err {
+					return err
+				}
+				locations = append(locations, location)
+				return nil
+			})
+	})
+	return locations, err
+}
+
+// GetLocationMetadataByName returns the metadata of a registered location
+func (self *Database) GetLocationMetadataByName(name string) (models.Location, error) {
+	var location models.Location
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.queryRow(`SELECT `+LOCATION_COLUMNS+` FROM locations WHERE name = ?`, func(row *sql.Row) (err error) {
+			location, err = scanLocation(row)
+			return err
+		}, name)
+	})
+	if err == sql.ErrNoRows {
+		err = errors.New(fmt.Sprintf("location '%s' is not registered", name))
+	}
+	return location, err
+}
+
+// SetLocationMetadata registers a location, or updates its metadata
+func (self *Database) SetLocationMetadata(location models.Location) (err error) {
+	aliases, err := json.Marshal(location.Aliases)
+	if err != nil {
+		return
+	}
+	polygon, err := json.Marshal(location.Polygon)
+	if err != nil {
+		return
+	}
+	tags, err := json.Marshal(location.Tags)
+	if err != nil {
+		return
+	}
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, `
+			INSERT OR REPLACE INTO locations(
+				name,
+				display_name,
+				aliases,
+				floor,
+				building,
+				x,
+				y,
+				lat,
+				lon,
+				polygon,
+				tags,
+				create_at
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+				IFNULL((SELECT create_at FROM locations WHERE name = ?), CURRENT_TIMESTAMP))`, func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(
+				location.Name,
+				location.DisplayName,
+				string(aliases),
+				location.Floor,
+				location.Building,
+				location.X,
+				location.Y,
+				location.Latitude,
+				location.Longitude,
+				string(polygon),
+				string(tags),
+				location.Name)
+			return err
+		})
+	})
+	return
+}
+
+// DeleteLocationMetadata unregisters a location, its learning data is kept
+func (self *Database) DeleteLocationMetadata(name string) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "DELETE FROM locations WHERE name = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(name)
+			return err
+		})
+	})
+	return
+}
+
+// ResolveLocationAlias returns the name of the registered location that has
+// the alias, or the alias itself when no location has it.
+func (self *Database) ResolveLocationAlias(alias string) (name string, err error) {
+	quoted, err := json.Marshal(alias)
+	if err != nil {
+		return
+	}
+	err = self.Select(func(query_id string, db *Database) error {
+		return db.queryRow(`SELECT name FROM locations WHERE instr(aliases, ?) > 0 LIMIT 1`, func(row *sql.Row) error {
+			return row.Scan(&name)
+		}, string(quoted))
+	})
+	if err == sql.ErrNoRows {
+		name, err = alias, nil
+	}
+	return
+}
+
+// RenameLocation moves the learning data and predictions of a location to a
+// new name, and renames its metadata or registers it if there is none, as a
+// single transaction.
+func (self *Database) RenameLocation(oldName string, location models.Location, source string) (int64, error) {
+	aliases, err := json.Marshal(location.Aliases)
+	if err != nil {
+		return 0, err
+	}
+	return self.auditedTransaction(models.AuditEntry{
+		Action:      models.AuditRename,
+		Location:    oldName,
+		NewLocation: location.Name,
+		Source:      source,
+	}, func(tx *sql.Tx) (affected int64, err error) {
+		result, err := tx.Exec("UPDATE sensors SET locationid = ? WHERE locationid = ?", location.Name, oldName)
+		if err != nil {
+			return
+		}
+		affected, err = result.RowsAffected()
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec("UPDATE location_predictions SET locationid = ? WHERE locationid = ?", location.Name, oldName)
+		if err != nil {
+			return
+		}
+		// the metadata keeps its other fields, so only the names change
+		result, err = tx.Exec(`
+			UPDATE locations
+			SET name = ?, aliases = ?, update_at = CURRENT_TIMESTAMP
+			WHERE name = ?`, location.Name, string(aliases), oldName)
+		if err != nil {
 			return
 		}
+		renamed, err := result.RowsAffected()
+		if err != nil || renamed > 0 {
+			return
+		}
+		// an unregistered location is registered, to keep its old name
+		_, err = tx.Exec(`INSERT OR REPLACE INTO locations(name, aliases) VALUES (?, ?)`, location.Name, string(aliases))
+		return
 	})
-	return err
+}
+
+// DEVICE_COLUMNS are the columns scanned by scanDevice
+const DEVICE_COLUMNS = `
+	id,
+	IFNULL(name, ''),
+	IFNULL(owner, ''),
+	IFNULL(type, ''),
+	IFNULL(device_group, ''),
+	ignored,
+	create_at,
+	update_at`
+
+func scanDevice(scanner interface {
+	Scan(dest ...interface{}) error
+}) (device models.Device, err error) {
+	err = scanner.Scan(
+		&device.ID,
+		&device.Name,
+		&device.Owner,
+		&device.Type,
+		&device.Group,
+		&device.Ignore,
+		&device.CreateAt,
+		&device.UpdateAt)
+	device.Registered = err == nil
+	return
+}
+
+// GetDeviceMetadata returns the metadata of all registered devices
+func (self *Database) GetDeviceMetadata() ([]models.Device, error) {
+	devices := []models.Device{}
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.runQuery(`SELECT `+DEVICE_COLUMNS+` FROM devices ORDER BY id`,
+			func(rows *sql.Rows) error {
+				device, err := scanDevice(rows)
+				if nil != err {
+					return err
+				}
+				devices = append(devices, device)
+				return nil
+			})
+	})
+	return devices, err
+}
+
+// GetDeviceMetadataById returns the metadata of a registered device
+func (self *Database) GetDeviceMetadataById(id string) (models.Device, error) {
+	var device models.Device
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.queryRow(`SELECT `+DEVICE_COLUMNS+` FROM devices WHERE id = ?`, func(row *sql.Row) (err error) {
+			device, err = scanDevice(row)
+			return err
+		}, id)
+	})
+	if err == sql.ErrNoRows {
+		err = errors.New(fmt.Sprintf("device '%s' is not registered", id))
+	}
+	return device, err
+}
+
+// GetDeviceMetadataOf returns the metadata of the registered devices
+// among the devices, by id
+func (self *Database) GetDeviceMetadataOf(devices []string) (map[string]models.Device, error) {
+	registered := make(map[string]models.Device)
+	err := self.Select(func(query_id string, db *Database) error {
+		for start := 0; start < len(devices); start += maxQueryVariables {
+			end := start + maxQueryVariables
+			if end > len(devices) {
+				end = len(devices)
+			}
+			args := make([]interface{}, end-start)
+			for i, device := range devices[start:end] {
+				args[i] = device
+			}
+			err := db.runQuery(`SELECT `+DEVICE_COLUMNS+` FROM devices WHERE id IN (?`+strings.Repeat(",?", len(args)-1)+`)`,
+				func(rows *sql.Rows) error {
+					device, err := scanDevice(rows)
+					if nil != err {
+						return err
+					}
+					registered[device.ID] = device
+					return nil
+				}, args...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return registered, err
+}
+
+// SetDeviceMetadata registers a device, or updates its metadata
+func (self *Database) SetDeviceMetadata(device models.Device) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, `
+			INSERT OR REPLACE INTO devices(
+				id,
+				name,
+				owner,
+				type,
+				device_group,
+				ignored,
+				create_at
+			)
+			VALUES (?, ?, ?, ?, ?, ?,
+				IFNULL((SELECT create_at FROM devices WHERE id = ?), CURRENT_TIMESTAMP))`, func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(
+				device.ID,
+				device.Name,
+				device.Owner,
+				device.Type,
+				device.Group,
+				device.Ignore,
+				device.ID)
+			return err
+		})
+	})
+	return
+}
+
+// DeleteDeviceMetadata unregisters a device, its sensor data is kept
+func (self *Database) DeleteDeviceMetadata(id string) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "DELETE FROM devices WHERE id = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(id)
+			return err
+		})
+	})
+	return
 }
 
 // Delete destroys database file
@@ -914,15 +1729,36 @@ func (self *Database) StartRequestQueue() {
 
 			t1 := time.Now()
 			query_id := self.getQId("w")
-			logger.Tracef("Running INSERT query %v", query_id)
+			self.logger.Tracef("Running INSERT query %v", query_id)
 			request_func(query_id)
-			logger.Tracef("Finished INSERT query %v %v", query_id, time.Since(t1))
+			self.logger.Tracef("Finished INSERT query %v %v", query_id, time.Since(t1))
 
 			self.LastInsertTime = time.Now()
 		}
 	}()
 }
 
+// Sync blocks until all previously queued inserts have been written
+func (self *Database) Sync() {
+	self.insertSync(func(query_id string) {})
+}
+
+// Drain blocks until all previously queued inserts have been written,
+// or until the context is done
+func (self *Database) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	// the queue may be full, so do not block on adding to it
+	go self.insertAsync(func(query_id string) {
+		close(done)
+	})
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "%d inserts of %s were not written", self.GetPending(), self.family)
+	}
+}
+
 // Generate query id for debugging
 func (self *Database) getQId(mode string) string {
 	self.lock.Lock()
@@ -946,25 +1782,54 @@ func Fatal(err error, wrapper string) {
 
 // Exists checks for the presense of a database file
 func Exists(name string) (err error) {
-	name = strings.TrimSpace(name)
-	name = path.Join(DataFolder, base58.FastBase58Encoding([]byte(name))+".sqlite3.db")
+	name = Filename(name)
 	if _, err = os.Stat(name); err != nil {
 		err = errors.New("database '" + name + "' does not exist")
 	}
 	return
 }
 
+var (
+	migrated     = make(map[string]bool)
+	migratedLock sync.Mutex
+)
+
+// migrate brings the tables of an existing database up to date.
+// It only runs once for each database file.
+func (self *Database) migrate() (err error) {
+	migratedLock.Lock()
+	defer migratedLock.Unlock()
+	if migrated[self.name] {
+		return
+	}
+	_, err = self.db.Exec(TABLES_SQL)
+	if err != nil {
+		err = errors.Wrap(err, "could not create tables")
+		return
+	}
+	for _, migration := range MIGRATIONS_SQL {
+		_, errMigrate := self.db.Exec(migration)
+		if errMigrate != nil && !strings.Contains(errMigrate.Error(), "duplicate column") {
+			err = errors.Wrap(errMigrate, "could not migrate database")
+			return
+		}
+	}
+	migrated[self.name] = true
+	return
+}
+
 // Open will open the database for transactions by first aquiring a filelock.
 func Open(family string, readOnly ...bool) (d *Database, err error) {
 	d = new(Database)
 	d.family = strings.TrimSpace(family)
+	d.logger = logger.WithFamily(d.family)
 
 	// convert the name to base64 for file writing
 	// override the name
 	if len(readOnly) > 1 && readOnly[1] {
 		d.name = path.Join(DataFolder, d.family)
 	} else {
-		d.name = path.Join(DataFolder, base58.FastBase58Encoding([]byte(d.family))+".sqlite3.db")
+		d.name = Filename(d.family)
 	}
 
 	// if read-only, make sure the database exists
@@ -992,6 +1857,10 @@ func Open(family string, readOnly ...bool) (d *Database, err error) {
 			return
 		}
 	}
+	err = d.migrate()
+	if err != nil {
+		return
+	}
 	d.StartRequestQueue()
 
 	return
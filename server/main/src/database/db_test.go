@@ -1,6 +1,7 @@
 package database
 
 import (
+	"io/ioutil"
 	"os"
 	"strconv"
 	"testing"
@@ -73,12 +74,26 @@ var j2 = `{
 	}
 }`
 
+// useTempFolder keeps the databases of a test in a temporary folder
+func useTempFolder(t *testing.T) (cleanup func()) {
+	folder, err := ioutil.TempDir("", "database")
+	assert.Nil(t, err)
+	DataFolder = folder
+	return func() {
+		DataFolder = DEFAULT_DATA_FOLDER
+		os.RemoveAll(folder)
+	}
+}
+
 func TestKeystore(t *testing.T) {
+	defer useTempFolder(t)()
 	db, err := Open("testing")
 	assert.Nil(t, err)
 
 	err = db.Set("hello", "world")
 	assert.Nil(t, err)
+	// the keystore is written by the queue
+	db.Sync()
 	var s string
 	err = db.Get("hello", &s)
 	assert.Nil(t, err)
@@ -87,6 +102,7 @@ func TestKeystore(t *testing.T) {
 	h := Human{"Dante", 5.4}
 	err = db.Set("human1", h)
 	assert.Nil(t, err)
+	db.Sync()
 	var h2 Human
 	err = db.Get("human1", &h2)
 	assert.Nil(t, err)
@@ -96,17 +112,12 @@ func TestKeystore(t *testing.T) {
 	err = db.Get("human2", &h2)
 	assert.NotNil(t, err)
 
-	// check the table columns
-	var columns []string
-	columns, err = db.Columns()
-	assert.Nil(t, err)
-	assert.Equal(t, []string{"timestamp", "family", "device", "location"}, columns[0:4])
-
 	err = db.Close()
 	assert.Nil(t, err)
 }
 
 func TestConcurrency(t *testing.T) {
+	defer useTempFolder(t)()
 	errors := make(chan error)
 	for i := 0; i < 3; i++ {
 		go func(n int) {
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mr-tron/base58/base58"
+	"github.com/pkg/errors"
+)
+
+// Filename returns the file of the database of a family
+func Filename(family string) string {
+	return path.Join(DataFolder, base58.FastBase58Encoding([]byte(strings.TrimSpace(family)))+".sqlite3.db")
+}
+
+// sqliteSuffixes are the files that sqlite may keep next to a database
+var sqliteSuffixes = []string{"", "-journal", "-wal", "-shm"}
+
+// Rename renames the database of a family. It must not be open.
+func Rename(from string, to string) (err error) {
+	from = strings.TrimSpace(from)
+	to = strings.TrimSpace(to)
+	if err = Exists(from); err != nil {
+		return
+	}
+	if Exists(to) == nil {
+		return errors.Errorf("family '%s' already exists", to)
+	}
+	for _, suffix := range sqliteSuffixes {
+		if _, errStat := os.Stat(Filename(from) + suffix); errStat != nil {
+			continue
+		}
+		err = os.Rename(Filename(from)+suffix, Filename(to)+suffix)
+		if err != nil {
+			return errors.Wrap(err, "could not rename database")
+		}
+	}
+	migratedLock.Lock()
+	delete(migrated, Filename(from))
+	migratedLock.Unlock()
+	return
+}
+
+// mergeTables are the tables that are copied by Merge. Tables with an
+// autoincrement id get new ids. Calibrations and models are not merged,
+// the family needs to be calibrated again, but the RSSI calibrations of
+// the scanners are.
+var mergeTables = []struct {
+	name  string
+	newID bool
+}{
+	{"sensors", false},
+	{"location_predictions", false},
+	{"gps", true},
+	{"locations", false},
+	{"devices", false},
+	{"scanners", false},
+	{"rssi_calibrations", false},
+	{"reference_beacons", false},
+	{"private_devices", false},
+	{"audit_log", true},
+}
+
+// Merge copies the fingerprints, predictions, locations and devices of
+// another family into this one. Rows that this family already has, such as
+// fingerprints with the same timestamp, are kept. It returns the number
+// of rows copied from each table.
+func (self *Database) Merge(from string) (merged map[string]int64, err error) {
+	from = strings.TrimSpace(from)
+	if from == self.family {
+		err = errors.New("cannot merge a family into itself")
+		return
+	}
+	if err = Exists(from); err != nil {
+		return
+	}
+	merged = make(map[string]int64)
+	self.insertSync(func(query_id string) {
+		self.logger.Debugf("%v merging %s", query_id, from)
+		err = self.merge(Filename(from), merged)
+	})
+	return
+}
+
+func (self *Database) merge(filename string, merged map[string]int64) (err error) {
+	ctx := context.Background()
+	// attached databases belong to a connection
+	conn, err := self.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS merging", filename)
+	if err != nil {
+		return errors.Wrap(err, "could not open family to merge")
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE merging")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	for _, table := range mergeTables {
+		var columns []string
+		columns, err = commonColumns(ctx, tx, table.name)
+		if err != nil {
+			break
+		}
+		if table.newID {
+			columns = without(columns, "id")
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		list := strings.Join(columns, ",")
+		var res sql.Result
+		res, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO main."+table.name+"("+list+") SELECT "+list+" FROM merging."+table.name)
+		if err != nil {
+			err = errors.Wrapf(err, "could not merge %s", table.name)
+			break
+		}
+		merged[table.name], _ = res.RowsAffected()
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// commonColumns returns the columns of a table that both databases have,
+// since older databases may be missing columns that were added later
+func commonColumns(ctx context.Context, tx *sql.Tx, table string) (columns []string, err error) {
+	mainColumns, err := tableColumns(ctx, tx, "main", table)
+	if err != nil {
+		return
+	}
+	mergingColumns, err := tableColumns(ctx, tx, "merging", table)
+	if err != nil {
+		return
+	}
+	for _, column := range mainColumns {
+		for _, other := range mergingColumns {
+			if column == other {
+				columns = append(columns, column)
+				break
+			}
+		}
+	}
+	return
+}
+
+func tableColumns(ctx context.Context, tx *sql.Tx, schema string, table string) (columns []string, err error) {
+	rows, err := tx.QueryContext(ctx, "PRAGMA "+schema+".table_info("+table+")")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			value      interface{}
+			primaryKey int
+		)
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &value, &primaryKey); err != nil {
+			return
+		}
+		columns = append(columns, name)
+	}
+	err = rows.Err()
+	return
+}
+
+func without(list []string, item string) (kept []string) {
+	for _, s := range list {
+		if s != item {
+			kept = append(kept, s)
+		}
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func addFingerprint(db *Database, timestamp int64, device string, location string) {
+	db.AddSensor(models.SensorData{
+		Timestamp: timestamp,
+		Device:    device,
+		Location:  location,
+		Sensors:   map[string]map[string]interface{}{"wifi": {"aa:bb": -50}},
+	})
+}
+
+func TestRenameAndMerge(t *testing.T) {
+	folder, err := ioutil.TempDir("", "families")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	DataFolder = folder
+	defer func() { DataFolder = DEFAULT_DATA_FOLDER }()
+
+	db, err := Open("kitchen")
+	assert.Nil(t, err)
+	addFingerprint(db, 1, "phone", "kitchen")
+	addFingerprint(db, 2, "phone", "kitchen")
+	db.Sync()
+	db.Close()
+
+	assert.Nil(t, Rename("kitchen", "house"))
+	assert.NotNil(t, Exists("kitchen"))
+	assert.Nil(t, Exists("house"))
+	assert.NotNil(t, Rename("missing", "house"))
+
+	other, err := Open("garage")
+	assert.Nil(t, err)
+	addFingerprint(other, 2, "tablet", "garage")
+	addFingerprint(other, 3, "tablet", "garage")
+	other.Sync()
+	other.Close()
+	assert.NotNil(t, Rename("garage", "house"))
+
+	db, err = Open("house")
+	assert.Nil(t, err)
+	defer db.Close()
+	merged, err := db.Merge("garage")
+	assert.Nil(t, err)
+	// the fingerprint with the same timestamp is kept
+	assert.Equal(t, int64(1), merged["sensors"])
+	count, err := db.TotalLearnedCount()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+	devices, err := db.GetDevices()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(devices))
+
+	_, err = db.Merge("house")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameLocation(t *testing.T) {
+	folder, err := ioutil.TempDir("", "locations")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	DataFolder = folder
+	defer func() { DataFolder = DEFAULT_DATA_FOLDER }()
+
+	db, err := Open("locations")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.AddSensor(models.SensorData{
+		Timestamp: 1,
+		Family:    "locations",
+		Device:    "phone",
+		Location:  "kitchen",
+		Sensors:   map[string]map[string]interface{}{"wifi": {"aa:bb:cc:dd:ee:ff": -50}},
+	}))
+	assert.Nil(t, db.SetLocationMetadata(models.Location{Name: "office", Floor: "2"}))
+	db.Sync()
+
+	// a registered location keeps its metadata
+	affected, err := db.RenameLocation("office", models.Location{Name: "study", Floor: "2", Aliases: []string{"office"}}, "test")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), affected)
+	location, err := db.GetLocationMetadataByName("study")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", location.Floor)
+	_, err = db.GetLocationMetadataByName("office")
+	assert.NotNil(t, err)
+
+	// an unregistered location is registered with its old name as alias
+	affected, err = db.RenameLocation("kitchen", models.Location{Name: "cooking", Aliases: []string{"kitchen"}}, "test")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), affected)
+	location, err = db.GetLocationMetadataByName("cooking")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kitchen"}, location.Aliases)
+	name, err := db.ResolveLocationAlias("kitchen")
+	assert.Nil(t, err)
+	assert.Equal(t, "cooking", name)
+}
@@ -6,7 +6,7 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/sjsafranek/ligneous"
+	"github.com/schollz/find4/server/main/src/logging"
 )
 
 const DEFAULT_DATA_FOLDER = "."
@@ -20,7 +20,7 @@ type Database struct {
 	name           string
 	family         string
 	db             *sql.DB
-	logger         *ligneous.SeelogWrapper
+	logger         *logging.Logger
 	isClosed       bool
 	requestQueue   chan func(string)
 	num_queries    int64
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// AddPrivateDevices records the hashed devices, and when they were seen
+func (self *Database) AddPrivateDevices(devices []models.PrivateDevice) {
+	if len(devices) == 0 {
+		return
+	}
+	self.insertAsync(func(query_id string) {
+		err := self.insert(query_id, "INSERT OR REPLACE INTO private_devices(id, oui, randomized, last_seen) VALUES (?, ?, ?, ?)", func(stmt *sql.Stmt) error {
+			for _, d := range devices {
+				_, err := stmt.Exec(d.ID, d.OUI, d.Randomized, d.LastSeen.UnixNano()/int64(time.Millisecond))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			self.logger.Error(errors.Wrap(err, "could not add private devices"))
+		}
+	})
+}
+
+// GetPrivateDevices returns the hashed devices among the devices, by id
+func (self *Database) GetPrivateDevices(devices []string) (map[string]models.PrivateDevice, error) {
+	private := make(map[string]models.PrivateDevice)
+	err := self.Select(func(query_id string, db *Database) error {
+		for start := 0; start < len(devices); start += maxQueryVariables {
+			end := start + maxQueryVariables
+			if end > len(devices) {
+				end = len(devices)
+			}
+			args := make([]interface{}, end-start)
+			for i, device := range devices[start:end] {
+				args[i] = device
+			}
+			err := db.runQuery(`SELECT id, IFNULL(oui, ''), randomized, last_seen FROM private_devices WHERE id IN (?`+strings.Repeat(",?", len(args)-1)+`)`,
+				func(rows *sql.Rows) error {
+					var d models.PrivateDevice
+					var lastSeen int64
+					if err := rows.Scan(&d.ID, &d.OUI, &d.Randomized, &lastSeen); nil != err {
+						return err
+					}
+					d.LastSeen = fromMilliseconds(lastSeen)
+					private[d.ID] = d
+					return nil
+				}, args...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return private, err
+}
+
+// ExpirePrivateDevices deletes the fingerprints and predictions of the
+// hashed devices from before a time, and the hashed devices that were
+// not seen since and have no fingerprints left. It returns the number of
+// deleted fingerprints.
+func (self *Database) ExpirePrivateDevices(before time.Time) (deleted int64, err error) {
+	ms := before.UnixNano() / int64(time.Millisecond)
+	self.insertSync(func(query_id string) {
+		self.logger.Tracef("%v expiring private devices", query_id)
+		var tx *sql.Tx
+		tx, err = self.db.Begin()
+		if err != nil {
+			return
+		}
+		err = func() (err error) {
+			_, err = tx.Exec(`DELETE FROM location_predictions WHERE timestamp IN (
+				SELECT timestamp FROM sensors WHERE timestamp < ? AND deviceid IN (SELECT id FROM private_devices))`, ms)
+			if err != nil {
+				return
+			}
+			result, err := tx.Exec(`DELETE FROM sensors WHERE timestamp < ? AND deviceid IN (SELECT id FROM private_devices)`, ms)
+			if err != nil {
+				return
+			}
+			deleted, _ = result.RowsAffected()
+			// the fingerprints of a window are saved after the scans, so
+			// the devices are kept until their fingerprints are deleted
+			expired := `SELECT id FROM private_devices WHERE last_seen < ? AND id NOT IN (SELECT deviceid FROM sensors)`
+			_, err = tx.Exec(`DELETE FROM pseudo_devices WHERE deviceid IN (`+expired+`)`, ms)
+			if err != nil {
+				return
+			}
+			_, err = tx.Exec(`DELETE FROM private_devices WHERE id IN (`+expired+`)`, ms)
+			return
+		}()
+		if err != nil {
+			tx.Rollback()
+			err = errors.Wrap(err, "could not expire private devices")
+			return
+		}
+		err = tx.Commit()
+	})
+	return
+}
+
+// OldestPrivate returns the time of the oldest fingerprint of the hashed
+// devices, or of the hashed device that was seen the longest ago, which
+// is zero if there are no hashed devices
+func (self *Database) OldestPrivate() (oldest time.Time, err error) {
+	var ms sql.NullInt64
+	err = self.Select(func(query_id string, db *Database) error {
+		return db.queryRow(`SELECT MIN(t) FROM (
+			SELECT MIN(timestamp) AS t FROM sensors WHERE deviceid IN (SELECT id FROM private_devices)
+			UNION ALL SELECT MIN(last_seen) AS t FROM private_devices)`, func(row *sql.Row) error {
+			return row.Scan(&ms)
+		})
+	})
+	if err != nil {
+		err = errors.Wrap(err, "could not get oldest private device")
+		return
+	}
+	if ms.Valid {
+		oldest = time.Unix(0, ms.Int64*int64(time.Millisecond))
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// GetSensorsSince returns the sensor data since a timestamp, in
+// milliseconds, ordered by time
+func (self *Database) GetSensorsSince(since int64) (sensors []models.SensorData, err error) {
+	err = self.Select(func(query_id string, db *Database) error {
+		sensors, err = db.GetAllFromQuery("SELECT "+SENSOR_SQL+" FROM sensors WHERE timestamp >= ? ORDER BY timestamp", since)
+		return err
+	})
+	return
+}
+
+// maxQueryVariables keeps the queries under the limit of sqlite
+const maxQueryVariables = 500
+
+// GetPseudoDevices returns the pseudo devices that the randomized MACs
+// were assigned to, by MAC
+func (self *Database) GetPseudoDevices(devices []string) (map[string]string, error) {
+	pseudoDevices := make(map[string]string)
+	err := self.Select(func(query_id string, db *Database) error {
+		for start := 0; start < len(devices); start += maxQueryVariables {
+			end := start + maxQueryVariables
+			if end > len(devices) {
+				end = len(devices)
+			}
+			args := make([]interface{}, end-start)
+			for i, device := range devices[start:end] {
+				args[i] = device
+			}
+			err := db.runQuery(`SELECT deviceid, pseudo_id FROM pseudo_devices WHERE deviceid IN (?`+strings.Repeat(",?", len(args)-1)+`)`,
+				func(rows *sql.Rows) error {
+					var device, pseudoID string
+					if err := rows.Scan(&device, &pseudoID); nil != err {
+						return err
+					}
+					pseudoDevices[device] = pseudoID
+					return nil
+				}, args...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return pseudoDevices, err
+}
+
+// SetPseudoDevices assigns randomized MACs to pseudo devices
+func (self *Database) SetPseudoDevices(pseudoDevices map[string]string) (err error) {
+	if len(pseudoDevices) == 0 {
+		return
+	}
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "INSERT OR REPLACE INTO pseudo_devices(deviceid, pseudo_id) VALUES (?, ?)", func(stmt *sql.Stmt) error {
+			for device, pseudoID := range pseudoDevices {
+				if _, err := stmt.Exec(device, pseudoID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// DeleteOldPseudoDevices deletes the pseudo devices of the randomized MACs
+// that have no fingerprints since a timestamp, in milliseconds
+func (self *Database) DeleteOldPseudoDevices(since int64) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "DELETE FROM pseudo_devices WHERE deviceid NOT IN (SELECT deviceid FROM sensors WHERE timestamp >= ?)", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(since)
+			return err
+		})
+	})
+	return
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// GetRSSICalibrations returns the RSSI calibrations, by device
+func (self *Database) GetRSSICalibrations() (map[string]models.RSSICalibration, error) {
+	calibrations := make(map[string]models.RSSICalibration)
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.runQuery(`SELECT id, rssi_offset, rssi_scale, IFNULL(source, ''), samples, update_at FROM rssi_calibrations`,
+			func(rows *sql.Rows) error {
+				var c models.RSSICalibration
+				err := rows.Scan(&c.Device, &c.Offset, &c.Scale, &c.Source, &c.Samples, &c.UpdateAt)
+				if nil != err {
+					return err
+				}
+				calibrations[c.Device] = c
+				return nil
+			})
+	})
+	return calibrations, err
+}
+
+// SetRSSICalibrations sets the RSSI calibrations of devices, replacing
+// the ones they had
+func (self *Database) SetRSSICalibrations(calibrations ...models.RSSICalibration) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "INSERT OR REPLACE INTO rssi_calibrations(id, rssi_offset, rssi_scale, source, samples) VALUES (?, ?, ?, ?, ?)", func(stmt *sql.Stmt) error {
+			for _, c := range calibrations {
+				_, err := stmt.Exec(c.Device, c.Offset, c.Scale, c.Source, c.Samples)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// DeleteRSSICalibration removes the RSSI calibration of a device
+func (self *Database) DeleteRSSICalibration(device string) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "DELETE FROM rssi_calibrations WHERE id = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(device)
+			return err
+		})
+	})
+	return
+}
+
+// GetReferenceBeacons returns the reference beacons
+func (self *Database) GetReferenceBeacons() ([]models.ReferenceBeacon, error) {
+	beacons := []models.ReferenceBeacon{}
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.runQuery(`SELECT id, IFNULL(location, ''), rssi, create_at FROM reference_beacons ORDER BY id`,
+			func(rows *sql.Rows) error {
+				var b models.ReferenceBeacon
+				err := rows.Scan(&b.Device, &b.Location, &b.RSSI, &b.CreateAt)
+				if nil != err {
+					return err
+				}
+				beacons = append(beacons, b)
+				return nil
+			})
+	})
+	return beacons, err
+}
+
+// SetReferenceBeacon adds a reference beacon, or changes its location and RSSI
+func (self *Database) SetReferenceBeacon(b models.ReferenceBeacon) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "INSERT OR IGNORE INTO reference_beacons(id) VALUES (?)", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(b.Device)
+			return err
+		})
+		if err != nil {
+			return
+		}
+		err = self.insert(query_id, "UPDATE reference_beacons SET location = ?, rssi = ? WHERE id = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(b.Location, b.RSSI, b.Device)
+			return err
+		})
+	})
+	return
+}
+
+// DeleteReferenceBeacon removes a reference beacon
+func (self *Database) DeleteReferenceBeacon(device string) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "DELETE FROM reference_beacons WHERE id = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(device)
+			return err
+		})
+	})
+	return
+}
+
+// GetSensorsOfDevice returns the sensor data of a device since a timestamp,
+// in milliseconds
+func (self *Database) GetSensorsOfDevice(device string, since int64) (sensors []models.SensorData, err error) {
+	err = self.Select(func(query_id string, db *Database) error {
+		sensors, err = db.GetAllFromQuery("SELECT "+SENSOR_SQL+" FROM sensors WHERE deviceid = ? AND timestamp >= ? ORDER BY timestamp", device, since)
+		return err
+	})
+	return
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// SCANNER_COLUMNS are the columns scanned by scanScanner
+const SCANNER_COLUMNS = `
+	id,
+	IFNULL(name, ''),
+	IFNULL(location, ''),
+	IFNULL(version, ''),
+	last_seen,
+	check_ins,
+	window_start,
+	window_fingerprints,
+	last_window_fingerprints,
+	silent,
+	create_at`
+
+func scanScanner(scanner interface {
+	Scan(dest ...interface{}) error
+}) (s models.Scanner, err error) {
+	var lastSeen, windowStart int64
+	err = scanner.Scan(
+		&s.ID,
+		&s.Name,
+		&s.Location,
+		&s.Version,
+		&lastSeen,
+		&s.CheckIns,
+		&windowStart,
+		&s.WindowFingerprints,
+		&s.LastWindowFingerprints,
+		&s.Silent,
+		&s.CreateAt)
+	s.LastSeen = fromMilliseconds(lastSeen)
+	s.WindowStart = fromMilliseconds(windowStart)
+	return
+}
+
+func fromMilliseconds(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// CheckInScanner records that a scanner sent passive data with a number of
+// fingerprints. The fingerprints are counted in windows of the given length,
+// and the scanner is added to the registry if it is new.
+func (self *Database) CheckInScanner(id string, version string, fingerprints int, at time.Time, window time.Duration) {
+	now := at.UnixNano() / int64(time.Millisecond)
+	windowLength := int64(window / time.Millisecond)
+	self.insertAsync(func(query_id string) {
+		err := self.insert(query_id, "INSERT OR IGNORE INTO scanners(id) VALUES (?)", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(id)
+			return err
+		})
+		if err != nil {
+			self.logger.Error(errors.Wrap(err, "could not add scanner"))
+			return
+		}
+		// a new window starts when the current one is over, and the window
+		// before it is empty if the scanner missed a whole window
+		err = self.insert(query_id, `
+			UPDATE scanners SET
+				version = CASE WHEN ?2 != '' THEN ?2 ELSE version END,
+				last_seen = ?3,
+				check_ins = check_ins + 1,
+				last_window_fingerprints = CASE
+					WHEN ?3 < window_start + ?4 THEN last_window_fingerprints
+					WHEN ?3 < window_start + 2 * ?4 THEN window_fingerprints
+					ELSE 0 END,
+				window_fingerprints = CASE WHEN ?3 < window_start + ?4 THEN window_fingerprints + ?5 ELSE ?5 END,
+				window_start = CASE WHEN ?3 < window_start + ?4 THEN window_start ELSE ?3 END
+			WHERE id = ?1`, func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(id, version, now, windowLength, fingerprints)
+			return err
+		})
+		if err != nil {
+			self.logger.Error(errors.Wrap(err, "could not check in scanner"))
+		}
+	})
+}
+
+// GetScanners returns the scanners in the registry
+func (self *Database) GetScanners() ([]models.Scanner, error) {
+	scanners := []models.Scanner{}
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.runQuery(`SELECT `+SCANNER_COLUMNS+` FROM scanners ORDER BY id`,
+			func(rows *sql.Rows) error {
+				s, err := scanScanner(rows)
+				if nil != err {
+					return err
+				}
+				scanners = append(scanners, s)
+				return nil
+			})
+	})
+	return scanners, err
+}
+
+// GetScanner returns a scanner in the registry
+func (self *Database) GetScanner(id string) (models.Scanner, error) {
+	var s models.Scanner
+	err := self.Select(func(query_id string, db *Database) error {
+		return db.queryRow(`SELECT `+SCANNER_COLUMNS+` FROM scanners WHERE id = ?`, func(row *sql.Row) (err error) {
+			s, err = scanScanner(row)
+			return err
+		}, id)
+	})
+	if err == sql.ErrNoRows {
+		err = errors.New(fmt.Sprintf("scanner '%s' is not registered", id))
+	}
+	return s, err
+}
+
+// SetScanner sets the name and location of a scanner, adding it to the
+// registry if needed
+func (self *Database) SetScanner(s models.Scanner) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "INSERT OR IGNORE INTO scanners(id) VALUES (?)", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(s.ID)
+			return err
+		})
+		if err != nil {
+			return
+		}
+		err = self.insert(query_id, "UPDATE scanners SET name = ?, location = ? WHERE id = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(s.Name, s.Location, s.ID)
+			return err
+		})
+	})
+	return
+}
+
+// SetScannerSilent sets whether a scanner has gone silent
+func (self *Database) SetScannerSilent(id string, silent bool) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "UPDATE scanners SET silent = ? WHERE id = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(silent, id)
+			return err
+		})
+	})
+	return
+}
+
+// DeleteScanner removes a scanner from the registry, until it checks in again
+func (self *Database) DeleteScanner(id string) (err error) {
+	self.insertSync(func(query_id string) {
+		err = self.insert(query_id, "DELETE FROM scanners WHERE id = ?", func(stmt *sql.Stmt) error {
+			_, err := stmt.Exec(id)
+			return err
+		})
+	})
+	return
+}
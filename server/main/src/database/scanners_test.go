@@ -0,0 +1,71 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanners(t *testing.T) {
+	folder, err := ioutil.TempDir("", "scanners")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	DataFolder = folder
+	defer func() { DataFolder = DEFAULT_DATA_FOLDER }()
+
+	db, err := Open("scanners")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	start := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	window := 90 * time.Second
+	db.CheckInScanner("pi1", "v1.0", 10, start, window)
+	db.CheckInScanner("pi1", "", 5, start.Add(30*time.Second), window)
+	db.Sync()
+	s, err := db.GetScanner("pi1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.0", s.Version)
+	assert.Equal(t, int64(2), s.CheckIns)
+	assert.Equal(t, start, s.WindowStart)
+	assert.Equal(t, int64(15), s.WindowFingerprints)
+	assert.Equal(t, int64(0), s.LastWindowFingerprints)
+	assert.Equal(t, start.Add(30*time.Second), s.LastSeen)
+
+	// the next window keeps the count of the previous one
+	db.CheckInScanner("pi1", "v1.1", 3, start.Add(100*time.Second), window)
+	db.Sync()
+	s, err = db.GetScanner("pi1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.1", s.Version)
+	assert.Equal(t, int64(3), s.WindowFingerprints)
+	assert.Equal(t, int64(15), s.LastWindowFingerprints)
+
+	// after a missed window the previous one is empty
+	db.CheckInScanner("pi1", "", 4, start.Add(400*time.Second), window)
+	db.Sync()
+	s, err = db.GetScanner("pi1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), s.WindowFingerprints)
+	assert.Equal(t, int64(0), s.LastWindowFingerprints)
+
+	assert.Nil(t, db.SetScanner(models.Scanner{ID: "pi1", Name: "Hallway", Location: "hallway"}))
+	assert.Nil(t, db.SetScannerSilent("pi1", true))
+	assert.Nil(t, db.SetScanner(models.Scanner{ID: "pi2", Location: "kitchen"}))
+	scanners, err := db.GetScanners()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scanners))
+	assert.Equal(t, "Hallway", scanners[0].Name)
+	assert.Equal(t, "hallway", scanners[0].Location)
+	assert.Equal(t, int64(4), scanners[0].CheckIns)
+	assert.True(t, scanners[0].Silent)
+	assert.Equal(t, "kitchen", scanners[1].Location)
+	assert.True(t, scanners[1].LastSeen.IsZero())
+
+	assert.Nil(t, db.DeleteScanner("pi2"))
+	_, err = db.GetScanner("pi2")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreModelSnapshot(t *testing.T) {
+	defer useTempFolder(t)()
+	db, err := Open("snapshots")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Nil(t, db.Set("NB1", map[string]int{"kitchen": 1}))
+	assert.Nil(t, db.SetRSSICalibrations(models.RSSICalibration{Device: "pi1", Offset: 3, Scale: 1, Source: models.RSSIManual}))
+	db.Sync()
+	snapshot, err := db.AddModelSnapshot(1, 0.5, true, "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Set("NB1", map[string]int{"kitchen": 2}))
+	assert.Nil(t, db.SetRSSICalibrations(
+		models.RSSICalibration{Device: "pi1", Offset: 5, Scale: 1, Source: models.RSSIManual},
+		models.RSSICalibration{Device: "pi2", Offset: 1, Scale: 1, Source: models.RSSIManual},
+	))
+	db.Sync()
+
+	// the models come back with the RSSI calibrations they were fitted on
+	assert.Nil(t, db.RestoreModelSnapshot(snapshot.ID))
+	var nb1 map[string]int
+	assert.Nil(t, db.Get("NB1", &nb1))
+	assert.Equal(t, 1, nb1["kitchen"])
+	calibrations, err := db.GetRSSICalibrations()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(calibrations))
+	assert.Equal(t, float64(3), calibrations["pi1"].Offset)
+}
@@ -88,12 +88,118 @@ var TABLES_SQL = `
         accuracy_breakdown TEXT,
         prediction_analysis TEXT,
         algorithm_efficacy TEXT,
+        cross_validation TEXT,
         calibration_time DATETIME DEFAULT CURRENT_TIMESTAMP,
         create_at DATETIME DEFAULT CURRENT_TIMESTAMP,
         update_at DATETIME DEFAULT CURRENT_TIMESTAMP
     );
 
 
+    CREATE TABLE IF NOT EXISTS model_snapshots (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        calibration_id INTEGER,
+        percent_correct REAL,
+        promoted INTEGER DEFAULT 0,
+        reason TEXT,
+        nb1 TEXT,
+        nb2 TEXT,
+        rssi_calibrations TEXT,
+        create_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+
+    CREATE TABLE IF NOT EXISTS audit_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        action TEXT,
+        deviceid TEXT,
+        locationid TEXT,
+        new_locationid TEXT,
+        from_time INTEGER,
+        to_time INTEGER,
+        affected INTEGER,
+        source TEXT,
+        create_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+
+    CREATE TABLE IF NOT EXISTS locations (
+        name TEXT NOT NULL PRIMARY KEY,
+        display_name TEXT,
+        aliases TEXT,
+        floor TEXT,
+        building TEXT,
+        x REAL,
+        y REAL,
+        lat REAL,
+        lon REAL,
+        polygon TEXT,
+        tags TEXT,
+        create_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        update_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+
+    CREATE TABLE IF NOT EXISTS devices (
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT,
+        owner TEXT,
+        type TEXT,
+        device_group TEXT,
+        ignored INTEGER DEFAULT 0,
+        create_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        update_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+
+    CREATE TABLE IF NOT EXISTS scanners (
+        id TEXT NOT NULL PRIMARY KEY,
+        name TEXT,
+        location TEXT,
+        version TEXT,
+        last_seen INTEGER DEFAULT 0,
+        check_ins INTEGER DEFAULT 0,
+        window_start INTEGER DEFAULT 0,
+        window_fingerprints INTEGER DEFAULT 0,
+        last_window_fingerprints INTEGER DEFAULT 0,
+        silent INTEGER DEFAULT 0,
+        create_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+
+    CREATE TABLE IF NOT EXISTS rssi_calibrations (
+        id TEXT NOT NULL PRIMARY KEY,
+        rssi_offset REAL DEFAULT 0,
+        rssi_scale REAL DEFAULT 1,
+        source TEXT,
+        samples INTEGER DEFAULT 0,
+        update_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+
+    CREATE TABLE IF NOT EXISTS reference_beacons (
+        id TEXT NOT NULL PRIMARY KEY,
+        location TEXT,
+        rssi REAL,
+        create_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+
+    CREATE TABLE IF NOT EXISTS pseudo_devices (
+        deviceid TEXT NOT NULL PRIMARY KEY,
+        pseudo_id TEXT,
+        create_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS pseudo_devices_pseudo_id ON pseudo_devices (pseudo_id);
+
+
+    CREATE TABLE IF NOT EXISTS private_devices (
+        id TEXT NOT NULL PRIMARY KEY,
+        oui TEXT,
+        randomized INTEGER DEFAULT 0,
+        last_seen INTEGER DEFAULT 0
+    );
+
+
     CREATE TABLE IF NOT EXISTS users (
         username TEXT,
         password TEXT,
@@ -103,6 +209,14 @@ var TABLES_SQL = `
 
 `
 
+// MIGRATIONS_SQL are run on existing databases to add columns
+// that were introduced after their tables were created.
+// New tables are added by running TABLES_SQL again.
+var MIGRATIONS_SQL = []string{
+	`ALTER TABLE calibrations ADD COLUMN cross_validation TEXT`,
+	`ALTER TABLE model_snapshots ADD COLUMN rssi_calibrations TEXT`,
+}
+
 // CREATE TABLE IF NOT EXISTS learning (
 //     id INTEGER PRIMARY KEY AUTOINCREMENT,
 //     algorithm TEXT,
@@ -48,6 +48,13 @@ var CALIBRATION_SQL = `
 		'"accuracy_breakdown": ' || accuracy_breakdown ||','||
 		'"prediction_analysis": ' || prediction_analysis ||','||
 		'"algorithm_efficacy": ' || algorithm_efficacy ||','||
+		'"cross_validation": ' ||
+			CASE
+			    WHEN cross_validation IS NULL THEN 'null'
+			    WHEN ''=cross_validation THEN 'null'
+			    ELSE cross_validation
+			END
+		||','||
 		'"calibration_time": "' || strftime('%Y-%m-%dT%H:%M:%SZ', calibration_time) ||'",'||
 		'"create_at": "' || strftime('%Y-%m-%dT%H:%M:%SZ', create_at) ||'",'||
 		'"update_at": "' || strftime('%Y-%m-%dT%H:%M:%SZ', update_at) ||'"'
@@ -62,6 +69,7 @@ type CalibrationModel struct {
 	AccuracyBreakdown        map[string]float64                       `json:"accuracy_breakdown"`
 	PredictionAnalysis       map[string]map[string]map[string]int     `json:"prediction_analysis"`
 	AlgorithmEfficacy        map[string]map[string]models.BinaryStats `json:"algorithm_efficacy"`
+	CrossValidation          models.CrossValidation                   `json:"cross_validation"`
 	CalibrationTime          time.Time                                `json:"calibration_time"`
 	CreateAt                 time.Time                                `json:"create_at"`
 	UpdateAt                 time.Time                                `json:"update_at"`
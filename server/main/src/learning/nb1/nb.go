@@ -23,8 +23,20 @@ func New() *Algorithm {
 	return n
 }
 
-// Fit will take the data and learn it
+// Fit will take the data, learn it and save it for classifying
 func (a *Algorithm) Fit(db *database.Database, datas []models.SensorData) (err error) {
+	err = a.Learn(datas)
+	if err != nil {
+		return
+	}
+	err = db.Set("NB1", a.Data)
+	// err = db.SetLearning("NB1", a.Data)
+	return
+}
+
+// Learn will take the data and learn it without saving it, so only this
+// algorithm classifies with it
+func (a *Algorithm) Learn(datas []models.SensorData) (err error) {
 	if len(datas) == 0 {
 		err = errors.New("no data")
 		return
@@ -49,8 +61,7 @@ func (a *Algorithm) Fit(db *database.Database, datas []models.SensorData) (err e
 		}
 	}
 
-	err = db.Set("NB1", a.Data)
-	// err = db.SetLearning("NB1", a.Data)
+	a.isLoaded = true
 	return
 }
 
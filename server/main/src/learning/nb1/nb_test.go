@@ -1,34 +1,50 @@
 package nb1
 
 import (
-	"fmt"
-	"path/filepath"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestBasic(t *testing.T) {
-	database.DataFolder, _ = filepath.Abs("../../../data")
-
-	d, err := database.Open("schollz")
+	folder, err := ioutil.TempDir("", "nb1")
 	assert.Nil(t, err)
-	datas, err := d.GetAllForClassification()
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	d, err := database.Open("nb1")
 	assert.Nil(t, err)
-	d.Close()
+	defer d.Close()
+
+	var datas []models.SensorData
+	for i := 0; i < 10; i++ {
+		// the readings are decoded from JSON
+		noise := float64(i % 3)
+		datas = append(datas,
+			models.SensorData{Location: "kitchen", Sensors: map[string]map[string]interface{}{
+				"wifi": {"aa:bb:cc:dd:ee:01": -40 - noise, "aa:bb:cc:dd:ee:02": -80 - noise},
+			}},
+			models.SensorData{Location: "bedroom", Sensors: map[string]map[string]interface{}{
+				"wifi": {"aa:bb:cc:dd:ee:01": -80 - noise, "aa:bb:cc:dd:ee:02": -40 - noise},
+			}},
+		)
+	}
 
 	nb1 := New()
-	err = nb1.Fit(datas[1:])
+	err = nb1.Fit(d, datas[2:])
 	assert.Nil(t, err)
+	d.Sync()
 
-	pl, err := nb1.Classify(datas[0])
+	pl, err := nb1.Classify(d, datas[0])
 	assert.Nil(t, err)
-	fmt.Println(datas[0].Location)
-	fmt.Println(pl)
+	assert.Equal(t, "kitchen", pl[0].Key)
 
-	pl, err = nb1.Classify(datas[1])
+	pl, err = nb1.Classify(d, datas[1])
 	assert.Nil(t, err)
-	fmt.Println(datas[1].Location)
-	fmt.Println(pl)
+	assert.Equal(t, "bedroom", pl[0].Key)
 }
@@ -23,8 +23,20 @@ func New() *Algorithm {
 	return n
 }
 
-// Fit will take the data and learn it
+// Fit will take the data, learn it and save it for classifying
 func (a *Algorithm) Fit(db *database.Database, datas []models.SensorData) (err error) {
+	err = a.Learn(datas)
+	if err != nil {
+		return
+	}
+	err = db.Set("NB2", a.Data)
+	// err = db.SetLearning("NB2", a.Data)
+	return
+}
+
+// Learn will take the data and learn it without saving it, so only this
+// algorithm classifies with it
+func (a *Algorithm) Learn(datas []models.SensorData) (err error) {
 	if len(datas) == 0 {
 		err = errors.New("no data")
 		return
@@ -54,8 +66,7 @@ func (a *Algorithm) Fit(db *database.Database, datas []models.SensorData) (err e
 		}
 	}
 
-	err = db.Set("NB2", a.Data)
-	// err = db.SetLearning("NB2", a.Data)
+	a.isLoaded = true
 	return
 }
 
@@ -0,0 +1,259 @@
+// Package logging writes structured logs as JSON lines. Loggers carry
+// fields, such as the family and the request id, so that a fingerprint
+// can be followed from the request to the database and the AI server.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Levels, from the most to the least verbose
+const (
+	TraceLevel = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	CriticalLevel
+)
+
+var levelNames = []string{"trace", "debug", "info", "warn", "error", "critical"}
+
+var (
+	// Output is where the logs are written
+	Output io.Writer = os.Stdout
+
+	level         = DebugLevel
+	familyLevels  = make(map[string]int)
+	lock          sync.RWMutex
+	outputLock    sync.Mutex
+	requestPrefix = fmt.Sprintf("%x", time.Now().UnixNano()&0xffffff)
+	requestCount  int64
+)
+
+// ParseLevel returns the level of a name, such as "debug"
+func ParseLevel(name string) (int, error) {
+	name = strings.TrimSpace(strings.ToLower(name))
+	if name == "warning" {
+		name = "warn"
+	}
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return i, nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level '%s'", name)
+}
+
+// SetLevel sets the level of the logs
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	level = l
+	return nil
+}
+
+// GetLevel returns the name of the level of the logs
+func GetLevel() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	return levelNames[level]
+}
+
+// SetFamilyLevel sets the level of the logs of a family,
+// an empty level removes it so the family uses the level of the logs
+func SetFamilyLevel(family string, name string) error {
+	if strings.TrimSpace(name) == "" {
+		lock.Lock()
+		defer lock.Unlock()
+		delete(familyLevels, family)
+		return nil
+	}
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	familyLevels[family] = l
+	return nil
+}
+
+// GetFamilyLevels returns the names of the levels set for families
+func GetFamilyLevels() map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+	levels := make(map[string]string)
+	for family, l := range familyLevels {
+		levels[family] = levelNames[l]
+	}
+	return levels
+}
+
+// NewRequestID returns an id that is unique to this process
+func NewRequestID() string {
+	return fmt.Sprintf("%s-%d", requestPrefix, atomic.AddInt64(&requestCount, 1))
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes logs with its fields. Loggers are not changed by
+// adding fields, a new logger is returned instead.
+type Logger struct {
+	fields []field
+	family string
+}
+
+// New returns a logger for a component of the server, such as "api"
+func New(component string) *Logger {
+	return &Logger{fields: []field{{"component", component}}}
+}
+
+// With returns a logger that adds a field to its logs
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{fields: append(fields, field{key, value}), family: l.family}
+}
+
+// WithFamily returns a logger for a family, which uses the level of the family
+func (l *Logger) WithFamily(family string) *Logger {
+	if family == "" {
+		return l
+	}
+	logger := l.With("family", family)
+	logger.family = family
+	return logger
+}
+
+// WithRequest returns a logger that adds the request id to its logs
+func (l *Logger) WithRequest(requestID string) *Logger {
+	if requestID == "" {
+		return l
+	}
+	return l.With("request_id", requestID)
+}
+
+func (l *Logger) enabled(msgLevel int) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	if familyLevel, ok := familyLevels[l.family]; ok && l.family != "" {
+		return msgLevel >= familyLevel
+	}
+	return msgLevel >= level
+}
+
+func (l *Logger) log(msgLevel int, msg string) {
+	if !l.enabled(msgLevel) {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, levelNames[msgLevel])
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+	for _, f := range l.fields {
+		buf.WriteString(",")
+		writeJSON(&buf, f.key)
+		buf.WriteString(":")
+		writeJSON(&buf, f.value)
+	}
+	buf.WriteString("}\n")
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	Output.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// Trace logs at the trace level
+func (l *Logger) Trace(v ...interface{}) {
+	l.log(TraceLevel, fmt.Sprint(v...))
+}
+
+// Tracef logs a formatted message at the trace level
+func (l *Logger) Tracef(format string, v ...interface{}) {
+	l.log(TraceLevel, fmt.Sprintf(format, v...))
+}
+
+// Debug logs at the debug level
+func (l *Logger) Debug(v ...interface{}) {
+	l.log(DebugLevel, fmt.Sprint(v...))
+}
+
+// Debugf logs a formatted message at the debug level
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.log(DebugLevel, fmt.Sprintf(format, v...))
+}
+
+// Info logs at the info level
+func (l *Logger) Info(v ...interface{}) {
+	l.log(InfoLevel, fmt.Sprint(v...))
+}
+
+// Infof logs a formatted message at the info level
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.log(InfoLevel, fmt.Sprintf(format, v...))
+}
+
+// Warn logs at the warn level
+func (l *Logger) Warn(v ...interface{}) {
+	l.log(WarnLevel, fmt.Sprint(v...))
+}
+
+// Warnf logs a formatted message at the warn level
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.log(WarnLevel, fmt.Sprintf(format, v...))
+}
+
+// Error logs at the error level
+func (l *Logger) Error(v ...interface{}) {
+	l.log(ErrorLevel, fmt.Sprint(v...))
+}
+
+// Errorf logs a formatted message at the error level
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.log(ErrorLevel, fmt.Sprintf(format, v...))
+}
+
+// Critical logs at the critical level
+func (l *Logger) Critical(v ...interface{}) {
+	l.log(CriticalLevel, fmt.Sprint(v...))
+}
+
+// Criticalf logs a formatted message at the critical level
+func (l *Logger) Criticalf(format string, v ...interface{}) {
+	l.log(CriticalLevel, fmt.Sprintf(format, v...))
+}
+
+// Flush is kept for compatibility, logs are written as they are logged
+func (l *Logger) Flush() {}
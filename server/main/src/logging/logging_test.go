@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	Output = &buf
+	defer func() {
+		Output = os.Stdout
+		SetLevel("debug")
+	}()
+	assert.Nil(t, SetLevel("info"))
+
+	logger := New("test")
+	logger.Debug("hidden")
+	logger.WithFamily("testdb").WithRequest("abc-1").Infof("saved %d", 3)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "saved 3", entry["msg"])
+	assert.Equal(t, "test", entry["component"])
+	assert.Equal(t, "testdb", entry["family"])
+	assert.Equal(t, "abc-1", entry["request_id"])
+
+	buf.Reset()
+	assert.Nil(t, SetFamilyLevel("testdb", "trace"))
+	assert.Equal(t, map[string]string{"testdb": "trace"}, GetFamilyLevels())
+	logger.WithFamily("testdb").Trace("shown")
+	logger.WithFamily("other").Debug("hidden")
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+	assert.Nil(t, SetFamilyLevel("testdb", ""))
+	assert.Empty(t, GetFamilyLevels())
+	assert.NotNil(t, SetLevel("loud"))
+	assert.Equal(t, "info", GetLevel())
+	assert.NotEqual(t, NewRequestID(), NewRequestID())
+}
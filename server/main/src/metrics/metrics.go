@@ -0,0 +1,249 @@
+// Package metrics keeps the counters, gauges and histograms of the server
+// and writes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets for latencies, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	registry   = make(map[string]*metric)
+	collectors []func()
+	lock       sync.Mutex
+)
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+	sync.Mutex
+}
+
+type series struct {
+	values []string
+	value  float64
+	// counts are the observations in each bucket, and above the last bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func register(name, help, kind string, buckets []float64, labels []string) *metric {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metric " + name + " is already registered")
+	}
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	registry[name] = m
+	return m
+}
+
+// get returns the series of the label values. It must be called with the metric locked.
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	m *metric
+}
+
+// NewCounter registers a counter with the given labels
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(name, help, "counter", nil, labels)}
+}
+
+// Inc adds one to the counter of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter of the label values
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.m.get(values).value += v
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	m *metric
+}
+
+// NewGauge registers a gauge with the given labels
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the gauge of the label values
+func (g *Gauge) Set(v float64, values ...string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.m.get(values).value = v
+}
+
+// Reset removes the values of all labels, such as families that were closed
+func (g *Gauge) Reset() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.m.series = make(map[string]*series)
+}
+
+// Histogram counts observations, such as latencies, in buckets
+type Histogram struct {
+	m *metric
+}
+
+// NewHistogram registers a histogram with the given upper bounds of its buckets
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{register(name, help, "histogram", buckets, labels)}
+}
+
+// Observe adds an observation to the histogram of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	s := h.m.get(values)
+	i := sort.SearchFloat64s(h.m.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// OnCollect adds a function that is called before the metrics are written,
+// to set the gauges that are read from elsewhere
+func OnCollect(collect func()) {
+	lock.Lock()
+	defer lock.Unlock()
+	collectors = append(collectors, collect)
+}
+
+// Write writes all of the metrics in the Prometheus text format
+func Write(w io.Writer) error {
+	lock.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	collect := append([]func(){}, collectors...)
+	lock.Unlock()
+	sort.Strings(names)
+
+	for _, f := range collect {
+		f()
+	}
+
+	buf := bufio.NewWriter(w)
+	for _, name := range names {
+		lock.Lock()
+		m := registry[name]
+		lock.Unlock()
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.formatLabels(s.values, "", 0), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.values, "le", bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.values, "le", math.Inf(1)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.formatLabels(s.values, "", 0), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.formatLabels(s.values, "", 0), s.count)
+	}
+}
+
+// formatLabels formats the label values, with the extra label if it is given
+func (m *metric) formatLabels(values []string, extra string, extraValue float64) string {
+	pairs := []string{}
+	for i, label := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeLabel(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra, formatFloat(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
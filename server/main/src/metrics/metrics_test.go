@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	requests := NewCounter("test_requests_total", "Requests.", "route")
+	requests.Inc("/a")
+	requests.Add(2, "/a")
+	requests.Inc(`/b"c`)
+	pending := NewGauge("test_pending", "Pending\nrequests.")
+	pending.Set(4)
+	latency := NewHistogram("test_latency_seconds", "Latency.", []float64{1, 0.1}, "family")
+	latency.Observe(0.1, "f")
+	latency.Observe(0.5, "f")
+	latency.Observe(3, "f")
+	OnCollect(func() { pending.Set(5) })
+
+	var buf bytes.Buffer
+	assert.Nil(t, Write(&buf))
+	assert.Equal(t, `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{family="f",le="0.1"} 1
+test_latency_seconds_bucket{family="f",le="1"} 2
+test_latency_seconds_bucket{family="f",le="+Inf"} 3
+test_latency_seconds_sum{family="f"} 3.6
+test_latency_seconds_count{family="f"} 3
+# HELP test_pending Pending\nrequests.
+# TYPE test_pending gauge
+test_pending 5
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a"} 3
+test_requests_total{route="/b\"c"} 1
+`, buf.String())
+
+	pending.Reset()
+	assert.Panics(t, func() { requests.Inc() })
+	assert.Panics(t, func() { NewGauge("test_pending", "Again.") })
+}
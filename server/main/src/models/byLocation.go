@@ -3,7 +3,11 @@ package models
 import "time"
 
 type ByLocationDevice struct {
-	Device      string    `json:"device"`
+	Device string `json:"device"`
+	// Name, Owner and Group are set for registered devices
+	Name        string    `json:"name,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Group       string    `json:"group,omitempty"`
 	Vendor      string    `json:"vendor,omitempty"`
 	Timestamp   time.Time `json:"timestamp"`
 	Probability float64   `json:"probability"`
@@ -11,10 +15,16 @@ type ByLocationDevice struct {
 	NumScanners int       `json:"num_scanners"`
 	ActiveMins  int       `json:"active_mins"`
 	FirstSeen   time.Time `json:"first_seen"`
+	// PseudoDevice is the device that the randomized MACs are clustered
+	// into, and Macs are its MACs that were seen
+	PseudoDevice string   `json:"pseudo_device,omitempty"`
+	Macs         []string `json:"macs,omitempty"`
 }
 
 type ByLocation struct {
 	Devices  []ByLocationDevice `json:"devices"`
 	Location string             `json:"location"`
 	Total    int                `json:"total"`
+	// Metadata is included when the location is registered
+	Metadata *Location `json:"metadata,omitempty"`
 }
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// CalibrationSummary is the overview of a past calibration
+type CalibrationSummary struct {
+	ID              int       `json:"id"`
+	CalibrationTime time.Time `json:"calibration_time"`
+	PercentCorrect  float64   `json:"percent_correct"`
+	// PercentCorrectSD is the standard deviation of the percent
+	// correct over the folds of the cross validation
+	PercentCorrectSD float64 `json:"percent_correct_sd"`
+	Folds            int     `json:"folds"`
+	// AccuracyBreakdown is the percent correct for each location
+	AccuracyBreakdown map[string]float64 `json:"accuracy_breakdown"`
+	// AlgorithmInformedness is the informedness of each algorithm,
+	// averaged over all locations
+	AlgorithmInformedness map[string]float64 `json:"algorithm_informedness"`
+}
+
+// CalibrationChange is the change of a single metric between two calibrations
+type CalibrationChange struct {
+	Before float64 `json:"before"`
+	After  float64 `json:"after"`
+	Delta  float64 `json:"delta"`
+}
+
+// NewCalibrationChange returns the change going from before to after
+func NewCalibrationChange(before, after float64) CalibrationChange {
+	return CalibrationChange{Before: before, After: after, Delta: after - before}
+}
+
+// CalibrationDiff compares two calibrations of the same family
+type CalibrationDiff struct {
+	From                  CalibrationSummary           `json:"from"`
+	To                    CalibrationSummary           `json:"to"`
+	PercentCorrect        CalibrationChange            `json:"percent_correct"`
+	AccuracyBreakdown     map[string]CalibrationChange `json:"accuracy_breakdown"`
+	AlgorithmInformedness map[string]CalibrationChange `json:"algorithm_informedness"`
+	// locations only present in one of the calibrations
+	AddedLocations   []string `json:"added_locations"`
+	RemovedLocations []string `json:"removed_locations"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Calibration job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// CalibrationJob tracks a single calibration of a family
+type CalibrationJob struct {
+	ID         string    `json:"id"`
+	Family     string    `json:"family"`
+	State      string    `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	QueuedAt   time.Time `json:"queued_at"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	// Duration is the running time of the calibration in seconds
+	Duration float64 `json:"duration"`
+}
+
+// IsDone returns whether the job has finished, successfully or not
+func (j CalibrationJob) IsDone() bool {
+	return j.State == JobSucceeded || j.State == JobFailed
+}
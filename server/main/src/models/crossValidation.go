@@ -0,0 +1,41 @@
+package models
+
+// CrossValidation reports how much the calibration metrics
+// varied between the folds of the k-fold cross validation
+type CrossValidation struct {
+	Folds int `json:"folds"`
+	// PercentCorrect is the percent correct of each fold
+	PercentCorrect   []float64 `json:"percent_correct"`
+	PercentCorrectSD float64   `json:"percent_correct_sd"`
+	// AccuracyBreakdownSD is the standard deviation of the accuracy of each location
+	AccuracyBreakdownSD map[string]float64 `json:"accuracy_breakdown_sd"`
+	// InformednessSD is the standard deviation of the informedness
+	// of each algorithm, for each location
+	InformednessSD map[string]map[string]float64 `json:"informedness_sd"`
+}
+
+// AverageBinaryStats combines the stats of several folds. The counts
+// are summed and the derived metrics are averaged.
+func AverageBinaryStats(stats []BinaryStats) (b BinaryStats) {
+	if len(stats) == 0 {
+		return
+	}
+	for _, s := range stats {
+		b.TruePositives += s.TruePositives
+		b.FalsePositives += s.FalsePositives
+		b.TrueNegatives += s.TrueNegatives
+		b.FalseNegatives += s.FalseNegatives
+		b.Sensitivity += s.Sensitivity
+		b.Specificity += s.Specificity
+		b.Informedness += s.Informedness
+		b.MCC += s.MCC
+		b.FisherP += s.FisherP
+	}
+	n := float64(len(stats))
+	b.Sensitivity /= n
+	b.Specificity /= n
+	b.Informedness /= n
+	b.MCC /= n
+	b.FisherP /= n
+	return
+}
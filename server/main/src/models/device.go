@@ -0,0 +1,46 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Device is a device of a family, along with its metadata in the
+// device registry. The ID is the device used for the sensor data.
+type Device struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Type  string `json:"type,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Ignore hides the device from tracking
+	Ignore bool `json:"ignore"`
+	// Registered is whether the device is in the registry
+	Registered bool `json:"registered"`
+	// Vendor is determined from the mac address, if possible
+	Vendor   string    `json:"vendor,omitempty"`
+	CreateAt time.Time `json:"create_at"`
+	UpdateAt time.Time `json:"update_at"`
+}
+
+// Validate will validate the device and normalize its metadata
+func (d *Device) Validate() (err error) {
+	d.ID = strings.TrimSpace(strings.ToLower(d.ID))
+	d.Name = strings.TrimSpace(d.Name)
+	d.Owner = strings.TrimSpace(d.Owner)
+	d.Type = strings.TrimSpace(strings.ToLower(d.Type))
+	d.Group = strings.TrimSpace(strings.ToLower(d.Group))
+	if d.ID == "" {
+		err = errors.New("device cannot be empty")
+	}
+	return
+}
+
+// DisplayName is the name of the device, or its id when it has no name
+func (d Device) DisplayName() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return d.ID
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceValidate(t *testing.T) {
+	d := Device{ID: " WiFi-AA:BB ", Name: " Zack's phone ", Type: "Phone", Group: " Family "}
+	assert.Nil(t, d.Validate())
+	assert.Equal(t, "wifi-aa:bb", d.ID)
+	assert.Equal(t, "Zack's phone", d.Name)
+	assert.Equal(t, "phone", d.Type)
+	assert.Equal(t, "family", d.Group)
+	assert.Equal(t, "Zack's phone", d.DisplayName())
+
+	d = Device{ID: "wifi-aa:bb"}
+	assert.Equal(t, "wifi-aa:bb", d.DisplayName())
+	d = Device{Name: "phone"}
+	assert.NotNil(t, d.Validate())
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Audit log actions
+const (
+	AuditRelabel = "relabel"
+	AuditDelete  = "delete"
+	AuditRename  = "rename"
+)
+
+// FingerprintEdit selects the fingerprints of a device within a
+// time window, to relabel or delete them.
+type FingerprintEdit struct {
+	Device string `json:"device"`
+	// From and To are the inclusive time window, in milliseconds
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	// Location is optional, only fingerprints labeled with
+	// this location are edited
+	Location string `json:"location"`
+	// NewLocation is the location the fingerprints are relabeled to
+	NewLocation string `json:"new_location"`
+}
+
+// Validate will validate that the edit selects a device and a time window
+func (e *FingerprintEdit) Validate() (err error) {
+	e.Device = strings.TrimSpace(strings.ToLower(e.Device))
+	e.Location = strings.TrimSpace(strings.ToLower(e.Location))
+	e.NewLocation = strings.TrimSpace(strings.ToLower(e.NewLocation))
+	if e.Device == "" {
+		err = errors.New("device cannot be empty")
+	} else if e.From <= 0 || e.To <= 0 {
+		err = errors.New("time window must have a from and to")
+	} else if e.From > e.To {
+		err = errors.New("time window cannot end before it starts")
+	}
+	return
+}
+
+// AuditEntry records a change made to the learning data
+type AuditEntry struct {
+	ID          int    `json:"id"`
+	Action      string `json:"action"`
+	Device      string `json:"device,omitempty"`
+	Location    string `json:"location,omitempty"`
+	NewLocation string `json:"new_location,omitempty"`
+	From        int64  `json:"from,omitempty"`
+	To          int64  `json:"to,omitempty"`
+	// Affected is the number of fingerprints that were changed
+	Affected int64 `json:"affected"`
+	// Source is the address of the client that made the change
+	Source   string    `json:"source,omitempty"`
+	CreateAt time.Time `json:"create_at"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprintEditValidate(t *testing.T) {
+	edit := FingerprintEdit{Device: " Phone1 ", From: 1514034330040, To: 1514034330940, NewLocation: "Kitchen"}
+	assert.Nil(t, edit.Validate())
+	assert.Equal(t, "phone1", edit.Device)
+	assert.Equal(t, "kitchen", edit.NewLocation)
+
+	edit = FingerprintEdit{From: 1514034330040, To: 1514034330940}
+	assert.NotNil(t, edit.Validate())
+	edit = FingerprintEdit{Device: "phone1", From: 1514034330040}
+	assert.NotNil(t, edit.Validate())
+	edit = FingerprintEdit{Device: "phone1", From: 1514034330940, To: 1514034330040}
+	assert.NotNil(t, edit.Validate())
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Location is the metadata of a location of a family. The Name is
+// the location that is used for the learning data.
+type Location struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	// Aliases are other names of the location. Learning data sent with
+	// an alias is saved with the name of the location.
+	Aliases  []string `json:"aliases,omitempty"`
+	Floor    string   `json:"floor,omitempty"`
+	Building string   `json:"building,omitempty"`
+	// X and Y are the position on a floor plan
+	X         float64 `json:"x,omitempty"`
+	Y         float64 `json:"y,omitempty"`
+	Latitude  float64 `json:"lat,omitempty"`
+	Longitude float64 `json:"lon,omitempty"`
+	// Polygon is the outline of the location, as [x, y] points
+	Polygon  [][]float64 `json:"polygon,omitempty"`
+	Tags     []string    `json:"tags,omitempty"`
+	CreateAt time.Time   `json:"create_at"`
+	UpdateAt time.Time   `json:"update_at"`
+}
+
+// Validate will validate the location and normalize its names
+func (l *Location) Validate() (err error) {
+	l.Name = strings.TrimSpace(strings.ToLower(l.Name))
+	l.DisplayName = strings.TrimSpace(l.DisplayName)
+	l.Floor = strings.TrimSpace(l.Floor)
+	l.Building = strings.TrimSpace(l.Building)
+	if l.Name == "" {
+		return errors.New("location name cannot be empty")
+	}
+
+	aliases := []string{}
+	seen := map[string]bool{l.Name: true}
+	for _, alias := range l.Aliases {
+		alias = strings.TrimSpace(strings.ToLower(alias))
+		if alias == "" || seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		aliases = append(aliases, alias)
+	}
+	l.Aliases = aliases
+
+	tags := []string{}
+	for _, tag := range l.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	l.Tags = tags
+
+	if l.Latitude < -90 || l.Latitude > 90 {
+		err = errors.New("latitude is not valid")
+	} else if l.Longitude < -180 || l.Longitude > 180 {
+		err = errors.New("longitude is not valid")
+	}
+	for i, point := range l.Polygon {
+		if len(point) != 2 {
+			err = fmt.Errorf("polygon point %d must be [x, y]", i)
+		}
+	}
+	return
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationValidate(t *testing.T) {
+	l := Location{
+		Name:    " Kitchen ",
+		Aliases: []string{"Cocina", "kitchen", "", "cocina"},
+		Tags:    []string{" food ", ""},
+		Polygon: [][]float64{{0, 0}, {0, 1}, {1, 1}},
+	}
+	assert.Nil(t, l.Validate())
+	assert.Equal(t, "kitchen", l.Name)
+	assert.Equal(t, []string{"cocina"}, l.Aliases)
+	assert.Equal(t, []string{"food"}, l.Tags)
+
+	l = Location{}
+	assert.NotNil(t, l.Validate())
+	l = Location{Name: "kitchen", Latitude: 91}
+	assert.NotNil(t, l.Validate())
+	l = Location{Name: "kitchen", Polygon: [][]float64{{0, 0, 1}}}
+	assert.NotNil(t, l.Validate())
+}
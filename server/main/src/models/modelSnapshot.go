@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// ModelSnapshot is a saved version of the models learned by a calibration.
+// It holds the naive bayes models and the python model file, and points
+// to the calibration that has the efficacy of the models.
+type ModelSnapshot struct {
+	ID             int     `json:"id"`
+	CalibrationID  int     `json:"calibration_id"`
+	PercentCorrect float64 `json:"percent_correct"`
+	// Promoted is whether the models were put into use after the calibration
+	Promoted bool `json:"promoted"`
+	// Reason explains why the models were not promoted
+	Reason   string    `json:"reason,omitempty"`
+	Active   bool      `json:"active"`
+	Pinned   bool      `json:"pinned"`
+	CreateAt time.Time `json:"create_at"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Privacy is the privacy mode of a family. When it is enabled, the MACs of
+// passive scans are replaced by keyed hashes, whose key is changed every
+// Rotation, and their fingerprints are deleted after Retention.
+type Privacy struct {
+	Enabled   bool          `json:"enabled"`
+	Retention time.Duration `json:"retention"`
+	Rotation  time.Duration `json:"rotation"`
+}
+
+// PrivateDevice is a device whose MAC was replaced by a hash, with what is
+// kept of the MAC
+type PrivateDevice struct {
+	// ID is the hashed device, like wifi-hash-0123456789abcdef
+	ID string `json:"id"`
+	// OUI is the vendor prefix of the MAC, like 88:d7:f6
+	OUI        string    `json:"oui,omitempty"`
+	Randomized bool      `json:"randomized"`
+	LastSeen   time.Time `json:"last_seen"`
+}
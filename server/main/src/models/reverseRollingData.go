@@ -13,4 +13,24 @@ type ReverseRollingData struct {
 	MinimumPassive int
 	DeviceLocation map[string]string // Device -> Location for learning
 	DeviceGPS      map[string]GPS    // Device -> GPS for learning
+	// Step is how far the window slides, the time block if it is zero
+	Step time.Duration
+	// Aggregation combines the RSSI that a scanner saw for a mac in a window
+	Aggregation string
+	// WindowEnd is the end of the next window, in milliseconds of the
+	// timestamps of the fingerprints
+	WindowEnd int64
+}
+
+// Aggregations are the ways to combine the RSSI of a scanner in a window
+var Aggregations = []string{"last", "mean", "median", "max", "count"}
+
+// ValidAggregation returns whether an aggregation is known
+func ValidAggregation(aggregation string) bool {
+	for _, a := range Aggregations {
+		if a == aggregation {
+			return true
+		}
+	}
+	return false
 }
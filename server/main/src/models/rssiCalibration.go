@@ -0,0 +1,83 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// sources of a RSSI calibration
+const (
+	RSSIManual  = "manual"
+	RSSILearned = "learned"
+)
+
+// RSSICalibration corrects the RSSI measured by a device or a passive
+// scanner, whose antenna sees the same position shifted from the others.
+// The calibrated RSSI is Scale*RSSI + Offset.
+type RSSICalibration struct {
+	Device string  `json:"device"`
+	Offset float64 `json:"offset"`
+	Scale  float64 `json:"scale"`
+	// Source is manual or learned from the reference beacons
+	Source string `json:"source"`
+	// Samples are the fingerprints of reference beacons it was learned from
+	Samples  int64     `json:"samples,omitempty"`
+	UpdateAt time.Time `json:"update_at"`
+}
+
+// Validate will validate the calibration, which has a scale of 1 if it is
+// not given
+func (c *RSSICalibration) Validate() (err error) {
+	c.Device = strings.TrimSpace(strings.ToLower(c.Device))
+	if c.Scale == 0 {
+		c.Scale = 1
+	}
+	if c.Source == "" {
+		c.Source = RSSIManual
+	}
+	if c.Device == "" {
+		err = errors.New("device cannot be empty")
+	} else if c.Scale < 0 || math.IsNaN(c.Scale) || math.IsInf(c.Scale, 0) {
+		err = errors.New("scale must be positive")
+	} else if math.IsNaN(c.Offset) || math.IsInf(c.Offset, 0) {
+		err = errors.New("offset is not valid")
+	} else if c.Source != RSSIManual && c.Source != RSSILearned {
+		err = errors.New("source must be manual or learned")
+	}
+	return
+}
+
+// Apply returns the calibrated RSSI, rounded since the RSSI are integers
+func (c RSSICalibration) Apply(rssi float64) float64 {
+	scale := c.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return math.Floor(scale*rssi + c.Offset + 0.5)
+}
+
+// ReferenceBeacon is a beacon that stays next to the passive scanners of
+// its location, which should all see it with the RSSI given
+type ReferenceBeacon struct {
+	// Device is the tracked device of the beacon, like wifi-aa:bb:cc:dd:ee:ff
+	Device   string    `json:"device"`
+	Location string    `json:"location"`
+	RSSI     float64   `json:"rssi"`
+	CreateAt time.Time `json:"create_at"`
+}
+
+// Validate will validate the beacon and normalize it
+func (b *ReferenceBeacon) Validate() (err error) {
+	b.Device = strings.TrimSpace(strings.ToLower(b.Device))
+	b.Location = strings.TrimSpace(strings.ToLower(b.Location))
+	if b.Device == "" {
+		err = errors.New("device cannot be empty")
+	} else if b.Location == "" {
+		err = errors.New("location cannot be empty")
+	} else if b.RSSI >= 0 || b.RSSI < -150 {
+		err = errors.New("rssi must be between -150 and 0")
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Scanner is a passive scanner of a family, in the scanner registry. It is
+// added when it first sends passive data. The ID is the device of its data.
+type Scanner struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Location string `json:"location,omitempty"`
+	// Version is the software version the scanner last sent
+	Version  string    `json:"version,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	CheckIns int64     `json:"check_ins"`
+	// WindowFingerprints are the fingerprints sent since WindowStart, and
+	// LastWindowFingerprints the ones sent in the window before
+	WindowStart            time.Time `json:"window_start"`
+	WindowFingerprints     int64     `json:"window_fingerprints"`
+	LastWindowFingerprints int64     `json:"last_window_fingerprints"`
+	// Silent is whether the scanner has not checked in for too long
+	Silent   bool      `json:"silent"`
+	CreateAt time.Time `json:"create_at"`
+}
+
+// Validate will validate the scanner and normalize its metadata
+func (s *Scanner) Validate() (err error) {
+	s.ID = strings.TrimSpace(strings.ToLower(s.ID))
+	s.Name = strings.TrimSpace(s.Name)
+	s.Location = strings.TrimSpace(strings.ToLower(s.Location))
+	if s.ID == "" {
+		err = errors.New("scanner cannot be empty")
+	}
+	return
+}
@@ -28,6 +28,10 @@ type SensorData struct {
 	Sensors map[string]map[string]interface{} `json:"s"`
 	// GPS is optional
 	GPS GPS `json:"gps,omitempty"`
+	// Version is the software version of the scanner, optional
+	Version string `json:"version,omitempty"`
+	// RequestID is the id of the request that sent the data, for the logs
+	RequestID string `json:"-"`
 }
 
 // GPS contains GPS data
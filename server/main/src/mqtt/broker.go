@@ -0,0 +1,521 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// packet types of MQTT 3.1.1
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// return codes of CONNACK
+const (
+	connackAccepted           = 0
+	connackBadProtocol        = 1
+	connackBadCredentials     = 4
+	connackNotAuthorized      = 5
+	subackFailure             = 0x80
+	brokerWriteTimeout        = 10 * time.Second
+	brokerConnectTimeout      = 10 * time.Second
+	brokerMaximumPacketLength = 1 << 20
+	// brokerSendBuffer is how many packets are queued for a client, the
+	// packets that do not fit are dropped
+	brokerSendBuffer = 256
+)
+
+// Broker is a MQTT 3.1.1 broker that runs inside the server, so that no
+// mosquitto has to be installed. Messages are delivered at QoS 0, and the
+// retained messages are kept in memory.
+type Broker struct {
+	// Authenticate returns whether a user may connect
+	Authenticate func(username, password string) bool
+	// Authorize returns whether a user may publish (write) or subscribe to a topic
+	Authorize func(username, topic string, write bool) bool
+
+	listener net.Listener
+	clients  map[*brokerClient]bool
+	retained map[string][]byte
+	sync.Mutex
+}
+
+type brokerClient struct {
+	conn     net.Conn
+	username string
+	// filters are guarded by the lock of the broker
+	filters map[string]bool
+	// send queues the packets, so that a client that does not read does
+	// not hold up the others. done stops the writer, which closes written
+	// once it has sent what was queued.
+	send    chan []byte
+	done    chan struct{}
+	written chan struct{}
+}
+
+// NewBroker returns a broker that checks clients with the given functions
+func NewBroker(authenticate func(username, password string) bool, authorize func(username, topic string, write bool) bool) *Broker {
+	return &Broker{
+		Authenticate: authenticate,
+		Authorize:    authorize,
+		clients:      make(map[*brokerClient]bool),
+		retained:     make(map[string][]byte),
+	}
+}
+
+// Listen accepts clients on an address, like ":1883"
+func (b *Broker) Listen(address string) (err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		err = errors.Wrap(err, "could not listen on "+address)
+		return
+	}
+	b.Lock()
+	b.listener = listener
+	b.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.handle(conn)
+		}
+	}()
+	logger.Infof("broker listening on %s", listener.Addr().String())
+	return
+}
+
+// Addr is the address the broker listens on
+func (b *Broker) Addr() net.Addr {
+	b.Lock()
+	defer b.Unlock()
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+// Close stops accepting clients and disconnects the connected ones
+func (b *Broker) Close() {
+	b.Lock()
+	defer b.Unlock()
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	for c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// the first packet has to be CONNECT
+	conn.SetReadDeadline(time.Now().Add(brokerConnectTimeout))
+	header, body, err := readPacket(r)
+	if err != nil || header>>4 != packetConnect {
+		return
+	}
+	c := newBrokerClient(conn)
+	defer func() {
+		close(c.done)
+		<-c.written
+	}()
+	keepAlive, code, err := b.connect(c, body)
+	if err != nil {
+		logger.Debugf("bad CONNECT from %s: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	c.write(packetConnack<<4, []byte{0, code})
+	if code != connackAccepted {
+		logger.Warnf("refused '%s' from %s", c.username, conn.RemoteAddr().String())
+		return
+	}
+	b.Lock()
+	b.clients[c] = true
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		delete(b.clients, c)
+		b.Unlock()
+	}()
+	logger.Debugf("'%s' connected from %s", c.username, conn.RemoteAddr().String())
+
+	for {
+		// clients that are quiet for one and a half keep alives are gone
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		header, body, err = readPacket(r)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("'%s' disconnected: %s", c.username, err.Error())
+			}
+			return
+		}
+		switch header >> 4 {
+		case packetPublish:
+			err = b.publish(c, header, body)
+		case packetSubscribe:
+			err = b.subscribe(c, body)
+		case packetUnsubscribe:
+			err = b.unsubscribe(c, body)
+		case packetPingreq:
+			c.write(packetPingresp<<4, nil)
+		case packetDisconnect:
+			return
+		default:
+			err = errors.Errorf("unsupported packet type %d", header>>4)
+		}
+		if err != nil {
+			logger.Debugf("closing connection of '%s': %s", c.username, err.Error())
+			return
+		}
+	}
+}
+
+// connect reads the CONNECT packet and checks the credentials
+func (b *Broker) connect(c *brokerClient, body []byte) (keepAlive time.Duration, code byte, err error) {
+	p := packetReader{body: body}
+	p.string() // protocol name
+	level := p.byte()
+	flags := p.byte()
+	keepAlive = time.Duration(p.uint16()) * time.Second
+	p.string() // client id
+	if flags&0x04 != 0 {
+		// will topic and message, which are not supported
+		p.string()
+		p.string()
+	}
+	var password string
+	if flags&0x80 != 0 {
+		c.username = p.string()
+	}
+	if flags&0x40 != 0 {
+		password = p.string()
+	}
+	if p.err != nil {
+		err = p.err
+		return
+	}
+	if level != 3 && level != 4 {
+		code = connackBadProtocol
+	} else if c.username == "" {
+		code = connackNotAuthorized
+	} else if !b.Authenticate(c.username, password) {
+		code = connackBadCredentials
+	}
+	return
+}
+
+// publish routes a message that a client published
+func (b *Broker) publish(c *brokerClient, header byte, body []byte) (err error) {
+	p := packetReader{body: body}
+	topic := p.string()
+	qos := (header >> 1) & 3
+	var packetID []byte
+	if qos > 0 {
+		packetID = p.bytes(2)
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if qos > 1 {
+		return errors.New("QoS 2 is not supported")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return errors.Errorf("cannot publish to '%s'", topic)
+	}
+	if qos == 1 {
+		c.write(packetPuback<<4, packetID)
+	}
+	if !b.Authorize(c.username, topic, true) {
+		logger.Warnf("'%s' may not publish to %s", c.username, topic)
+		return
+	}
+	b.route(topic, p.rest(), header&1 == 1)
+	return
+}
+
+// Publish sends a message to the clients that subscribed to its topic
+func (b *Broker) Publish(topic string, payload []byte, retain bool) {
+	b.route(topic, payload, retain)
+}
+
+func (b *Broker) route(topic string, payload []byte, retain bool) {
+	packet := publishPacket(topic, payload)
+	b.Lock()
+	defer b.Unlock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = append([]byte{}, payload...)
+		}
+	}
+	for c := range b.clients {
+		for filter := range c.filters {
+			if topicMatches(filter, topic) {
+				c.write(packetPublish<<4, packet)
+				break
+			}
+		}
+	}
+}
+
+// subscribe adds the filters that the client may read, and sends their
+// retained messages
+func (b *Broker) subscribe(c *brokerClient, body []byte) (err error) {
+	p := packetReader{body: body}
+	granted := p.bytes(2)
+	var filters []string
+	for p.err == nil && len(p.body) > 0 {
+		filter := p.string()
+		p.byte() // requested QoS, always granted as 0
+		if p.err != nil {
+			break
+		}
+		if !validFilter(filter) || !b.Authorize(c.username, filter, false) {
+			logger.Warnf("'%s' may not subscribe to %s", c.username, filter)
+			granted = append(granted, subackFailure)
+			continue
+		}
+		filters = append(filters, filter)
+		granted = append(granted, 0)
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for _, filter := range filters {
+		c.filters[filter] = true
+	}
+	c.write(packetSuback<<4, granted)
+	for topic, payload := range b.retained {
+		for _, filter := range filters {
+			if topicMatches(filter, topic) {
+				c.write(packetPublish<<4|1, publishPacket(topic, payload))
+				break
+			}
+		}
+	}
+	return
+}
+
+func (b *Broker) unsubscribe(c *brokerClient, body []byte) (err error) {
+	p := packetReader{body: body}
+	packetID := p.bytes(2)
+	b.Lock()
+	for p.err == nil && len(p.body) > 0 {
+		delete(c.filters, p.string())
+	}
+	b.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	c.write(packetUnsuback<<4, packetID)
+	return
+}
+
+// newBrokerClient returns a client of a connection and starts its writer
+func newBrokerClient(conn net.Conn) *brokerClient {
+	c := &brokerClient{
+		conn:    conn,
+		filters: make(map[string]bool),
+		send:    make(chan []byte, brokerSendBuffer),
+		done:    make(chan struct{}),
+		written: make(chan struct{}),
+	}
+	go c.writer()
+	return c
+}
+
+// write queues a packet, dropping it if the queue of the client is full
+func (c *brokerClient) write(header byte, body []byte) {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	select {
+	case c.send <- append(packet, body...):
+	default:
+		logger.Debugf("dropped a packet for '%s', who is not reading", c.username)
+	}
+}
+
+// writer sends the queued packets, closing the connection if the client
+// does not read in time
+func (c *brokerClient) writer() {
+	defer close(c.written)
+	send := func(packet []byte) {
+		c.conn.SetWriteDeadline(time.Now().Add(brokerWriteTimeout))
+		if _, err := c.conn.Write(packet); err != nil {
+			c.conn.Close()
+		}
+	}
+	for {
+		select {
+		case packet := <-c.send:
+			send(packet)
+		case <-c.done:
+			// send what was queued before the connection is closed
+			for {
+				select {
+				case packet := <-c.send:
+					send(packet)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func publishPacket(topic string, payload []byte) []byte {
+	body := make([]byte, 2, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	return append(append(body, topic...), payload...)
+}
+
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	header, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		var digit byte
+		digit, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		length += int(digit&127) * multiplier
+		multiplier *= 128
+		if digit&128 == 0 {
+			break
+		}
+		if i == 3 {
+			err = errors.New("malformed remaining length")
+			return
+		}
+	}
+	if length > brokerMaximumPacketLength {
+		err = errors.Errorf("packet of %d bytes is too large", length)
+		return
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+// packetReader reads the fields of a packet, keeping the first error
+type packetReader struct {
+	body []byte
+	err  error
+}
+
+func (p *packetReader) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.body) < n {
+		p.err = errors.New("packet is too short")
+		return nil
+	}
+	b := p.body[:n]
+	p.body = p.body[n:]
+	return b
+}
+
+func (p *packetReader) byte() byte {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *packetReader) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (p *packetReader) string() string {
+	return string(p.bytes(int(p.uint16())))
+}
+
+func (p *packetReader) rest() []byte {
+	return p.body
+}
+
+// validFilter returns whether the wildcards of a filter are whole levels,
+// with # only at the end
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatches returns whether a topic matches a filter with the + and #
+// wildcards. Topics starting with $ are only matched explicitly.
+func topicMatches(filter, topic string) bool {
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (filters[0] == "+" || filters[0] == "#") {
+		return false
+	}
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topics) || (f != "+" && f != topics[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
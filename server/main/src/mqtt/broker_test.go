@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicMatches(t *testing.T) {
+	assert.True(t, topicMatches("family/#", "family/location/zack"))
+	assert.True(t, topicMatches("+/location/+", "family/location/zack"))
+	assert.True(t, topicMatches("family/location/zack", "family/location/zack"))
+	assert.False(t, topicMatches("family/location", "family/location/zack"))
+	assert.False(t, topicMatches("+/track/+", "family/learn/zack/kitchen"))
+	assert.False(t, topicMatches("#", "$SYS/uptime"))
+
+	assert.True(t, validFilter("family/#"))
+	assert.True(t, validFilter("+/track/+"))
+	assert.False(t, validFilter("family/#/zack"))
+	assert.False(t, validFilter("family/loc+"))
+	assert.False(t, validFilter(""))
+}
+
+func TestBrokerRetained(t *testing.T) {
+	b := NewBroker(func(username, password string) bool {
+		return password == "secret"
+	}, func(username, topic string, write bool) bool {
+		return write || username == "reader"
+	})
+	assert.Nil(t, b.Listen("127.0.0.1:0"))
+	defer b.Close()
+	address := "tcp://" + b.Addr().String()
+
+	writer, err := connect(t, address, "writer", "secret")
+	assert.Nil(t, err)
+	defer writer.Disconnect(0)
+	writer.Publish("home/state", 1, true, "on").Wait()
+	writer.Publish("home/other", 1, false, "not retained").Wait()
+
+	// the retained message is sent on subscribing, flagged as retained
+	messages := make(chan MQTT.Message, 2)
+	reader, err := connect(t, address, "reader", "secret")
+	assert.Nil(t, err)
+	defer reader.Disconnect(0)
+	reader.Subscribe("home/#", 0, func(c MQTT.Client, msg MQTT.Message) {
+		messages <- msg
+	}).Wait()
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "home/state", msg.Topic())
+		assert.Equal(t, "on", string(msg.Payload()))
+		assert.True(t, msg.Retained())
+	case <-time.After(5 * time.Second):
+		t.Fatal("retained message was not sent")
+	}
+
+	// an empty retained message clears it
+	writer.Publish("home/state", 1, true, "").Wait()
+	<-messages
+	b.Lock()
+	assert.Equal(t, 0, len(b.retained))
+	b.Unlock()
+
+	// the writer cannot read
+	token := writer.Subscribe("home/#", 0, nil)
+	token.Wait()
+	assert.Equal(t, byte(0x80), token.(*MQTT.SubscribeToken).Result()["home/#"])
+}
+
+func TestBrokerSlowClient(t *testing.T) {
+	b := NewBroker(nil, nil)
+	conn, other := net.Pipe()
+	defer other.Close()
+	c := newBrokerClient(conn)
+	defer func() {
+		conn.Close()
+		close(c.done)
+		<-c.written
+	}()
+	c.filters["#"] = true
+	b.Lock()
+	b.clients[c] = true
+	b.Unlock()
+
+	// a client that does not read does not hold up publishing
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*brokerSendBuffer; i++ {
+			b.Publish("family/location/zack", []byte("kitchen"), false)
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publishing waited for a client that does not read")
+	}
+}
@@ -0,0 +1,178 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+var (
+	// HomeAssistant publishes Home Assistant discovery messages for the
+	// registered devices, under DiscoveryPrefix
+	HomeAssistant   = true
+	DiscoveryPrefix = "homeassistant"
+	// DiscoveryPerFamily puts the DiscoveryPrefix under FAMILY/, so that
+	// the family can read it. A Home Assistant then discovers the devices
+	// of one family, while the shared prefix needs the admin to read it.
+	DiscoveryPerFamily = true
+)
+
+// discovered are the devices whose entities were published since
+// connecting, by FAMILY/DEVICE. The devices that are not registered are
+// not kept, since passive scans see many of them.
+var (
+	discovered     = make(map[string]struct{})
+	discoveredLock sync.Mutex
+)
+
+// discoveryComponents are the Home Assistant entities of each device
+var discoveryComponents = []string{"sensor", "device_tracker"}
+
+var notObjectID = regexp.MustCompile("[^a-z0-9_-]+")
+
+// objectID is the Home Assistant id of a device, like find_FAMILY_DEVICE
+func objectID(family, device string) string {
+	return notObjectID.ReplaceAllString(strings.ToLower("find_"+family+"_"+device), "_")
+}
+
+func discoveryTopic(component, family, device string) string {
+	topic := strings.Join([]string{DiscoveryPrefix, component, objectID(family, device), "config"}, "/")
+	if DiscoveryPerFamily {
+		topic = family + "/" + topic
+	}
+	return topic
+}
+
+// stateTopic has the current location of a device
+func stateTopic(family, device string) string {
+	return family + "/state/" + device
+}
+
+// resetDiscovery forgets which devices were discovered, so that they are
+// published again on the next connection
+func resetDiscovery() {
+	discoveredLock.Lock()
+	discovered = make(map[string]struct{})
+	discoveredLock.Unlock()
+}
+
+// ForgetDiscovery forgets which devices of a family were discovered, once
+// its database is deleted or renamed
+func ForgetDiscovery(family string) {
+	discoveredLock.Lock()
+	defer discoveredLock.Unlock()
+	for key := range discovered {
+		if strings.HasPrefix(key, family+"/") {
+			delete(discovered, key)
+		}
+	}
+}
+
+// Discovered returns whether the entities of a device were published
+func Discovered(family, device string) bool {
+	discoveredLock.Lock()
+	defer discoveredLock.Unlock()
+	_, ok := discovered[family+"/"+device]
+	return ok
+}
+
+// PublishDiscovery publishes the entities of a registered device, which
+// are removed if the device is not registered or ignored
+func PublishDiscovery(family string, device models.Device) (err error) {
+	if !HomeAssistant {
+		return
+	}
+	if !device.Registered || device.Ignore {
+		// the entities are removed when the device is deleted or ignored,
+		// so they only have to be removed here if they were just published
+		discoveredLock.Lock()
+		_, published := discovered[family+"/"+device.ID]
+		delete(discovered, family+"/"+device.ID)
+		discoveredLock.Unlock()
+		if published {
+			err = RemoveDiscovery(family, device.ID)
+		}
+		return
+	}
+
+	id := objectID(family, device.ID)
+	haDevice := map[string]interface{}{
+		"identifiers": []string{id},
+		"name":        device.DisplayName(),
+	}
+	if device.Vendor != "" {
+		haDevice["manufacturer"] = device.Vendor
+	}
+	if device.Type != "" {
+		haDevice["model"] = device.Type
+	}
+	configs := map[string]map[string]interface{}{
+		"sensor": {
+			"name":        device.DisplayName() + " location",
+			"unique_id":   id + "_location",
+			"state_topic": stateTopic(family, device.ID),
+			"icon":        "mdi:map-marker",
+			"device":      haDevice,
+		},
+		"device_tracker": {
+			"name":        device.DisplayName(),
+			"unique_id":   id + "_tracker",
+			"state_topic": stateTopic(family, device.ID),
+			"source_type": "router",
+			"device":      haDevice,
+		},
+	}
+	for _, component := range discoveryComponents {
+		b, _ := json.Marshal(configs[component])
+		if err = publish(discoveryTopic(component, family, device.ID), b, true); err != nil {
+			err = errors.Wrap(err, "could not publish discovery of "+device.ID)
+			return
+		}
+	}
+	discoveredLock.Lock()
+	discovered[family+"/"+device.ID] = struct{}{}
+	discoveredLock.Unlock()
+	logger.WithFamily(family).Debugf("published discovery of %s", device.ID)
+	return
+}
+
+// RemoveDiscovery removes the entities and the state of a device, by
+// clearing their retained messages
+func RemoveDiscovery(family, device string) (err error) {
+	if !HomeAssistant {
+		return
+	}
+	topics := []string{stateTopic(family, device)}
+	for _, component := range discoveryComponents {
+		topics = append(topics, discoveryTopic(component, family, device))
+	}
+	for _, topic := range topics {
+		if err = publish(topic, nil, true); err != nil {
+			err = errors.Wrap(err, "could not remove discovery of "+device)
+			return
+		}
+	}
+	discoveredLock.Lock()
+	delete(discovered, family+"/"+device)
+	discoveredLock.Unlock()
+	return
+}
+
+// PublishState publishes the current location of a device, as a retained
+// message, if its entities were published
+func PublishState(family, device, location string) (err error) {
+	if !HomeAssistant {
+		return
+	}
+	discoveredLock.Lock()
+	_, published := discovered[family+"/"+device]
+	discoveredLock.Unlock()
+	if !published {
+		return
+	}
+	return publish(stateTopic(family, device), []byte(location), true)
+}
@@ -0,0 +1,5 @@
+package mqtt
+
+import "github.com/schollz/find4/server/main/src/logging"
+
+var logger = logging.New("mqtt")
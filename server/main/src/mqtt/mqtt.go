@@ -1,59 +1,101 @@
 package mqtt
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
-	"github.com/schollz/find4/server/main/src/api"
 	"github.com/schollz/find4/server/main/src/database"
-	// "github.com/schollz/find4/server/main/src/logging"
+	"github.com/schollz/find4/server/main/src/logging"
 	"github.com/schollz/find4/server/main/src/models"
 	"github.com/schollz/find4/server/main/src/utils"
-	"github.com/sjsafranek/ligneous"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	// Server is the address of the broker to use for MQTT
 	Server                   = "localhost:1883"
-	Debug                    = false
-	logger                   ligneous.SeelogWrapper
 	Existing                 = false
 	IsSetup                  = false
 	AdminUser                = "zack"
 	AdminPassword            = "1234"
 	MosquittoConfigDirectory = "mosquitto_config"
+	// Embedded runs a broker in the server, listening on Listen, instead
+	// of configuring mosquitto
+	Embedded = false
+	Listen   = ":1883"
+
+	// ProcessSensorData handles the fingerprints received over MQTT. It is
+	// set by the server, so that they are processed like the ones sent over HTTP.
+	ProcessSensorData func(d models.SensorData) error
+	// ProcessPassiveData handles the passive scans received over MQTT
+	ProcessPassiveData func(d models.SensorData) error
+	// ClassifySensorData saves and classifies the fingerprints received
+	// over MQTT on FAMILY/classify
+	ClassifySensorData func(d models.SensorData) (models.LocationAnalysis, error)
+	// GetDatabase returns the open database of a family. It is set by the
+	// server, so that the passwords are written by its writer.
+	GetDatabase func(family string) (*database.Database, error)
 )
 
 var (
 	adminClient MQTT.Client
+	broker      *Broker
+	clientLock  sync.RWMutex
 )
 
+// passwordKey is the key of the keystore of a family that has the hash
+// of its password for the embedded broker
+const passwordKey = "MQTTPassword"
+
+// subscriptions are the topics of the fingerprints, in the FIND format:
+// FAMILY/track/DEVICE and FAMILY/learn/DEVICE/LOCATION, and as sensor data
+// in JSON: FAMILY/data, FAMILY/passive and FAMILY/classify
+var subscriptions = map[string]byte{
+	"+/track/+":   1,
+	"+/learn/+/+": 1,
+	"+/data":      1,
+	"+/passive":   1,
+	"+/classify":  1,
+}
+
+// Setup connects to the broker and subscribes to the fingerprints
 func Setup() (err error) {
-	logger = ligneous.New()
-	if Debug {
-		logger.SetLevel("debug")
-	} else {
-		logger.SetLevel("info")
+	if ProcessSensorData == nil {
+		return errors.New("nothing to process the sensor data")
 	}
-
-	logger.Log.Debug("setting up")
+	logger.Debug("setting up")
 
 	server := "tcp://" + Server
 	opts := MQTT.NewClientOptions()
-	if Existing {
-		logger.Log.Debug("using existing setup")
+	if Embedded {
+		logger.Debug("using embedded broker")
+		b := NewBroker(authenticate, authorize)
+		if err = b.Listen(Listen); err != nil {
+			return
+		}
+		clientLock.Lock()
+		broker = b
+		clientLock.Unlock()
+		_, port, _ := net.SplitHostPort(b.Addr().String())
+		server = "tcp://" + net.JoinHostPort("127.0.0.1", port)
+		opts.AddBroker(server).SetClientID(utils.RandomString(5)).SetUsername(AdminUser).SetPassword(AdminPassword).SetCleanSession(true)
+	} else if Existing {
+		logger.Debug("using existing setup")
 		opts.AddBroker(server).SetClientID(utils.RandomString(5)).SetCleanSession(true)
 	} else {
-		logger.Log.Debug("using current setup")
+		logger.Debug("using current setup")
 		err = updateMosquittoConfig()
 		if err != nil {
 			err = errors.Wrap(err, "could not update mosquitto config")
@@ -62,50 +104,103 @@ func Setup() (err error) {
 		time.Sleep(3 * time.Second)
 		opts.AddBroker(server).SetClientID(utils.RandomString(5)).SetUsername(AdminUser).SetPassword(AdminPassword).SetCleanSession(true)
 	}
-	// subscribe
+	opts.SetAutoReconnect(true)
+	// subscribe again whenever the connection is made
 	opts.OnConnect = func(c MQTT.Client) {
-		if token := c.Subscribe("#", 1, messageReceived); token.Wait() && token.Error() != nil {
-			err = errors.Wrap(token.Error(), "could not subscribe")
+		// the retained discovery may be gone with the broker
+		resetDiscovery()
+		if token := c.SubscribeMultiple(subscriptions, messageReceived); token.Wait() && token.Error() != nil {
+			logger.Error(errors.Wrap(token.Error(), "could not subscribe"))
 			return
 		}
+		logger.Debug("subscribed to fingerprints")
+	}
+	opts.OnConnectionLost = func(c MQTT.Client, err error) {
+		logger.Warnf("lost connection to %s: %s", server, err.Error())
 	}
 
-	adminClient = MQTT.NewClient(opts)
-
-	if token := adminClient.Connect(); token.Wait() && token.Error() != nil {
-		err = token.Error()
+	client := MQTT.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		err = errors.Wrap(token.Error(), "could not connect to "+server)
+		return
 	}
-	logger.Log.Debug("finished setup")
+
+	clientLock.Lock()
+	adminClient = client
 	IsSetup = true
+	clientLock.Unlock()
+	logger.Debug("finished setup")
 	return
 }
 
+// Close disconnects from the broker, and stops the embedded broker
+func Close() {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if IsSetup {
+		logger.Debug("disconnecting")
+		adminClient.Disconnect(250)
+		IsSetup = false
+	}
+	if broker != nil {
+		broker.Close()
+		broker = nil
+	}
+}
+
+// authenticate checks the admin, or a family and the password that was
+// made for it by AddFamily
+func authenticate(username, password string) bool {
+	if username == AdminUser {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(AdminPassword)) == 1
+	}
+	db, err := database.Open(username, true)
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	var hash string
+	if err = db.Get(passwordKey, &hash); err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// authorize lets the admin use every topic, and a family use its own
+// topics, FAMILY/#
+func authorize(username, topic string, write bool) bool {
+	if username == AdminUser {
+		return true
+	}
+	return username != "" && strings.SplitN(topic, "/", 2)[0] == username
+}
+
 func updateMosquittoConfig() (err error) {
 	// open the database that stores the basic parameters
-	logger.Log.Debug("opening mosquitto database")
+	logger.Debug("opening mosquitto database")
 	db, err := database.Open("mosquitto", false, true)
 	if err != nil {
 		return
 	}
 	defer db.Close()
-	logger.Log.Debug("starting database")
+	logger.Debug("starting database")
 
 	// check if the defaults exist, otherwise create them
 	var errGet error
 	var acl, passwd, conf string
 	errGet = db.Get("acl", &acl)
 	if errGet != nil {
-		logger.Log.Debug("making acl")
+		logger.Debug("making acl")
 		acl = fmt.Sprintf("user %s\ntopic readwrite #\n\n", AdminUser)
 	}
 	errGet = db.Get("passwd", &passwd)
 	if errGet != nil {
-		logger.Log.Debug("making passwd")
+		logger.Debug("making passwd")
 		passwd = fmt.Sprintf("%s:%s\n", AdminUser, AdminPassword)
 	}
 	errGet = db.Get("conf", &conf)
 	if errGet != nil {
-		logger.Log.Debug("making conf")
+		logger.Debug("making conf")
 		conf = fmt.Sprintf("allow_anonymous false\n\nacl_file %s/acl\n\npassword_file %s/passwd\n\npid_file %s/pid", MosquittoConfigDirectory, MosquittoConfigDirectory, MosquittoConfigDirectory)
 	}
 
@@ -147,7 +242,7 @@ func updateMosquittoConfig() (err error) {
 	// regenerate mosquitto
 	bPID, errPID := ioutil.ReadFile(path.Join(MosquittoConfigDirectory, "pid"))
 	if errPID != nil {
-		logger.Log.Debug("could not get PID, running")
+		logger.Debug("could not get PID, running")
 		// try running by itself
 		cmd = "mosquitto"
 		args = []string{"-c", fmt.Sprintf("%s/mosquitto.conf", MosquittoConfigDirectory), "-d"}
@@ -163,7 +258,7 @@ func updateMosquittoConfig() (err error) {
 			return
 		}
 	}
-	logger.Log.Debug("setup mosquitto and gave HUP signal")
+	logger.Debug("setup mosquitto and gave HUP signal")
 	return
 }
 
@@ -184,10 +279,42 @@ func add(family string) (password string, err error) {
 	password = utils.RandomString(5)
 	passes[family] = password
 	err = db.Set("passes", passes)
+	db.Sync()
 	return
 }
 
+// setPassword makes a password for a family and stores its hash in the
+// database of the family, for the embedded broker
+func setPassword(family string) (password string, err error) {
+	if database.Exists(family) != nil {
+		err = errors.Errorf("family '%s' does not exist", family)
+		return
+	}
+	if GetDatabase == nil {
+		err = errors.New("mqtt has no databases")
+		return
+	}
+	db, err := GetDatabase(family)
+	if err != nil {
+		return
+	}
+
+	password = utils.RandomString(5)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+	err = db.Set(passwordKey, string(hash))
+	db.Sync()
+	return
+}
+
+// AddFamily makes a new password for a family, which can then use
+// its topics with the family as username
 func AddFamily(family string) (password string, err error) {
+	if Embedded {
+		return setPassword(family)
+	}
 	password, err = add(family)
 	if err != nil {
 		return
@@ -196,57 +323,122 @@ func AddFamily(family string) (password string, err error) {
 	return
 }
 
+// Publish publishes the location of a device to FAMILY/location/DEVICE
 func Publish(family, device, message string) (err error) {
+	return publish(strings.Join([]string{family, "/location/", device}, ""), []byte(message), false)
+}
+
+func publish(topic string, message []byte, retain bool) (err error) {
+	clientLock.RLock()
+	defer clientLock.RUnlock()
 	if !IsSetup {
 		return errors.New("mqtt not setup")
 	}
-	pubTopic := strings.Join([]string{family, "/location/", device}, "")
-
-	if token := adminClient.Publish(pubTopic, 1, false, message); token.Wait() && token.Error() != nil {
-		err = fmt.Errorf("Failed to send message")
+	if token := adminClient.Publish(topic, 1, retain, message); token.Wait() && token.Error() != nil {
+		err = errors.Wrap(token.Error(), "failed to send message")
 	}
 	return
 }
 
 func messageReceived(client MQTT.Client, msg MQTT.Message) {
+	if topics := strings.Split(msg.Topic(), "/"); len(topics) == 2 {
+		sensorDataReceived(topics[0], topics[1], msg.Payload())
+		return
+	}
 	jsonFingerprint, route, err := mqttBuildFingerprint(msg.Topic(), msg.Payload())
 	if err != nil {
+		logger.Debugf("ignored message on %s: %s", msg.Topic(), err.Error())
 		return
 	}
-	logger.Log.Debug("Got valid MQTT request for group " + jsonFingerprint.Group + ", user " + jsonFingerprint.Username)
 	if route == "track" {
 		jsonFingerprint.Location = ""
 	}
 	d := jsonFingerprint.Convert()
-	err = api.SaveSensorData(d)
+	d.RequestID = logging.NewRequestID()
+	log := logger.WithFamily(d.Family).WithRequest(d.RequestID)
+	err = d.Validate()
 	if err != nil {
-		logger.Log.Error(err)
+		log.Warnf("problem validating data on %s: %s", msg.Topic(), err.Error())
 		return
 	}
-	_, err = sendOutData(d)
+	log.Debugf("got %s fingerprint of %s", route, d.Device)
+	err = ProcessSensorData(d)
 	if err != nil {
-		logger.Log.Error(err)
-		return
+		log.Warn(err)
 	}
 }
 
-func sendOutData(p models.SensorData) (analysis models.LocationAnalysis, err error) {
-	analysis, _ = api.AnalyzeSensorData(p)
-	type Payload struct {
-		Sensors models.SensorData           `json:"sensors"`
-		Guesses []models.LocationPrediction `json:"guesses"`
+// sensorDataReceived handles the sensor data in JSON, which is sent to the
+// topic of its family
+func sensorDataReceived(family, route string, message []byte) {
+	family = strings.TrimSpace(strings.ToLower(family))
+	var d models.SensorData
+	err := json.Unmarshal(message, &d)
+	if err != nil {
+		logger.WithFamily(family).Debugf("ignored message on %s/%s: %s", family, route, err.Error())
+		return
+	}
+	if d.Family == "" {
+		d.Family = family
 	}
-	payload := Payload{
-		Sensors: p,
-		Guesses: analysis.Guesses,
+	d.RequestID = logging.NewRequestID()
+	log := logger.WithFamily(family).WithRequest(d.RequestID)
+	err = d.Validate()
+	if err == nil && d.Family != family {
+		err = errors.Errorf("family '%s' does not match the topic", d.Family)
 	}
-	bTarget, err := json.Marshal(payload)
 	if err != nil {
+		err = errors.Wrap(err, "problem validating data")
+	}
+
+	switch route {
+	case "data":
+		if err == nil {
+			err = ProcessSensorData(d)
+		}
+	case "passive":
+		if err == nil && ProcessPassiveData == nil {
+			err = errors.New("passive data is not processed")
+		} else if err == nil {
+			err = ProcessPassiveData(d)
+		}
+	case "classify":
+		if d.Device == "" {
+			break
+		}
+		// the classification waits on the AI, so it is not done while
+		// the client is delivering messages
+		go classify(d, err)
+		return
+	default:
 		return
 	}
-	logger.Log.Debugf("[%s] sending data over mqtt (%s)", p.Family, p.Device)
-	Publish(p.Family, p.Device, string(bTarget))
-	return
+	if err != nil {
+		log.Warnf("problem with %s data of %s: %s", route, d.Device, err.Error())
+		return
+	}
+	log.Debugf("got %s data of %s", route, d.Device)
+}
+
+// classify publishes the analysis of the sensor data to
+// FAMILY/classify/DEVICE, like the response of /classify
+func classify(d models.SensorData, err error) {
+	log := logger.WithFamily(d.Family).WithRequest(d.RequestID)
+	var analysis models.LocationAnalysis
+	if err == nil && ClassifySensorData == nil {
+		err = errors.New("sensor data is not classified")
+	} else if err == nil {
+		analysis, err = ClassifySensorData(d)
+	}
+	response := map[string]interface{}{"message": "classified data", "success": true, "analysis": analysis}
+	if err != nil {
+		log.Warnf("problem classifying data of %s: %s", d.Device, err.Error())
+		response = map[string]interface{}{"message": err.Error(), "success": false, "analysis": nil}
+	}
+	b, _ := json.Marshal(response)
+	if err = publish(d.Family+"/classify/"+d.Device, b, false); err != nil {
+		log.Warn(err)
+	}
 }
 
 // backwards compatible with FIND
@@ -1,19 +1,307 @@
 package mqtt
 
 import (
-	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/schollz/find4/server/main/src/utils"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestBuildFingerprint(t *testing.T) {
+	f, route, err := mqttBuildFingerprint("testdb/learn/zack/Kitchen", []byte("001a1e46cd1082001a1e46cd1184"))
+	assert.Nil(t, err)
+	assert.Equal(t, "learn", route)
+	assert.Equal(t, "testdb", f.Group)
+	assert.Equal(t, "zack", f.Username)
+	assert.Equal(t, "kitchen", f.Location)
+	assert.Equal(t, []models.Router{{Mac: "00:1a:1e:46:cd:10", Rssi: -82}, {Mac: "00:1a:1e:46:cd:11", Rssi: -84}}, f.WifiFingerprint)
+
+	_, _, err = mqttBuildFingerprint("testdb/track/zack/kitchen", nil)
+	assert.NotNil(t, err)
+	_, _, err = mqttBuildFingerprint("testdb/location/zack", nil)
+	assert.NotNil(t, err)
+}
+
+// addFamily makes the database of a family and a password for it
+func addFamily(t *testing.T, family string) (password string, err error) {
+	if _, err = GetDatabase(family); err != nil {
+		t.Fatal(err)
+	}
+	return AddFamily(family)
+}
+
+// setupEmbedded runs the embedded broker with the databases in a temporary folder
+func setupEmbedded(t *testing.T) (address string, teardown func()) {
+	folder, err := ioutil.TempDir("", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.DataFolder = folder
+	ProcessSensorData = func(d models.SensorData) error { return nil }
+	dbs := make(map[string]*database.Database)
+	GetDatabase = func(family string) (*database.Database, error) {
+		if db, ok := dbs[family]; ok {
+			return db, nil
+		}
+		db, err := database.Open(family)
+		if err == nil {
+			dbs[family] = db
+		}
+		return db, err
+	}
+	Embedded = true
+	Listen = "127.0.0.1:0"
+	AdminUser = "admin"
+	AdminPassword = "1234"
+	if err = Setup(); err != nil {
+		t.Fatal(err)
+	}
+	address = "tcp://" + broker.Addr().String()
+	teardown = func() {
+		Close()
+		for _, db := range dbs {
+			db.Close()
+		}
+		Embedded = false
+		ProcessSensorData = nil
+		GetDatabase = nil
+		database.DataFolder = database.DEFAULT_DATA_FOLDER
+		os.RemoveAll(folder)
+	}
+	return
+}
+
+func connect(t *testing.T, address, username, password string) (MQTT.Client, error) {
+	opts := MQTT.NewClientOptions().AddBroker(address).SetClientID(utils.RandomString(8))
+	opts.SetUsername(username).SetPassword(password)
+	client := MQTT.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	return client, token.Error()
+}
+
 func TestMQTT(t *testing.T) {
-	Debug = true
-	err := Setup()
+	address, teardown := setupEmbedded(t)
+	defer teardown()
+
+	received := make(chan models.SensorData, 1)
+	ProcessSensorData = func(d models.SensorData) error {
+		received <- d
+		return nil
+	}
+
+	password, err := addFamily(t, "testmqtt")
+	assert.Nil(t, err)
+	client, err := connect(t, address, "testmqtt", password)
+	assert.Nil(t, err)
+	defer client.Disconnect(0)
+
+	// fingerprints are processed
+	client.Publish("testmqtt/track/zack", 1, false, "001a1e46cd1082").Wait()
+	select {
+	case d := <-received:
+		assert.Equal(t, "testmqtt", d.Family)
+		assert.Equal(t, "zack", d.Device)
+		assert.Equal(t, "", d.Location)
+		assert.Equal(t, float64(-82), d.Sensors["wifi"]["00:1a:1e:46:cd:10"])
+		assert.NotEqual(t, "", d.RequestID)
+		assert.True(t, d.Timestamp > 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fingerprint was not processed")
+	}
+
+	// locations are published
+	locations := make(chan string, 1)
+	token := client.Subscribe("testmqtt/location/#", 0, func(c MQTT.Client, msg MQTT.Message) {
+		locations <- msg.Topic() + " " + string(msg.Payload())
+	})
+	token.Wait()
+	assert.Nil(t, token.Error())
+	assert.Nil(t, Publish("testmqtt", "zack", `{"location":"kitchen"}`))
+	select {
+	case location := <-locations:
+		assert.Equal(t, `testmqtt/location/zack {"location":"kitchen"}`, location)
+	case <-time.After(5 * time.Second):
+		t.Fatal("location was not published")
+	}
+}
+
+func TestEmbeddedCredentials(t *testing.T) {
+	address, teardown := setupEmbedded(t)
+	defer teardown()
+
+	_, err := connect(t, address, "admin", "wrong")
+	assert.NotNil(t, err)
+	_, err = connect(t, address, "nofamily", "1234")
+	assert.NotNil(t, err)
+
+	// only families that exist get a password
+	_, err = AddFamily("nofamily")
+	assert.NotNil(t, err)
+
+	// a new family can connect right away, with its latest password
+	first, err := addFamily(t, "testcredentials")
 	assert.Nil(t, err)
-	err = Publish("labs", "fido", "hello, world")
+	client, err := connect(t, address, "testcredentials", first)
 	assert.Nil(t, err)
-	password, err := AddFamily("labs")
+	client.Disconnect(0)
+	second, err := AddFamily("testcredentials")
 	assert.Nil(t, err)
-	fmt.Println(password)
+	if first != second {
+		_, err = connect(t, address, "testcredentials", first)
+		assert.NotNil(t, err)
+	}
+	client, err = connect(t, address, "testcredentials", second)
+	assert.Nil(t, err)
+	defer client.Disconnect(0)
+
+	// a family only reads its own topics
+	token := client.SubscribeMultiple(map[string]byte{
+		"testcredentials/location/#": 0,
+		"otherfamily/location/#":     0,
+		"#":                          0,
+	}, nil)
+	token.Wait()
+	assert.Nil(t, token.Error())
+	assert.Equal(t, map[string]byte{
+		"testcredentials/location/#": 0,
+		"otherfamily/location/#":     0x80,
+		"#":                          0x80,
+	}, token.(*MQTT.SubscribeToken).Result())
+}
+
+func TestSensorDataMQTT(t *testing.T) {
+	address, teardown := setupEmbedded(t)
+	defer teardown()
+
+	received := make(chan string, 3)
+	ProcessSensorData = func(d models.SensorData) error {
+		received <- "data " + d.Device + " " + d.Location
+		return nil
+	}
+	ProcessPassiveData = func(d models.SensorData) error {
+		received <- "passive " + d.Device
+		return nil
+	}
+	ClassifySensorData = func(d models.SensorData) (models.LocationAnalysis, error) {
+		return models.LocationAnalysis{Guesses: []models.LocationPrediction{{Location: "kitchen", Probability: 1}}}, nil
+	}
+	defer func() {
+		ProcessPassiveData = nil
+		ClassifySensorData = nil
+	}()
+
+	password, err := addFamily(t, "testjson")
+	assert.Nil(t, err)
+	client, err := connect(t, address, "testjson", password)
+	assert.Nil(t, err)
+	defer client.Disconnect(0)
+
+	responses := make(chan string, 1)
+	token := client.Subscribe("testjson/classify/+", 0, func(c MQTT.Client, msg MQTT.Message) {
+		responses <- msg.Topic() + " " + string(msg.Payload())
+	})
+	token.Wait()
+	assert.Nil(t, token.Error())
+
+	// the family of the sensor data has to match the topic
+	client.Publish("testjson/data", 1, false, `{"f":"otherfamily","d":"zack","s":{"bluetooth":{"aa:bb":-50}}}`).Wait()
+	client.Publish("testjson/data", 1, false, `{"d":"zack","l":"Kitchen","s":{"bluetooth":{"aa:bb":-50}},"gps":{"lat":1,"lon":2}}`).Wait()
+	client.Publish("testjson/passive", 1, false, `{"f":"testjson","d":"scanner","s":{"wifi":{"aa:bb":-50}}}`).Wait()
+	for _, expected := range []string{"data zack kitchen", "passive scanner"} {
+		select {
+		case r := <-received:
+			assert.Equal(t, expected, r)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not processed", expected)
+		}
+	}
+
+	client.Publish("testjson/classify", 1, false, `{"d":"zack","s":{"wifi":{"aa:bb":-50}}}`).Wait()
+	select {
+	case r := <-responses:
+		assert.Contains(t, r, "testjson/classify/zack ")
+		assert.Contains(t, r, `"success":true`)
+		assert.Contains(t, r, `"location":"kitchen"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("classification was not published")
+	}
+	assert.Equal(t, 0, len(received))
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	address, teardown := setupEmbedded(t)
+	defer teardown()
+
+	client, err := connect(t, address, "admin", "1234")
+	assert.Nil(t, err)
+	defer client.Disconnect(0)
+	messages := make(chan string, 10)
+	token := client.SubscribeMultiple(map[string]byte{"testha/#": 0}, func(c MQTT.Client, msg MQTT.Message) {
+		messages <- msg.Topic() + " " + string(msg.Payload())
+	})
+	token.Wait()
+	assert.Nil(t, token.Error())
+	next := func() string {
+		select {
+		case m := <-messages:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing was published")
+		}
+		return ""
+	}
+
+	// devices that are not registered are not discovered
+	assert.Nil(t, PublishDiscovery("testha", models.Device{ID: "aa:bb"}))
+	assert.False(t, Discovered("testha", "aa:bb"))
+	assert.Nil(t, PublishState("testha", "aa:bb", "kitchen"))
+
+	assert.Nil(t, PublishDiscovery("testha", models.Device{ID: "zack", Name: "Zack's phone", Registered: true}))
+	sensor := next()
+	assert.Contains(t, sensor, "testha/homeassistant/sensor/find_testha_zack/config ")
+	assert.Contains(t, sensor, `"state_topic":"testha/state/zack"`)
+	assert.Contains(t, sensor, `"unique_id":"find_testha_zack_location"`)
+	assert.Contains(t, next(), "testha/homeassistant/device_tracker/find_testha_zack/config ")
+	assert.Nil(t, PublishState("testha", "zack", "kitchen"))
+	assert.Equal(t, "testha/state/zack kitchen", next())
+
+	// the devices of a deleted or renamed family are forgotten
+	ForgetDiscovery("testha2")
+	assert.True(t, Discovered("testha", "zack"))
+	ForgetDiscovery("testha")
+	assert.False(t, Discovered("testha", "zack"))
+	assert.Nil(t, PublishDiscovery("testha", models.Device{ID: "zack", Name: "Zack's phone", Registered: true}))
+	next()
+	next()
+
+	// ignoring the device removes its entities and state
+	assert.Nil(t, PublishDiscovery("testha", models.Device{ID: "zack", Registered: true, Ignore: true}))
+	removed := []string{next(), next(), next()}
+	assert.Contains(t, removed, "testha/state/zack ")
+	assert.Contains(t, removed, "testha/homeassistant/sensor/find_testha_zack/config ")
+	assert.Contains(t, removed, "testha/homeassistant/device_tracker/find_testha_zack/config ")
+	assert.Nil(t, PublishState("testha", "zack", "kitchen"))
+	select {
+	case m := <-messages:
+		t.Fatalf("unexpected message %s", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	broker.Lock()
+	assert.Equal(t, 0, len(broker.retained))
+	broker.Unlock()
+}
+
+func TestDiscoveryTopic(t *testing.T) {
+	assert.Equal(t, "testha/homeassistant/sensor/find_testha_zack/config", discoveryTopic("sensor", "testha", "zack"))
+	defer func() { DiscoveryPerFamily = true }()
+	// one Home Assistant discovers the devices of all families
+	DiscoveryPerFamily = false
+	assert.Equal(t, "homeassistant/sensor/find_testha_zack/config", discoveryTopic("sensor", "testha", "zack"))
 }
@@ -1,66 +1,392 @@
 package server
 
 import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/schollz/find4/server/main/src/api"
 	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/mqtt"
 )
 
-var (
-	DATABASES map[string]*database.Database
-)
+// DatabaseIdleTimeout is how long the database of a family stays open after
+// it was last used. Zero keeps databases open.
+var DatabaseIdleTimeout = 30 * time.Minute
 
-func OpenDatabase(family string) error {
+// databaseCloseTimeout is how long closing a database waits for its write queue
+const databaseCloseTimeout = 30 * time.Second
+
+// familyDatabase is the open database of a family, with its worker
+type familyDatabase struct {
+	db *database.Database
+	// stop stops the worker, which closes done when it returns
+	stop     chan struct{}
+	done     chan struct{}
+	lastUsed time.Time
+}
+
+// Databases are the open databases of the families. They are opened when
+// they are used, and closed once they have been idle for a while.
+type Databases struct {
+	families map[string]*familyDatabase
+	// reserved are the families whose databases are being closed, deleted
+	// or renamed, which are not opened until that is done
+	reserved map[string]chan struct{}
+	sync.Mutex
+}
+
+var databases Databases
+
+// FamilyInfo describes the database of a family
+type FamilyInfo struct {
+	Family     string    `json:"family"`
+	Open       bool      `json:"open"`
+	SizeBytes  int64     `json:"size_bytes"`
+	ModifiedAt time.Time `json:"modified_at"`
+	// LastUsed is when an open database was last used
+	LastUsed   *time.Time `json:"last_used,omitempty"`
+	Pending    int        `json:"pending_inserts"`
+	Websockets int        `json:"websockets"`
+	// Calibrating is whether a calibration is queued or running
+	Calibrating bool `json:"calibrating"`
+}
+
+// open opens the database of a family and starts its worker.
+// It must be called with the databases locked.
+func (self *Databases) open(family string) (*familyDatabase, error) {
 	db_conn, err := database.Open(family, false)
 	if nil != err {
-		return err
+		return nil, err
+	}
+	f := &familyDatabase{
+		db:       db_conn,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		lastUsed: time.Now(),
 	}
-	DATABASES[family] = db_conn
+	self.families[family] = f
 
 	// control for server shutdowns and crashs
 	// make sure calibration occurs on database startup
-	go api.DatabaseWorker(db_conn, family)
+	go func() {
+		defer close(f.done)
+		api.DatabaseWorker(db_conn, family, f.stop)
+	}()
+	return f, nil
+}
+
+// lockFamilies locks the databases once none of the families is reserved
+func (self *Databases) lockFamilies(families ...string) {
+	for {
+		self.Lock()
+		var released chan struct{}
+		for _, family := range families {
+			if r, ok := self.reserved[family]; ok {
+				released = r
+				break
+			}
+		}
+		if released == nil {
+			return
+		}
+		self.Unlock()
+		<-released
+	}
+}
+
+// reserve keeps the families from being opened until release is called,
+// so that their databases can be closed without holding the lock. It must
+// be called with the databases locked.
+func (self *Databases) reserve(families ...string) (release func()) {
+	released := make(chan struct{})
+	for _, family := range families {
+		self.reserved[family] = released
+	}
+	return func() {
+		self.Lock()
+		for _, family := range families {
+			delete(self.reserved, family)
+		}
+		self.Unlock()
+		close(released)
+	}
+}
+
+// detach removes the database of a family from the open ones, so that it
+// can be closed. It must be called with the databases locked.
+func (self *Databases) detach(family string) *familyDatabase {
+	f, ok := self.families[family]
+	if !ok {
+		return nil
+	}
+	delete(self.families, family)
+	return f
+}
 
-	return nil
+// close stops the worker of a family, writes its queue and closes its
+// database. It must be called without the databases locked, since it
+// waits for the queue.
+func (f *familyDatabase) close() (err error) {
+	if f == nil {
+		return
+	}
+	// the worker may be reading the database
+	close(f.stop)
+	<-f.done
+	ctx, cancel := context.WithTimeout(context.Background(), databaseCloseTimeout)
+	defer cancel()
+	err = f.db.Drain(ctx)
+	if err != nil {
+		logger.Error(err)
+	}
+	f.db.Close()
+	return
+}
+
+// snapshot returns the open databases
+func (self *Databases) snapshot() map[string]*database.Database {
+	self.Lock()
+	defer self.Unlock()
+	dbs := make(map[string]*database.Database)
+	for family, f := range self.families {
+		dbs[family] = f.db
+	}
+	return dbs
+}
+
+// closeIdle closes the databases that have not been used within the timeout,
+// unless they are calibrating
+func (self *Databases) closeIdle(timeout time.Duration) {
+	self.Lock()
+	idle := make(map[string]*familyDatabase)
+	for family, f := range self.families {
+		if time.Since(f.lastUsed) < timeout || api.CalibrationPending(family) {
+			continue
+		}
+		idle[family] = self.detach(family)
+	}
+	if len(idle) == 0 {
+		self.Unlock()
+		return
+	}
+	families := make([]string, 0, len(idle))
+	for family := range idle {
+		families = append(families, family)
+	}
+	release := self.reserve(families...)
+	self.Unlock()
+	defer release()
+
+	for family, f := range idle {
+		logger.Debugf("Closing idle %v database", family)
+		f.close()
+	}
+}
+
+// withClosedDatabase opens the database of a family that is not open for
+// a task, and closes it after. It returns false without running the task
+// if the family is open, or being closed, deleted or renamed.
+func withClosedDatabase(family string, task func(db *database.Database)) (ran bool, err error) {
+	databases.Lock()
+	_, open := databases.families[family]
+	_, reserved := databases.reserved[family]
+	if open || reserved {
+		databases.Unlock()
+		return
+	}
+	release := databases.reserve(family)
+	databases.Unlock()
+	defer release()
+
+	db, err := database.Open(family, true)
+	if err != nil {
+		return
+	}
+	task(db)
+	ctx, cancel := context.WithTimeout(context.Background(), databaseCloseTimeout)
+	defer cancel()
+	err = db.Drain(ctx)
+	db.Close()
+	return true, err
+}
+
+func OpenDatabase(family string) error {
+	databases.lockFamilies(family)
+	defer databases.Unlock()
+	if _, ok := databases.families[family]; ok {
+		return nil
+	}
+	_, err := databases.open(family)
+	return err
 }
 
 func GetDatabase(family string) (*database.Database, error) {
-	if _, ok := DATABASES[family]; !ok {
-		err := OpenDatabase(family)
-		return DATABASES[family], err
+	databases.lockFamilies(family)
+	defer databases.Unlock()
+	f, ok := databases.families[family]
+	if !ok {
+		var err error
+		f, err = databases.open(family)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return DATABASES[family], nil
+	f.lastUsed = time.Now()
+	return f.db, nil
 }
 
 func DeleteDatabase(family string) error {
-	db, err := GetDatabase(family)
-	if nil != err {
+	databases.lockFamilies(family)
+	if err := database.Exists(family); err != nil {
+		databases.Unlock()
+		return err
+	}
+	f := databases.detach(family)
+	release := databases.reserve(family)
+	databases.Unlock()
+	defer release()
+
+	f.close()
+	passive.remove(family)
+	forgetClustered(family)
+	mqtt.ForgetDiscovery(family)
+	if err := os.Remove(database.Filename(family)); err != nil {
 		return err
 	}
-	db.Delete()
-	DATABASES[family].Close()
-	delete(DATABASES, family)
-	return nil
+	return api.DeleteSalt(family)
+}
+
+// ListFamilies returns the families that have a database
+func ListFamilies() (families []FamilyInfo) {
+	websocketStats := GetWebsocketStats()
+	databases.Lock()
+	defer databases.Unlock()
+	names := database.GetFamilies()
+	sort.Strings(names)
+	families = []FamilyInfo{}
+	for _, family := range names {
+		info := FamilyInfo{
+			Family:      family,
+			Calibrating: api.CalibrationPending(family),
+		}
+		if stat, err := os.Stat(database.Filename(family)); err == nil {
+			info.SizeBytes = stat.Size()
+			info.ModifiedAt = stat.ModTime().UTC()
+		}
+		if f, ok := databases.families[family]; ok {
+			lastUsed := f.lastUsed.UTC()
+			info.Open = true
+			info.LastUsed = &lastUsed
+			info.Pending = f.db.GetPending()
+		}
+		if stats, ok := websocketStats[family]; ok {
+			info.Websockets = stats.Connected
+		}
+		families = append(families, info)
+	}
+	return
+}
+
+// RenameDatabase renames a family, with its database and models
+func RenameDatabase(from string, to string) (err error) {
+	from = strings.TrimSpace(from)
+	to = strings.TrimSpace(to)
+	if to == "" {
+		return errors.New("need a new name")
+	}
+	if api.CalibrationPending(from) {
+		return errors.Errorf("cannot rename '%s' while it is calibrating", from)
+	}
+	databases.lockFamilies(from, to)
+	if err = database.Exists(from); err != nil {
+		databases.Unlock()
+		return
+	}
+	if database.Exists(to) == nil {
+		databases.Unlock()
+		return errors.Errorf("family '%s' already exists", to)
+	}
+	f := databases.detach(from)
+	release := databases.reserve(from, to)
+	databases.Unlock()
+	defer release()
+
+	f.close()
+	// a calibration could be scheduled with the database that was open
+	// before it was reserved
+	if api.CalibrationPending(from) {
+		return errors.Errorf("cannot rename '%s' while it is calibrating", from)
+	}
+	passive.remove(from)
+	forgetClustered(from)
+	mqtt.ForgetDiscovery(from)
+	err = database.Rename(from, to)
+	if err != nil {
+		return
+	}
+	err = api.RenameModels(from, to)
+	if err != nil {
+		err = errors.Wrap(err, "renamed database, but not its models")
+		return
+	}
+	err = api.RenameSalt(from, to)
+	if err != nil {
+		err = errors.Wrap(err, "renamed database, but not its privacy salt")
+	}
+	return
+}
+
+// MergeDatabases copies the data of a family into another one, which is
+// then calibrated. The family that was merged is kept.
+func MergeDatabases(from string, into string) (merged map[string]int64, err error) {
+	from = strings.TrimSpace(from)
+	// write what is queued for the family before it is read
+	databases.Lock()
+	f, ok := databases.families[from]
+	databases.Unlock()
+	if ok {
+		ctx, cancel := context.WithTimeout(context.Background(), databaseCloseTimeout)
+		err = f.db.Drain(ctx)
+		cancel()
+	}
+	if err != nil {
+		return
+	}
+
+	if err = database.Exists(into); err != nil {
+		return
+	}
+	db, err := GetDatabase(into)
+	if err != nil {
+		return
+	}
+	merged, err = db.Merge(from)
+	if err != nil {
+		return
+	}
+	api.ScheduleCalibration(db, into)
+	return
 }
 
 func init() {
-	DATABASES = make(map[string]*database.Database)
+	databases.families = make(map[string]*familyDatabase)
+	databases.reserved = make(map[string]chan struct{})
 
 	// debugging goroutine to report database write queues
 	go func() {
 		for {
 			time.Sleep(10 * time.Second)
 
-			c := 0
-			for range DATABASES {
-				c++
-			}
-
-			if 0 != c {
-				logger.Debugf("%v active databases", c)
-				for family := range DATABASES {
-					pending := DATABASES[family].GetPending()
+			dbs := databases.snapshot()
+			if 0 != len(dbs) {
+				logger.Debugf("%v active databases", len(dbs))
+				for family, db := range dbs {
+					pending := db.GetPending()
 					if 0 != pending {
 						logger.Debugf("%v requests in %v queue", pending, family)
 					}
@@ -69,12 +395,32 @@ func init() {
 		}
 	}()
 
+	// close the databases that are not being used
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			if DatabaseIdleTimeout > 0 {
+				databases.closeIdle(DatabaseIdleTimeout)
+			}
+		}
+	}()
 }
 
 // Shutdown closes databases for a graceful shutdown
 func Shutdown() {
-	for family := range DATABASES {
+	databases.Lock()
+	open := make(map[string]*familyDatabase)
+	families := make([]string, 0, len(databases.families))
+	for family := range databases.families {
+		open[family] = databases.detach(family)
+		families = append(families, family)
+	}
+	release := databases.reserve(families...)
+	databases.Unlock()
+	defer release()
+
+	for family, f := range open {
 		logger.Warnf("Closing %v database", family)
-		DATABASES[family].Close()
+		f.close()
 	}
 }
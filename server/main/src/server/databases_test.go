@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatabases(t *testing.T) {
+	folder, err := ioutil.TempDir("", "databases")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	db, err := GetDatabase("testfamilies")
+	assert.Nil(t, err)
+	again, err := GetDatabase("testfamilies")
+	assert.Nil(t, err)
+	assert.True(t, db == again)
+
+	families := ListFamilies()
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, "testfamilies", families[0].Family)
+	assert.True(t, families[0].Open)
+
+	// the database is closed once it is idle, and opened again when it is used
+	databases.closeIdle(time.Hour)
+	assert.True(t, ListFamilies()[0].Open)
+	databases.closeIdle(0)
+	assert.False(t, ListFamilies()[0].Open)
+
+	// a family that is being closed is only opened once it is closed, and
+	// the other families are not held up by it
+	databases.Lock()
+	release := databases.reserve("testfamilies")
+	databases.Unlock()
+	opened := make(chan struct{})
+	go func() {
+		GetDatabase("testfamilies")
+		close(opened)
+	}()
+	other, err := GetDatabase("otherfamily")
+	assert.Nil(t, err)
+	assert.NotNil(t, other)
+	select {
+	case <-opened:
+		t.Error("opened a reserved family")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	<-opened
+	assert.Nil(t, DeleteDatabase("otherfamily"))
+	databases.closeIdle(0)
+
+	assert.Nil(t, RenameDatabase("testfamilies", "renamedfamily"))
+	assert.NotNil(t, RenameDatabase("testfamilies", "other"))
+	families = ListFamilies()
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, "renamedfamily", families[0].Family)
+	assert.False(t, families[0].Open)
+
+	assert.Nil(t, DeleteDatabase("renamedfamily"))
+	assert.Equal(t, 0, len(ListFamilies()))
+	assert.NotNil(t, DeleteDatabase("renamedfamily"))
+}
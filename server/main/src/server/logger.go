@@ -1,5 +1,5 @@
 package server
 
-import "github.com/sjsafranek/ligneous"
+import "github.com/schollz/find4/server/main/src/logging"
 
-var logger = ligneous.NewLogger()
+var logger = logging.New("server")
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/schollz/find4/server/main/src/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounter("find_http_requests_total",
+		"HTTP requests, by route and status code.", "method", "route", "code")
+	httpRequestSeconds = metrics.NewHistogram("find_http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by route.", metrics.DefaultBuckets, "method", "route")
+	databasePending = metrics.NewGauge("find_database_pending_inserts",
+		"Inserts waiting in the write queue of each family.", "family")
+	websocketClients = metrics.NewGauge("find_websocket_clients",
+		"Websockets that are connected to each family.", "family")
+)
+
+// routes are the routes of the server, used to label requests by route
+// instead of by path. They are set once all routes are registered.
+var routes gin.RoutesInfo
+
+func init() {
+	metrics.OnCollect(func() {
+		databasePending.Reset()
+		for family, db := range databases.snapshot() {
+			databasePending.Set(float64(db.GetPending()), family)
+		}
+		websocketClients.Reset()
+		for family, stats := range GetWebsocketStats() {
+			websocketClients.Set(float64(stats.Connected), family)
+		}
+	})
+}
+
+// observeRequest records the count and latency of a request
+func observeRequest(c *gin.Context, latency time.Duration) {
+	route := routeOf(c)
+	httpRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+	httpRequestSeconds.Observe(latency.Seconds(), c.Request.Method, route)
+}
+
+// routeOf returns the route that matched the request, such as
+// "/api/v1/location/:family/*device". Requests that did not match
+// any route are "unmatched", to keep the number of labels small.
+func routeOf(c *gin.Context) string {
+	path := c.Request.URL.Path
+	for _, route := range routes {
+		if route.Method != c.Request.Method || len(c.Params) != strings.Count(route.Path, ":")+strings.Count(route.Path, "*") {
+			continue
+		}
+		expanded := route.Path
+		for _, param := range c.Params {
+			if strings.Contains(expanded, "/*"+param.Key) {
+				expanded = strings.Replace(expanded, "/*"+param.Key, param.Value, 1)
+			} else {
+				expanded = strings.Replace(expanded, ":"+param.Key, param.Value, 1)
+			}
+		}
+		if expanded == path {
+			return route.Path
+		}
+	}
+	return "unmatched"
+}
+
+func handlerMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(200)
+	if err := metrics.Write(c.Writer); err != nil {
+		logger.Warn(err)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteOf(t *testing.T) {
+	var route string
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		route = routeOf(c)
+	})
+	router.GET("/api/v1/location/:family/*device", func(c *gin.Context) {})
+	router.GET("/api/v1/locations/:family", func(c *gin.Context) {})
+	router.POST("/api/v1/locations/:family", func(c *gin.Context) {})
+	routes = router.Routes()
+	defer func() { routes = nil }()
+
+	for path, expected := range map[string]string{
+		"/api/v1/location/testdb/wifi-aa:bb": "/api/v1/location/:family/*device",
+		"/api/v1/locations/testdb":           "/api/v1/locations/:family",
+		"/api/v1/nothing/testdb":             "unmatched",
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, expected, route, path)
+	}
+}
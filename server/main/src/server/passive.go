@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// PassiveFlushInterval is how often the passive windows that are over are
+// reversed into fingerprints
+var PassiveFlushInterval = 5 * time.Second
+
+// passiveSettingsKey is the key of the keystore with the passive settings
+const passiveSettingsKey = "ReverseRollingData"
+
+// passiveAggregators gather the passive scans of each family
+type passiveAggregators struct {
+	families map[string]*api.PassiveAggregator
+	// timestamps are the last timestamps of the reversed fingerprints of
+	// each family, which identify them and so are kept apart
+	timestamps map[string]int64
+	sync.Mutex
+}
+
+var passive = passiveAggregators{
+	families:   make(map[string]*api.PassiveAggregator),
+	timestamps: make(map[string]int64),
+}
+
+// get returns the aggregator of a family, with the settings of its database
+func (self *passiveAggregators) get(family string) (*api.PassiveAggregator, error) {
+	self.Lock()
+	aggregator, ok := self.families[family]
+	self.Unlock()
+	if ok {
+		return aggregator, nil
+	}
+
+	// the database is not opened while the aggregators are locked
+	db, err := GetDatabase(family)
+	if err != nil {
+		return nil, err
+	}
+	var rollingData models.ReverseRollingData
+	stored := db.Get(passiveSettingsKey, &rollingData) == nil
+	if !stored {
+		rollingData = models.ReverseRollingData{}
+	}
+	rollingData.Family = family
+	if rollingData.TimeBlock.Seconds() == 0 {
+		rollingData.TimeBlock = PassiveTimeBlock
+	}
+
+	self.Lock()
+	aggregator, ok = self.families[family]
+	if !ok {
+		aggregator = api.NewPassiveAggregator(rollingData)
+		self.families[family] = aggregator
+	}
+	self.Unlock()
+	// the analyses read the time block from the stored settings, so the
+	// defaults are stored for the families that did not save any
+	if !ok && !stored {
+		if err = saveSettings(family, aggregator.Settings()); err != nil {
+			return nil, err
+		}
+	}
+	return aggregator, nil
+}
+
+// remove forgets the aggregator of a family, with its buffered scans
+func (self *passiveAggregators) remove(family string) {
+	self.Lock()
+	delete(self.families, family)
+	delete(self.timestamps, family)
+	self.Unlock()
+}
+
+// timestamp returns a time in milliseconds, or a later one if a reversed
+// fingerprint of the family already has it
+func (self *passiveAggregators) timestamp(family string, timestamp int64) int64 {
+	self.Lock()
+	defer self.Unlock()
+	if timestamp <= self.timestamps[family] {
+		timestamp = self.timestamps[family] + 1
+	}
+	self.timestamps[family] = timestamp
+	return timestamp
+}
+
+// snapshot returns the aggregators
+func (self *passiveAggregators) snapshot() map[string]*api.PassiveAggregator {
+	self.Lock()
+	defer self.Unlock()
+	aggregators := make(map[string]*api.PassiveAggregator)
+	for family, aggregator := range self.families {
+		aggregators[family] = aggregator
+	}
+	return aggregators
+}
+
+// saveSettings stores the passive settings of a family, and waits for them
+// to be written so that they are kept if the server stops
+func saveSettings(family string, settings models.ReverseRollingData) (err error) {
+	db, err := GetDatabase(family)
+	if err != nil {
+		return
+	}
+	err = db.Set(passiveSettingsKey, settings)
+	if err != nil {
+		err = errors.Wrap(err, "could not save passive settings")
+		return
+	}
+	db.Sync()
+	return
+}
+
+// processPassiveData adds the passive scan of a scanner to the aggregator
+// of its family, which reverses it once its windows are over
+func processPassiveData(d models.SensorData) (message string, err error) {
+	if d.Location != "" {
+		logger.Debugf("[%s] entered passive fingerprint for %s at %s", d.Family, d.Device, d.Location)
+	} else {
+		logger.Debugf("[%s] entered passive fingerprint for %s", d.Family, d.Device)
+	}
+	if len(d.Sensors) == 0 {
+		err = errors.New("no fingerprints")
+		return
+	}
+
+	aggregator, err := passive.get(d.Family)
+	if err != nil {
+		return
+	}
+	db, err := GetDatabase(d.Family)
+	if err != nil {
+		return
+	}
+	// in privacy mode the MACs are never kept
+	d, err = api.Anonymize(db, d, aggregator.Settings().DeviceLocation)
+	if err != nil {
+		err = errors.Wrap(err, "could not anonymize passive data")
+		return
+	}
+	timeBlock := aggregator.Add(d)
+	numFingerprints := 0
+	for sensor := range d.Sensors {
+		numFingerprints += len(d.Sensors[sensor])
+	}
+	message = fmt.Sprintf("inserted %d fingerprints for %s", numFingerprints, d.Family)
+
+	db.CheckInScanner(d.Device, d.Version, numFingerprints, time.Now(), timeBlock)
+	return
+}
+
+// FlushPassive reverses the passive windows of every family that are over
+// by now, for when the server stops and no later scans arrive
+func FlushPassive() {
+	flushPassive(time.Now().UTC().UnixNano() / int64(time.Millisecond))
+}
+
+// flushPassive reverses the passive windows of every family that are over
+// by their scans or by until, each family at the same time as the others
+func flushPassive(until int64) {
+	var wg sync.WaitGroup
+	for family, aggregator := range passive.snapshot() {
+		wg.Add(1)
+		go func(family string, aggregator *api.PassiveAggregator) {
+			defer wg.Done()
+			windows, settings := aggregator.Flush(until)
+			for _, window := range windows {
+				saveWindow(family, window, settings)
+			}
+		}(family, aggregator)
+	}
+	wg.Wait()
+}
+
+// saveWindow saves the reversed fingerprints of a passive window, at the
+// end of the window so that they are in the order of the scans
+func saveWindow(family string, window api.PassiveWindow, settings models.ReverseRollingData) {
+	logger.Debugf("[%s] reversing passive window of %s", family, time.Duration(window.End-window.Start)*time.Millisecond)
+	for _, d := range window.Datas {
+		numPassivePoints := 0
+		for sensorType := range d.Sensors {
+			numPassivePoints += len(d.Sensors[sensorType])
+		}
+		if numPassivePoints < settings.MinimumPassive {
+			logger.Debugf("[%s] skipped saving reverse sensor data for %s, not enough points (< %d)", family, d.Device, settings.MinimumPassive)
+			continue
+		}
+		d.Timestamp = passive.timestamp(family, window.End)
+		logger.Debugf("[%s] reverse sensor data: %+v", family, d)
+		err := processSensorData(d)
+		if err != nil {
+			logger.Warnf("[%s] problem saving: %s", family, err.Error())
+			continue
+		}
+		logger.Debugf("[%s] saved reverse sensor data for %s", family, d.Device)
+	}
+}
+
+func init() {
+	go func() {
+		for {
+			time.Sleep(PassiveFlushInterval)
+			flushPassive(0)
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassiveData(t *testing.T) {
+	folder, err := ioutil.TempDir("", "passive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+	defer DeleteDatabase("testpassive")
+
+	// concurrent scans are all kept
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := processPassiveData(models.SensorData{
+				Family:    "testpassive",
+				Device:    "pi1",
+				Timestamp: 1000,
+				Sensors:   map[string]map[string]interface{}{"wifi": {"aa:bb": -50}},
+			})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	aggregator, err := passive.get("testpassive")
+	assert.Nil(t, err)
+	assert.Equal(t, 20, aggregator.Pending())
+	assert.Equal(t, PassiveTimeBlock, aggregator.Settings().TimeBlock)
+
+	// the default settings are stored for the analyses
+	db, err := GetDatabase("testpassive")
+	assert.Nil(t, err)
+	var stored models.ReverseRollingData
+	assert.Nil(t, db.Get(passiveSettingsKey, &stored))
+	assert.Equal(t, PassiveTimeBlock, stored.TimeBlock)
+
+	// only the settings are stored
+	settings := aggregator.Update(func(settings *models.ReverseRollingData) {
+		settings.TimeBlock = time.Minute
+		settings.DeviceLocation["wifi-aa:bb"] = "kitchen"
+	})
+	assert.Nil(t, saveSettings("testpassive", settings))
+	stored = models.ReverseRollingData{}
+	assert.Nil(t, db.Get(passiveSettingsKey, &stored))
+	assert.Equal(t, 0, len(stored.Datas))
+	assert.Equal(t, time.Minute, stored.TimeBlock)
+	assert.Equal(t, "kitchen", stored.DeviceLocation["wifi-aa:bb"])
+
+	// the settings are loaded again, without the scans
+	passive.remove("testpassive")
+	aggregator, err = passive.get("testpassive")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, aggregator.Pending())
+	assert.Equal(t, time.Minute, aggregator.Settings().TimeBlock)
+
+	// the reversed fingerprints have their own timestamps
+	assert.Equal(t, int64(5000), passive.timestamp("testpassive", 5000))
+	assert.Equal(t, int64(5001), passive.timestamp("testpassive", 5000))
+
+	// they are saved at the end of their window, not when it is flushed
+	saveWindow("testpassive", api.PassiveWindow{Start: 60000, End: 120000, Datas: []models.SensorData{{
+		Family:  "testpassive",
+		Device:  "wifi-aa:bb",
+		Sensors: map[string]map[string]interface{}{"wifi": {"pi1": -50}},
+	}}}, settings)
+	db.Sync()
+	datas, err := db.GetSensorsSince(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(datas))
+	assert.Equal(t, int64(120000), datas[0].Timestamp)
+}
+
+func TestPassivePrivacy(t *testing.T) {
+	folder, err := ioutil.TempDir("", "passive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+	defer DeleteDatabase("testprivacy")
+
+	db, err := GetDatabase("testprivacy")
+	assert.Nil(t, err)
+	_, err = api.SetPrivacy(db, true, 0, 0)
+	assert.Nil(t, err)
+	_, err = processPassiveData(models.SensorData{
+		Family:    "testprivacy",
+		Device:    "pi1",
+		Timestamp: 1000,
+		Sensors:   map[string]map[string]interface{}{"wifi": {"aa:bb:cc:dd:ee:ff": -50}},
+	})
+	assert.Nil(t, err)
+
+	// the MAC is not kept in the buffered scans
+	aggregator, err := passive.get("testprivacy")
+	assert.Nil(t, err)
+	aggregator.Add(models.SensorData{Family: "testprivacy", Device: "pi1", Timestamp: 200000, Sensors: map[string]map[string]interface{}{"wifi": {"11:22:33:44:55:66": -50}}})
+	windows, _ := aggregator.Flush(0)
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, 1, len(windows[0].Datas))
+	assert.True(t, strings.HasPrefix(windows[0].Datas[0].Device, "wifi-hash-"))
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// PrivacyCheckInterval is how often the fingerprints of hashed devices
+// are checked for expiry
+var PrivacyCheckInterval = time.Minute
+
+// privacyResponse shows the privacy mode of a family without its salt
+func privacyResponse(privacy models.Privacy) gin.H {
+	return gin.H{
+		"enabled":   privacy.Enabled,
+		"retention": int64(privacy.Retention.Seconds()),
+		"rotation":  int64(privacy.Rotation.Seconds()),
+	}
+}
+
+func handlerApiV1Privacy(c *gin.Context) {
+	privacy, err := func(c *gin.Context) (privacy models.Privacy, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		privacy = api.GetPrivacy(db)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got privacy mode", "success": true, "privacy": privacyResponse(privacy)})
+	}
+}
+
+func handlerApiV1SetPrivacy(c *gin.Context) {
+	privacy, err := func(c *gin.Context) (privacy models.Privacy, err error) {
+		// the retention and rotation are in seconds
+		var p struct {
+			Enabled   bool  `json:"enabled"`
+			Retention int64 `json:"retention"`
+			Rotation  int64 `json:"rotation"`
+		}
+		err = c.BindJSON(&p)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		privacy, err = api.SetPrivacy(db, p.Enabled, time.Duration(p.Retention)*time.Second, time.Duration(p.Rotation)*time.Second)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "saved privacy mode", "success": true, "privacy": privacyResponse(privacy)})
+	}
+}
+
+// closedExpiry is when the next fingerprint of a hashed device of a closed
+// family expires, and when its database was modified as of then
+type closedExpiry struct {
+	next     time.Time
+	modified time.Time
+}
+
+// privateExpiry remembers the expiry of the closed families, so that they
+// are only opened once a fingerprint expires or they were modified
+var privateExpiry = struct {
+	closed map[string]closedExpiry
+	sync.Mutex
+}{closed: make(map[string]closedExpiry)}
+
+// expirePrivate deletes the fingerprints of the hashed devices that are
+// older than the retention of their family, for the open families and
+// the closed ones
+func expirePrivate() {
+	privateExpiry.Lock()
+	defer privateExpiry.Unlock()
+	open := databases.snapshot()
+	for family, db := range open {
+		expireFamily(family, db)
+	}
+
+	closed := make(map[string]closedExpiry)
+	for _, family := range database.GetFamilies() {
+		if _, ok := open[family]; ok {
+			continue
+		}
+		stat, err := os.Stat(database.Filename(family))
+		if err != nil {
+			continue
+		}
+		expiry, ok := privateExpiry.closed[family]
+		if ok && expiry.modified.Equal(stat.ModTime()) && (expiry.next.IsZero() || time.Now().Before(expiry.next)) {
+			closed[family] = expiry
+			continue
+		}
+		ran, err := withClosedDatabase(family, func(db *database.Database) {
+			expireFamily(family, db)
+			var errNext error
+			expiry.next, errNext = api.NextPrivateExpiry(db)
+			if errNext != nil {
+				logger.WithFamily(family).Warn(errNext)
+			}
+		})
+		if err != nil {
+			logger.WithFamily(family).Warn(err)
+			continue
+		}
+		if !ran {
+			continue
+		}
+		if stat, err = os.Stat(database.Filename(family)); err == nil {
+			expiry.modified = stat.ModTime()
+			closed[family] = expiry
+		}
+	}
+	privateExpiry.closed = closed
+}
+
+// expireFamily deletes the expired fingerprints of the hashed devices of
+// a family
+func expireFamily(family string, db *database.Database) {
+	deleted, err := api.ExpirePrivate(db)
+	if err != nil {
+		logger.WithFamily(family).Warn(err)
+		return
+	}
+	if deleted > 0 {
+		logger.WithFamily(family).Infof("deleted %d expired fingerprints of hashed devices", deleted)
+	}
+}
+
+func init() {
+	go func() {
+		for {
+			time.Sleep(PrivacyCheckInterval)
+			expirePrivate()
+		}
+	}()
+}
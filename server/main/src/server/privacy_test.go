@@ -0,0 +1,48 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpirePrivateClosed(t *testing.T) {
+	folder, err := ioutil.TempDir("", "privacy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	db, err := GetDatabase("testprivacy")
+	assert.Nil(t, err)
+	_, err = api.SetPrivacy(db, true, time.Hour, 0)
+	assert.Nil(t, err)
+	old := time.Now().Add(-2 * time.Hour)
+	db.AddPrivateDevices([]models.PrivateDevice{{ID: "wifi-hash-0000000000000001", LastSeen: old}})
+	assert.Nil(t, db.AddSensor(models.SensorData{
+		Timestamp: old.UnixNano() / int64(time.Millisecond),
+		Family:    "testprivacy",
+		Device:    "wifi-hash-0000000000000001",
+		Sensors:   map[string]map[string]interface{}{"wifi": {"pi1-wifi": -50}},
+	}))
+	db.Sync()
+
+	// the fingerprints of a closed family expire without keeping it open
+	databases.closeIdle(0)
+	expirePrivate()
+	assert.False(t, ListFamilies()[0].Open)
+	assert.True(t, privateExpiry.closed["testprivacy"].next.IsZero())
+
+	db, err = GetDatabase("testprivacy")
+	assert.Nil(t, err)
+	datas, err := db.GetSensorsSince(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(datas))
+	assert.Nil(t, DeleteDatabase("testprivacy"))
+}
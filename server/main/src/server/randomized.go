@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/api"
+)
+
+// RandomizedClusterInterval is how often the randomized MACs are clustered
+// into pseudo devices
+var RandomizedClusterInterval = time.Minute
+
+// clustered is the last fingerprint of each family whose randomized MACs
+// were clustered, so that families without new fingerprints are skipped
+var clustered = struct {
+	last map[string]int64
+	sync.Mutex
+}{last: make(map[string]int64)}
+
+// clusterRandomized clusters the randomized MACs of the open databases
+// that got fingerprints since they were last clustered
+func clusterRandomized() {
+	for family, db := range databases.snapshot() {
+		last, err := db.GetLastSensorTimestamp()
+		if err != nil {
+			continue
+		}
+		clustered.Lock()
+		done := clustered.last[family] == last
+		clustered.Unlock()
+		if done {
+			continue
+		}
+		last, err = api.ClusterRecentRandomized(db)
+		if err != nil {
+			logger.WithFamily(family).Warn(err)
+			continue
+		}
+		clustered.Lock()
+		clustered.last[family] = last
+		clustered.Unlock()
+	}
+}
+
+// forgetClustered forgets when the randomized MACs of a family were
+// clustered, once its database is deleted or renamed
+func forgetClustered(family string) {
+	clustered.Lock()
+	delete(clustered.last, family)
+	clustered.Unlock()
+}
+
+func init() {
+	go func() {
+		for {
+			time.Sleep(RandomizedClusterInterval)
+			clusterRandomized()
+		}
+	}()
+}
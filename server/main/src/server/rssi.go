@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+func handlerApiV1RSSI(c *gin.Context) {
+	calibrations, beacons, err := func(c *gin.Context) (calibrations []models.RSSICalibration, beacons []models.ReferenceBeacon, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		byDevice, err := db.GetRSSICalibrations()
+		if err != nil {
+			return
+		}
+		calibrations = []models.RSSICalibration{}
+		for _, calibration := range byDevice {
+			calibrations = append(calibrations, calibration)
+		}
+		sort.Slice(calibrations, func(i, j int) bool {
+			return calibrations[i].Device < calibrations[j].Device
+		})
+		beacons, err = db.GetReferenceBeacons()
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got RSSI calibrations", "success": true, "calibrations": calibrations, "beacons": beacons})
+	}
+}
+
+func handlerApiV1SetRSSICalibration(c *gin.Context) {
+	calibration, err := func(c *gin.Context) (calibration models.RSSICalibration, err error) {
+		err = c.BindJSON(&calibration)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		calibration.Device = c.Param("device")
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		if err = api.SetRSSICalibration(db, strings.TrimSpace(c.Param("family")), calibration); err != nil {
+			return
+		}
+		calibrations, err := db.GetRSSICalibrations()
+		calibration = calibrations[strings.TrimSpace(strings.ToLower(calibration.Device))]
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "saved RSSI calibration", "success": true, "calibration": calibration})
+	}
+}
+
+func handlerApiV1DeleteRSSICalibration(c *gin.Context) {
+	err := func(c *gin.Context) (err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		err = api.DeleteRSSICalibration(db, strings.TrimSpace(c.Param("family")), c.Param("device"))
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "deleted RSSI calibration of " + c.Param("device"), "success": true})
+	}
+}
+
+func handlerApiV1SetReferenceBeacon(c *gin.Context) {
+	beacon, err := func(c *gin.Context) (beacon models.ReferenceBeacon, err error) {
+		err = c.BindJSON(&beacon)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		beacon.Device = c.Param("device")
+		if err = beacon.Validate(); err != nil {
+			return
+		}
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		err = db.SetReferenceBeacon(beacon)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "saved reference beacon", "success": true, "beacon": beacon})
+	}
+}
+
+func handlerApiV1DeleteReferenceBeacon(c *gin.Context) {
+	err := func(c *gin.Context) (err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		err = db.DeleteReferenceBeacon(strings.TrimSpace(strings.ToLower(c.Param("device"))))
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "deleted reference beacon " + c.Param("device"), "success": true})
+	}
+}
+
+func handlerApiV1LearnRSSI(c *gin.Context) {
+	learned, err := func(c *gin.Context) (learned []models.RSSICalibration, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		learned, err = api.LearnRSSICalibrations(db, strings.TrimSpace(c.Param("family")))
+		if learned == nil {
+			learned = []models.RSSICalibration{}
+		}
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "learned RSSI calibrations", "success": true, "calibrations": learned})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/models"
+)
+
+// ScannerCheckInterval is how often the scanners are checked for silence
+var ScannerCheckInterval = time.Minute
+
+func handlerApiV1Scanners(c *gin.Context) {
+	scanners, err := func(c *gin.Context) (scanners []models.Scanner, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		scanners, err = api.GetScanners(db)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got scanners", "success": true, "scanners": scanners, "timeout": api.ScannerTimeout.String()})
+	}
+}
+
+func handlerApiV1SetScanner(c *gin.Context) {
+	scanner, err := func(c *gin.Context) (scanner models.Scanner, err error) {
+		err = c.BindJSON(&scanner)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		scanner.ID = c.Param("scanner")
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		scanner, err = api.SetScanner(db, scanner)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "saved scanner", "success": true, "scanner": scanner})
+	}
+}
+
+func handlerApiV1DeleteScanner(c *gin.Context) {
+	err := func(c *gin.Context) (err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		err = db.DeleteScanner(strings.TrimSpace(strings.ToLower(c.Param("scanner"))))
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "deleted scanner " + c.Param("scanner"), "success": true})
+	}
+}
+
+// checkScanners alerts the websockets of the families whose scanners went
+// silent or came back
+func checkScanners() {
+	for family, db := range databases.snapshot() {
+		changed, err := api.CheckScanners(db)
+		if err != nil {
+			logger.WithFamily(family).Warn(err)
+			continue
+		}
+		for _, s := range changed {
+			if s.Silent {
+				logger.WithFamily(family).Warnf("scanner %s is silent, last seen %s", s.ID, s.LastSeen.Format(time.RFC3339))
+			} else {
+				logger.WithFamily(family).Infof("scanner %s is back", s.ID)
+			}
+			sendOutScanner(family, s)
+		}
+	}
+}
+
+// sendOutScanner notifies the family's websockets that a scanner went silent or came back
+func sendOutScanner(family string, s models.Scanner) {
+	type Payload struct {
+		Type    string         `json:"type"`
+		Scanner models.Scanner `json:"scanner"`
+	}
+	bTarget, err := json.Marshal(Payload{Type: "scanner", Scanner: s})
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	SendMessageOverWebsockets(family, "all", bTarget)
+}
+
+func init() {
+	go func() {
+		for {
+			time.Sleep(ScannerCheckInterval)
+			checkScanners()
+		}
+	}()
+}
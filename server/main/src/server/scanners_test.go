@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckScanners(t *testing.T) {
+	folder, err := ioutil.TempDir("", "scanners")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+	defer DeleteDatabase("testscanners")
+
+	db, err := GetDatabase("testscanners")
+	assert.Nil(t, err)
+	_, err = processPassiveData(models.SensorData{
+		Family:  "testscanners",
+		Device:  "pi1",
+		Version: "v1.2",
+		Sensors: map[string]map[string]interface{}{"wifi": {"aa:bb": -50, "cc:dd": -60}},
+	})
+	assert.Nil(t, err)
+	db.CheckInScanner("pi2", "", 1, time.Now().Add(-time.Hour), time.Minute)
+	db.Sync()
+
+	scanners, err := api.GetScanners(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scanners))
+	assert.Equal(t, "v1.2", scanners[0].Version)
+	assert.Equal(t, int64(2), scanners[0].WindowFingerprints)
+	assert.False(t, scanners[0].Silent)
+	assert.True(t, scanners[1].Silent)
+
+	// silent scanners are alerted once
+	checkScanners()
+	changed, err := api.CheckScanners(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changed))
+	s, err := db.GetScanner("pi2")
+	assert.Nil(t, err)
+	assert.True(t, s.Silent)
+
+	// and again when they are back
+	db.CheckInScanner("pi2", "", 1, time.Now(), time.Minute)
+	db.Sync()
+	changed, err = api.CheckScanners(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changed))
+	assert.False(t, changed[0].Silent)
+}
@@ -14,9 +14,11 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/config"
 	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/logging"
 	"github.com/schollz/find4/server/main/src/models"
-	// "github.com/schollz/find4/server/main/src/mqtt"
+	"github.com/schollz/find4/server/main/src/mqtt"
 	"github.com/schollz/utils"
 )
 
@@ -26,28 +28,46 @@ var UseSSL = false
 var UseMQTT = false
 var MinimumPassive = -1
 
+// PassiveTimeBlock is the default window to gather passive scans in
+var PassiveTimeBlock = 90 * time.Second
+
+// errIgnored is why the devices that are ignored in the registry are not sent out
+var errIgnored = errors.New("device is ignored")
+
 // Run will start the server listening on the specified port
 func Run() (err error) {
 	defer logger.Flush()
 
-	// if UseMQTT {
-	// 	// setup MQTT
-	// 	err = mqtt.Setup()
-	// 	if err != nil {
-	// 		logger.Warn(err)
-	// 	}
-	// 	logger.Debug("setup mqtt")
-	// }
+	if UseMQTT {
+		// setup MQTT, its fingerprints are processed like the ones sent over HTTP
+		mqtt.ProcessSensorData = func(d models.SensorData) error {
+			return processSensorData(d)
+		}
+		mqtt.ProcessPassiveData = func(d models.SensorData) error {
+			_, err := processPassiveData(d)
+			return err
+		}
+		mqtt.ClassifySensorData = classifySensorData
+		mqtt.GetDatabase = GetDatabase
+		err = mqtt.Setup()
+		if err != nil {
+			logger.Warn(err)
+		}
+		logger.Debug("setup mqtt")
+	}
 
 	logger.Debug("current families: ", database.GetFamilies())
 
+	// notify websockets when calibrations finish
+	api.OnCalibrationJobDone = sendOutCalibration
+
 	// setup gin server
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	// Standardize logs
 	r.LoadHTMLGlob("templates/*")
 	r.Static("/static", "./static")
-	r.Use(middleWareHandler(), gin.Recovery(), gzip.Gzip(gzip.DefaultCompression))
+	r.Use(middleWareHandler(), gin.Recovery(), gzipUnlessStreaming(gzip.DefaultCompression))
 	// r.Use(middleWareHandler(), gin.Recovery())
 	r.HEAD("/", func(c *gin.Context) { // handler for the uptime robot
 		c.String(http.StatusOK, "OK")
@@ -70,6 +90,9 @@ func Run() (err error) {
 
 	})
 	r.DELETE("/api/v1/database/:family", func(c *gin.Context) {
+		if UseMQTT {
+			removeDiscovery(c.Param("family"))
+		}
 		err := DeleteDatabase(c.Param("family"))
 		if err == nil {
 			c.JSON(200, gin.H{"success": true, "message": "deleted " + c.Param("family")})
@@ -81,9 +104,10 @@ func Run() (err error) {
 	r.DELETE("/api/v1/location/:family/:location", func(c *gin.Context) {
 		db, err := GetDatabase(c.Param("family"))
 		if err == nil {
-			err = db.DeleteLocation(c.Param("location"))
+			var affected int64
+			affected, err = api.DeleteLocation(db, c.Param("family"), c.Param("location"), c.ClientIP())
 			if err == nil {
-				c.JSON(200, gin.H{"success": true, "message": "deleted location '" + c.Param("location") + "' for " + c.Param("family")})
+				c.JSON(200, gin.H{"success": true, "message": "deleted location '" + c.Param("location") + "' for " + c.Param("family"), "affected": affected})
 				return
 			}
 		}
@@ -125,6 +149,7 @@ func Run() (err error) {
 		}
 		type DeviceTable struct {
 			ID           string
+			Device       string
 			Name         string
 			LastLocation string
 			LastSeen     time.Time
@@ -216,7 +241,7 @@ func Run() (err error) {
 			// }
 
 			// DEBUGING
-			calibration, err := db.GetCalibration()
+			calibration, err := db.GetActiveCalibration()
 			if err != nil {
 				logger.Warn("could not get calibration")
 			}
@@ -280,7 +305,7 @@ func Run() (err error) {
 			}
 
 			logger.Debugf("[%s] getting by_locations", family)
-			byLocations, err := api.GetByLocation(db, family, 15, false, 3, 0, 0, deviceCounts)
+			byLocations, err := api.GetByLocation(db, family, 15, false, 3, 0, 0, "", deviceCounts)
 			if err != nil {
 				logger.Warn(err)
 			}
@@ -289,9 +314,14 @@ func Run() (err error) {
 			table := []DeviceTable{}
 			for _, byLocation := range byLocations {
 				for _, device := range byLocation.Devices {
+					name := device.Name
+					if name == "" {
+						name = device.Device
+					}
 					table = append(table, DeviceTable{
 						ID:           utils.Hash(device.Device),
-						Name:         device.Device,
+						Device:       device.Device,
+						Name:         name,
 						LastLocation: byLocation.Location,
 						LastSeen:     device.Timestamp,
 						Probability:  int64(device.Probability * 100),
@@ -352,25 +382,108 @@ func Run() (err error) {
 	r.GET("/api/v1/by_location/:family", handlerApiV1ByLocation)
 	r.OPTIONS("/api/v1/calibrate/*family", func(c *gin.Context) { c.String(200, "OK") })
 	r.GET("/api/v1/calibrate/*family", handlerApiV1Calibrate)
+	r.OPTIONS("/api/v1/calibrations/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/calibrations/:family", handlerApiV1Calibrations)
+	r.OPTIONS("/api/v1/calibrations/:family/diff", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/calibrations/:family/diff", handlerApiV1CalibrationsDiff)
+	r.OPTIONS("/api/v1/calibrations/:family/jobs", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/calibrations/:family/jobs", handlerApiV1CalibrationJobs)
+	r.OPTIONS("/api/v1/calibrations/:family/jobs/:id", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/calibrations/:family/jobs/:id", handlerApiV1CalibrationJob)
+	r.OPTIONS("/api/v1/fingerprints/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.DELETE("/api/v1/fingerprints/:family", handlerApiV1FingerprintsDelete)
+	r.OPTIONS("/api/v1/fingerprints/:family/relabel", func(c *gin.Context) { c.String(200, "OK") })
+	r.POST("/api/v1/fingerprints/:family/relabel", handlerApiV1FingerprintsRelabel)
+	r.OPTIONS("/api/v1/audit/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/audit/:family", handlerApiV1Audit)
+	r.OPTIONS("/api/v1/registry/:family/locations", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/registry/:family/locations", handlerApiV1RegistryLocations)
+	r.OPTIONS("/api/v1/registry/:family/locations/:location", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/registry/:family/locations/:location", handlerApiV1RegistryLocation)
+	r.PUT("/api/v1/registry/:family/locations/:location", handlerApiV1RegistrySetLocation)
+	r.DELETE("/api/v1/registry/:family/locations/:location", handlerApiV1RegistryDeleteLocation)
+	r.OPTIONS("/api/v1/registry/:family/locations/:location/rename", func(c *gin.Context) { c.String(200, "OK") })
+	r.POST("/api/v1/registry/:family/locations/:location/rename", handlerApiV1RegistryRenameLocation)
+	r.OPTIONS("/api/v1/registry/:family/devices", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/registry/:family/devices", handlerApiV1RegistryDevices)
+	r.OPTIONS("/api/v1/registry/:family/devices/:device", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/registry/:family/devices/:device", handlerApiV1RegistryDevice)
+	r.PUT("/api/v1/registry/:family/devices/:device", handlerApiV1RegistrySetDevice)
+	r.DELETE("/api/v1/registry/:family/devices/:device", handlerApiV1RegistryDeleteDevice)
+	r.OPTIONS("/api/v1/scanners/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/scanners/:family", handlerApiV1Scanners)
+	r.OPTIONS("/api/v1/scanners/:family/:scanner", func(c *gin.Context) { c.String(200, "OK") })
+	r.PUT("/api/v1/scanners/:family/:scanner", handlerApiV1SetScanner)
+	r.DELETE("/api/v1/scanners/:family/:scanner", handlerApiV1DeleteScanner)
+	r.OPTIONS("/api/v1/rssi/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/rssi/:family", handlerApiV1RSSI)
+	r.OPTIONS("/api/v1/rssi/:family/calibrations/:device", func(c *gin.Context) { c.String(200, "OK") })
+	r.PUT("/api/v1/rssi/:family/calibrations/:device", handlerApiV1SetRSSICalibration)
+	r.DELETE("/api/v1/rssi/:family/calibrations/:device", handlerApiV1DeleteRSSICalibration)
+	r.OPTIONS("/api/v1/rssi/:family/beacons/:device", func(c *gin.Context) { c.String(200, "OK") })
+	r.PUT("/api/v1/rssi/:family/beacons/:device", handlerApiV1SetReferenceBeacon)
+	r.DELETE("/api/v1/rssi/:family/beacons/:device", handlerApiV1DeleteReferenceBeacon)
+	r.OPTIONS("/api/v1/rssi/:family/learn", func(c *gin.Context) { c.String(200, "OK") })
+	r.POST("/api/v1/rssi/:family/learn", handlerApiV1LearnRSSI)
+	r.OPTIONS("/api/v1/privacy/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/privacy/:family", handlerApiV1Privacy)
+	r.PUT("/api/v1/privacy/:family", handlerApiV1SetPrivacy)
+	r.OPTIONS("/api/v1/models/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/models/:family", handlerApiV1Models)
+	r.OPTIONS("/api/v1/models/:family/rollback/:id", func(c *gin.Context) { c.String(200, "OK") })
+	r.POST("/api/v1/models/:family/rollback/:id", handlerApiV1ModelsRollback)
+	r.OPTIONS("/api/v1/models/:family/pin", func(c *gin.Context) { c.String(200, "OK") })
+	r.DELETE("/api/v1/models/:family/pin", handlerApiV1ModelsUnpin)
+	r.OPTIONS("/api/v1/models/:family/pin/:id", func(c *gin.Context) { c.String(200, "OK") })
+	r.POST("/api/v1/models/:family/pin/:id", handlerApiV1ModelsPin)
 	r.OPTIONS("/api/v1/settings/passive", func(c *gin.Context) { c.String(200, "OK") })
 	r.POST("/api/v1/settings/passive", handlerReverseSettings)
 	r.OPTIONS("/api/v1/efficacy/:family", func(c *gin.Context) { c.String(200, "OK") })
 	r.GET("/api/v1/efficacy/:family", handlerEfficacy)
 	r.GET("/ping", ping)
+	r.GET("/metrics", handlerMetrics) // prometheus metrics (see metrics.go)
 	r.GET("/now", handlerNow)
 	r.GET("/test", handleTest)
-	r.GET("/ws", wshandler) // handler for the web sockets (see websockets.go)
-	// if UseMQTT {
-	// 	r.GET("/api/v1/mqtt/:family", handlerMQTT) // handler for setting MQTT
-	// }
+	r.OPTIONS("/api/v1/admin/logging", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/admin/logging", handlerApiV1AdminLogging)
+	r.PUT("/api/v1/admin/logging", handlerApiV1AdminSetLogging)
+	r.OPTIONS("/api/v1/admin/logging/:family", func(c *gin.Context) { c.String(200, "OK") })
+	r.PUT("/api/v1/admin/logging/:family", handlerApiV1AdminSetLogging)
+	r.DELETE("/api/v1/admin/logging/:family", handlerApiV1AdminResetLogging)
+	r.OPTIONS("/api/v1/admin/config", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/admin/config", handlerApiV1AdminConfig)
+	r.OPTIONS("/api/v1/admin/families", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/admin/families", handlerApiV1AdminFamilies)
+	r.OPTIONS("/api/v1/admin/families/:family/rename", func(c *gin.Context) { c.String(200, "OK") })
+	r.POST("/api/v1/admin/families/:family/rename", handlerApiV1AdminRenameFamily)
+	r.OPTIONS("/api/v1/admin/families/:family/merge", func(c *gin.Context) { c.String(200, "OK") })
+	r.POST("/api/v1/admin/families/:family/merge", handlerApiV1AdminMergeFamily)
+	r.OPTIONS("/api/v1/websockets", func(c *gin.Context) { c.String(200, "OK") })
+	r.GET("/api/v1/websockets", handlerApiV1Websockets)
+	r.GET("/ws", wshandler)                             // handler for the web sockets (see websockets.go)
+	r.GET("/api/v1/stream/:family", handlerApiV1Stream) // handler for server-sent events (see stream.go)
+	if UseMQTT {
+		r.GET("/api/v1/mqtt/:family", handlerMQTT) // handler for setting MQTT
+	}
 	r.POST("/data", handlerData)             // typical data handler
 	r.POST("/classify", handlerDataClassify) // classify a fingerprint
 	r.POST("/passive", handlerReverse)       // typical data handler
 	r.POST("/learn", handlerFIND)            // backwards-compatible with FIND for learning
 	r.POST("/track", handlerFIND)            // backwards-compatible with FIND for tracking
+	routes = r.Routes()
 	logger.Infof("Running on 0.0.0.0:%s", Port)
 
-	err = r.Run(":" + Port) // listen and serve on 0.0.0.0:8080
+	srv := &http.Server{Addr: ":" + Port, Handler: r}
+	// streams never finish on their own, so they are ended to let the server stop
+	srv.RegisterOnShutdown(streams.close)
+	httpServerLock.Lock()
+	httpServer = srv
+	httpServerLock.Unlock()
+	err = srv.ListenAndServe() // listen and serve on 0.0.0.0:8080
+	if err == http.ErrServerClosed {
+		// stopped by Stop
+		err = nil
+	}
 	return
 }
 
@@ -393,11 +506,11 @@ func handlerApiV1Devices(c *gin.Context) {
 		if err != nil {
 			return
 		}
-		s, err := db.GetDevices()
+		devices, err := api.GetDevices(db, strings.TrimSpace(strings.ToLower(c.DefaultQuery("group", ""))))
 		if err != nil {
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"message": "got devices", "success": true, "devices": s})
+		c.JSON(http.StatusOK, gin.H{"message": "got devices", "success": true, "devices": devices})
 		return
 	}(c)
 	if err != nil {
@@ -456,10 +569,98 @@ func handlerApiV1Locations(c *gin.Context) {
 	}
 }
 
+func handlerApiV1AdminLogging(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"message": "got log levels", "success": true, "level": logging.GetLevel(), "families": logging.GetFamilyLevels()})
+}
+
+func handlerApiV1AdminSetLogging(c *gin.Context) {
+	err := func(c *gin.Context) (err error) {
+		var p struct {
+			Level string `json:"level"`
+		}
+		err = c.BindJSON(&p)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		family := strings.TrimSpace(c.Param("family"))
+		if family == "" {
+			err = logging.SetLevel(p.Level)
+		} else {
+			err = logging.SetFamilyLevel(family, p.Level)
+		}
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "set log level", "success": true, "level": logging.GetLevel(), "families": logging.GetFamilyLevels()})
+	}
+}
+
+func handlerApiV1AdminResetLogging(c *gin.Context) {
+	logging.SetFamilyLevel(strings.TrimSpace(c.Param("family")), "")
+	c.JSON(http.StatusOK, gin.H{"message": "reset log level", "success": true, "level": logging.GetLevel(), "families": logging.GetFamilyLevels()})
+}
+
+func handlerApiV1AdminConfig(c *gin.Context) {
+	settings := config.Get().Redacted()
+	// the log level can be changed while running
+	settings.LogLevel = logging.GetLevel()
+	c.JSON(http.StatusOK, gin.H{"message": "got config", "success": true, "config": settings})
+}
+
+func handlerApiV1AdminFamilies(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"message": "got families", "success": true, "families": ListFamilies()})
+}
+
+func handlerApiV1AdminRenameFamily(c *gin.Context) {
+	family := strings.TrimSpace(c.Param("family"))
+	var p struct {
+		Name string `json:"name"`
+	}
+	err := c.BindJSON(&p)
+	if err != nil {
+		err = errors.Wrap(err, "problem binding data")
+	} else {
+		err = RenameDatabase(family, p.Name)
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("renamed %s to %s", family, strings.TrimSpace(p.Name)), "success": true})
+	}
+}
+
+func handlerApiV1AdminMergeFamily(c *gin.Context) {
+	family := strings.TrimSpace(c.Param("family"))
+	merged, err := func(c *gin.Context) (merged map[string]int64, err error) {
+		var p struct {
+			From string `json:"from"`
+		}
+		err = c.BindJSON(&p)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		return MergeDatabases(p.From, family)
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "merged into " + family + ", which is being calibrated", "success": true, "merged": merged})
+	}
+}
+
+func handlerApiV1Websockets(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"message": "got websockets", "success": true, "websockets": GetWebsocketStats()})
+}
+
 func handlerEfficacy(c *gin.Context) {
 	type Efficacy struct {
 		AccuracyBreakdown   map[string]float64                       `json:"accuracy_breakdown"`
 		ConfusionMetrics    map[string]map[string]models.BinaryStats `json:"confusion_metrics"`
+		CrossValidation     models.CrossValidation                   `json:"cross_validation"`
 		LastCalibrationTime time.Time                                `json:"last_calibration_time"`
 	}
 	efficacy, err := func(c *gin.Context) (efficacy Efficacy, err error) {
@@ -487,7 +688,7 @@ func handlerEfficacy(c *gin.Context) {
 		// }
 
 		// DEBUGING
-		calibration, err := db.GetCalibration()
+		calibration, err := db.GetActiveCalibration()
 		if err != nil {
 			logger.Warn("could not get calibration")
 			err = errors.Wrap(err, "could not get calibration")
@@ -498,6 +699,7 @@ func handlerEfficacy(c *gin.Context) {
 		efficacy.LastCalibrationTime = calibration.CalibrationTime
 		efficacy.AccuracyBreakdown = calibration.AccuracyBreakdown
 		efficacy.ConfusionMetrics = calibration.AlgorithmEfficacy
+		efficacy.CrossValidation = calibration.CrossValidation
 		//.end
 
 		return
@@ -531,13 +733,31 @@ func handlerApiV1ByLocation(c *gin.Context) {
 		if err != nil {
 			return
 		}
+		group := strings.TrimSpace(strings.ToLower(c.DefaultQuery("group", "")))
 
 		db, err := GetDatabase(family)
 		if err != nil {
 			return
 		}
 
-		byLocations, err = api.GetByLocation(db, family, minutesAgoInt, showRandomized, activeMinsThreshold, minScanners, minProbability, make(map[string]int))
+		byLocations, err = api.GetByLocation(db, family, minutesAgoInt, showRandomized, activeMinsThreshold, minScanners, minProbability, group, make(map[string]int))
+		if err != nil || c.DefaultQuery("metadata", "0") != "1" {
+			return
+		}
+
+		names := make([]string, len(byLocations))
+		for i := range byLocations {
+			names[i] = byLocations[i].Location
+		}
+		metadata, err := api.GetLocationMetadataFor(db, names)
+		if err != nil {
+			return
+		}
+		for i := range byLocations {
+			if location, ok := metadata[byLocations[i].Location]; ok {
+				byLocations[i].Metadata = &location
+			}
+		}
 		return
 	}(c)
 	if err != nil {
@@ -549,7 +769,7 @@ func handlerApiV1ByLocation(c *gin.Context) {
 }
 
 func handlerApiV1Location(c *gin.Context) {
-	s, analysis, err := func(c *gin.Context) (s models.SensorData, analysis models.LocationAnalysis, err error) {
+	s, analysis, metadata, err := func(c *gin.Context) (s models.SensorData, analysis models.LocationAnalysis, metadata map[string]models.Location, err error) {
 		family := strings.TrimSpace(c.Param("family"))
 		device := strings.TrimSpace(c.Param("device")[1:])
 
@@ -563,21 +783,32 @@ func handlerApiV1Location(c *gin.Context) {
 		}
 		analysis, err = api.AnalyzeSensorData(db, s)
 		if err != nil {
-			err = api.Calibrate(db, family, true)
-			if err != nil {
-				logger.Warn(err)
-				return
-			}
+			logger.Warn(err)
+			api.ScheduleCalibration(db, family)
+			err = nil
+		}
+		if c.DefaultQuery("metadata", "0") == "1" {
+			metadata, err = api.GetLocationMetadataFor(db, guessedLocations(analysis.Guesses))
 		}
 		return
 	}(c)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": err == nil})
+	} else if metadata != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "got location", "success": err == nil, "sensors": s, "analysis": analysis, "metadata": metadata})
 	} else {
 		c.JSON(http.StatusOK, gin.H{"message": "got location", "success": err == nil, "sensors": s, "analysis": analysis})
 	}
 }
 
+func guessedLocations(guesses []models.LocationPrediction) []string {
+	names := make([]string, len(guesses))
+	for i := range guesses {
+		names[i] = guesses[i].Location
+	}
+	return names
+}
+
 func handlerApiV1LocationSimple(c *gin.Context) {
 	s, analysis, err := func(c *gin.Context) (s models.SensorData, analysis models.LocationAnalysis, err error) {
 		family := strings.TrimSpace(c.Param("family"))
@@ -594,11 +825,9 @@ func handlerApiV1LocationSimple(c *gin.Context) {
 		}
 		analysis, err = api.AnalyzeSensorData(db, s)
 		if err != nil {
-			err = api.Calibrate(db, family, true)
-			if err != nil {
-				logger.Warn(err)
-				return
-			}
+			logger.Warn(err)
+			api.ScheduleCalibration(db, family)
+			err = nil
 		}
 		return
 	}(c)
@@ -619,25 +848,403 @@ func handlerApiV1LocationSimple(c *gin.Context) {
 }
 
 func handlerApiV1Calibrate(c *gin.Context) {
-	family := strings.TrimSpace(c.Param("family")[1:])
-	var err error
-	if family == "" {
-		err = errors.New("invalid family")
+	job, err := func(c *gin.Context) (job models.CalibrationJob, err error) {
+		family := strings.TrimSpace(c.Param("family")[1:])
+		if family == "" {
+			err = errors.New("invalid family")
+			return
+		}
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		job = api.ScheduleCalibration(db, family)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "queued calibration " + job.ID, "success": true, "job": job})
+	}
+}
+
+func handlerApiV1Calibrations(c *gin.Context) {
+	history, err := func(c *gin.Context) (history []models.CalibrationSummary, err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if err != nil {
+			return
+		}
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		history, err = api.GetCalibrationHistory(db, limit)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got calibrations", "success": true, "calibrations": history})
+	}
+}
+
+func handlerApiV1CalibrationsDiff(c *gin.Context) {
+	diff, err := func(c *gin.Context) (diff models.CalibrationDiff, err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		fromID, err := strconv.Atoi(c.DefaultQuery("from", "0"))
+		if err != nil {
+			return
+		}
+		toID, err := strconv.Atoi(c.DefaultQuery("to", "0"))
+		if err != nil {
+			return
+		}
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		diff, err = api.CompareCalibrations(db, fromID, toID)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "compared calibrations", "success": true, "diff": diff})
+	}
+}
+
+func handlerApiV1CalibrationJobs(c *gin.Context) {
+	family := strings.TrimSpace(c.Param("family"))
+	c.JSON(http.StatusOK, gin.H{"message": "got calibration jobs", "success": true, "jobs": api.GetCalibrationJobs(family)})
+}
+
+func handlerApiV1CalibrationJob(c *gin.Context) {
+	job, err := api.GetCalibrationJob(strings.TrimSpace(c.Param("family")), strings.TrimSpace(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got calibration job", "success": true, "job": job})
+	}
+}
+
+func handlerApiV1FingerprintsRelabel(c *gin.Context) {
+	affected, err := func(c *gin.Context) (affected int64, err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		var edit models.FingerprintEdit
+		err = c.BindJSON(&edit)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		affected, err = api.RelabelFingerprints(db, family, edit, c.ClientIP())
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
 	} else {
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("relabeled %d fingerprints", affected), "success": true, "affected": affected})
+	}
+}
+
+func handlerApiV1FingerprintsDelete(c *gin.Context) {
+	affected, err := func(c *gin.Context) (affected int64, err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		var edit models.FingerprintEdit
+		err = c.BindJSON(&edit)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
 		db, err := GetDatabase(family)
 		if err != nil {
 			return
 		}
-		err = api.Calibrate(db, family, true)
+		affected, err = api.DeleteFingerprints(db, family, edit, c.ClientIP())
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("deleted %d fingerprints", affected), "success": true, "affected": affected})
+	}
+}
+
+func handlerApiV1Audit(c *gin.Context) {
+	entries, err := func(c *gin.Context) (entries []models.AuditEntry, err error) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil {
+			return
+		}
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		entries, err = api.GetAuditLog(db, limit)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got audit log", "success": true, "audit": entries})
+	}
+}
+
+func handlerApiV1RegistryLocations(c *gin.Context) {
+	locations, err := func(c *gin.Context) (locations []models.Location, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		locations, err = db.GetLocationMetadata()
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got locations", "success": true, "locations": locations})
+	}
+}
+
+func handlerApiV1RegistryLocation(c *gin.Context) {
+	location, err := func(c *gin.Context) (location models.Location, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		location, err = db.GetLocationMetadataByName(strings.TrimSpace(strings.ToLower(c.Param("location"))))
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got location", "success": true, "location": location})
+	}
+}
+
+func handlerApiV1RegistrySetLocation(c *gin.Context) {
+	location, err := func(c *gin.Context) (location models.Location, err error) {
+		err = c.BindJSON(&location)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		location.Name = c.Param("location")
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		location, err = api.SetLocationMetadata(db, location)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "saved location", "success": true, "location": location})
+	}
+}
+
+func handlerApiV1RegistryDeleteLocation(c *gin.Context) {
+	err := func(c *gin.Context) (err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		err = db.DeleteLocationMetadata(strings.TrimSpace(strings.ToLower(c.Param("location"))))
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "unregistered location " + c.Param("location"), "success": true})
 	}
-	message := "calibrated data"
+}
+
+func handlerApiV1RegistryRenameLocation(c *gin.Context) {
+	affected, err := func(c *gin.Context) (affected int64, err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		var rename struct {
+			Name string `json:"name" binding:"required"`
+		}
+		err = c.BindJSON(&rename)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		affected, err = api.RenameLocation(db, family, c.Param("location"), rename.Name, c.ClientIP())
+		return
+	}(c)
 	if err != nil {
-		message = err.Error()
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("renamed location, moved %d fingerprints", affected), "success": true, "affected": affected})
+	}
+}
+
+func handlerApiV1RegistryDevices(c *gin.Context) {
+	devices, err := func(c *gin.Context) (devices []models.Device, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		devices, err = db.GetDeviceMetadata()
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got devices", "success": true, "devices": devices})
+	}
+}
+
+func handlerApiV1RegistryDevice(c *gin.Context) {
+	device, err := func(c *gin.Context) (device models.Device, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		device, err = db.GetDeviceMetadataById(strings.TrimSpace(strings.ToLower(c.Param("device"))))
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got device", "success": true, "device": device})
+	}
+}
+
+func handlerApiV1RegistrySetDevice(c *gin.Context) {
+	device, err := func(c *gin.Context) (device models.Device, err error) {
+		err = c.BindJSON(&device)
+		if err != nil {
+			err = errors.Wrap(err, "problem binding data")
+			return
+		}
+		device.ID = c.Param("device")
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		device, err = api.SetDeviceMetadata(db, device)
+		if err == nil && UseMQTT {
+			if errDiscovery := mqtt.PublishDiscovery(strings.TrimSpace(strings.ToLower(c.Param("family"))), device); errDiscovery != nil {
+				logger.Warn(errDiscovery)
+			}
+		}
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "saved device", "success": true, "device": device})
+	}
+}
+
+func handlerApiV1RegistryDeleteDevice(c *gin.Context) {
+	err := func(c *gin.Context) (err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		device := strings.TrimSpace(strings.ToLower(c.Param("device")))
+		err = db.DeleteDeviceMetadata(device)
+		if err == nil && UseMQTT {
+			if errDiscovery := mqtt.RemoveDiscovery(strings.TrimSpace(strings.ToLower(c.Param("family"))), device); errDiscovery != nil {
+				logger.Warn(errDiscovery)
+			}
+		}
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "unregistered device " + c.Param("device"), "success": true})
+	}
+}
+
+func handlerApiV1Models(c *gin.Context) {
+	snapshots, err := func(c *gin.Context) (snapshots []models.ModelSnapshot, err error) {
+		db, err := GetDatabase(strings.TrimSpace(c.Param("family")))
+		if err != nil {
+			return
+		}
+		snapshots, err = api.GetModelSnapshots(db)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "got model snapshots", "success": true, "snapshots": snapshots})
+	}
+}
+
+func handlerApiV1ModelsRollback(c *gin.Context) {
+	id, err := func(c *gin.Context) (id int, err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		id, err = strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return
+		}
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		err = api.RollbackModels(db, family, id)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("rolled back to model snapshot %d", id), "success": true})
+	}
+}
+
+func handlerApiV1ModelsPin(c *gin.Context) {
+	id, err := func(c *gin.Context) (id int, err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		id, err = strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return
+		}
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		err = api.PinModels(db, family, id)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("pinned to model snapshot %d", id), "success": true})
+	}
+}
+
+func handlerApiV1ModelsUnpin(c *gin.Context) {
+	err := func(c *gin.Context) (err error) {
+		family := strings.TrimSpace(c.Param("family"))
+		db, err := GetDatabase(family)
+		if err != nil {
+			return
+		}
+		err = api.UnpinModels(db, family)
+		return
+	}(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "success": false})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "unpinned models", "success": true})
 	}
-	c.JSON(http.StatusOK, gin.H{"message": message, "success": err == nil})
 }
 
-/*
 func handlerMQTT(c *gin.Context) {
 	message, err := func(c *gin.Context) (message string, err error) {
 		family := strings.TrimSpace(c.Param("family"))
@@ -659,7 +1266,6 @@ func handlerMQTT(c *gin.Context) {
 	}
 	return
 }
-*/
 
 func sendOutLocation(family, device string) (s models.SensorData, analysis models.LocationAnalysis, err error) {
 	db, err := GetDatabase(family)
@@ -676,11 +1282,9 @@ func sendOutLocation(family, device string) (s models.SensorData, analysis model
 	}
 	analysis, err = api.AnalyzeSensorData(db, s)
 	if err != nil {
-		err = api.Calibrate(db, family, true)
-		if err != nil {
-			logger.Warn(err)
-			return
-		}
+		logger.Warn(err)
+		api.ScheduleCalibration(db, family)
+		err = nil
 	}
 	return
 }
@@ -706,6 +1310,7 @@ func handlerData(c *gin.Context) {
 			err = errors.Wrap(err, "problem validating data")
 			return
 		}
+		d.RequestID = requestID(c)
 
 		// process data
 		err = processSensorData(d, justSave)
@@ -741,20 +1346,9 @@ func handlerDataClassify(c *gin.Context) {
 			err = errors.Wrap(err, "problem validating data")
 			return
 		}
+		d.RequestID = requestID(c)
 
-		// process data
-		err = processSensorData(d, true)
-		if err != nil {
-			return
-		}
-
-		db, err := GetDatabase(d.Family)
-		if err != nil {
-			return
-		}
-
-		aidata, err = api.AnalyzeSensorData(db, d)
-		logger.Debugf("[%s] /data %+v", d.Family, d)
+		aidata, err = classifySensorData(d)
 		message = "classified data"
 		return
 	}(c)
@@ -767,6 +1361,23 @@ func handlerDataClassify(c *gin.Context) {
 	}
 }
 
+// classifySensorData saves the sensor data and returns its analysis
+func classifySensorData(d models.SensorData) (aidata models.LocationAnalysis, err error) {
+	err = processSensorData(d, true)
+	if err != nil {
+		return
+	}
+
+	db, err := GetDatabase(d.Family)
+	if err != nil {
+		return
+	}
+
+	aidata, err = api.AnalyzeSensorData(db, d)
+	logger.Debugf("[%s] /data %+v", d.Family, d)
+	return
+}
+
 func handlerReverseSettings(c *gin.Context) {
 	message, err := func(c *gin.Context) (message string, err error) {
 		// bind sensor data
@@ -775,6 +1386,10 @@ func handlerReverseSettings(c *gin.Context) {
 			MinimumPassive int `json:"minimum_passive"`
 			// Timespan of window
 			Window int64 `json:"window"`
+			// Step is how far the window slides, in seconds
+			Step int64 `json:"step"`
+			// Aggregation combines the RSSI of a scanner in a window
+			Aggregation string `json:"aggregation"`
 			// Family is a group of devices
 			Family string `json:"family" binding:"required"`
 			// Device are unique within a family
@@ -797,59 +1412,62 @@ func handlerReverseSettings(c *gin.Context) {
 		d.Family = strings.TrimSpace(strings.ToLower(d.Family))
 		d.Device = strings.TrimSpace(strings.ToLower(d.Device))
 		d.Location = strings.TrimSpace(strings.ToLower(d.Location))
-
-		// open database
-		db, err := GetDatabase(c.Param("family"))
-		if err != nil {
+		d.Aggregation = strings.TrimSpace(strings.ToLower(d.Aggregation))
+		if d.Aggregation != "" && !models.ValidAggregation(d.Aggregation) {
+			err = errors.Errorf("aggregation '%s' must be one of %s", d.Aggregation, strings.Join(models.Aggregations, ", "))
 			return
 		}
 
-		var rollingData models.ReverseRollingData
-		err = db.Get("ReverseRollingData", &rollingData)
+		aggregator, err := passive.get(d.Family)
 		if err != nil {
-			rollingData = models.ReverseRollingData{
-				Family:         d.Family,
-				DeviceLocation: make(map[string]string),
-				DeviceGPS:      make(map[string]models.GPS),
-				TimeBlock:      90 * time.Second,
-			}
-		}
-		if rollingData.TimeBlock.Seconds() == 0 {
-			rollingData.TimeBlock = 90 * time.Second
+			return
 		}
-
-		// set tracking information
-		if d.Device != "" {
-			if d.Location != "" {
-				message = fmt.Sprintf("Set location to '%s' for %s for learning with device '%s'", d.Location, d.Family, d.Device)
-				rollingData.DeviceLocation[d.Device] = d.Location
-				if d.Latitude != 0 && d.Longitude != 0 {
-					rollingData.DeviceGPS[d.Device] = models.GPS{
-						Latitude:  d.Latitude,
-						Longitude: d.Longitude,
-						Altitude:  d.Altitude,
+		settings := aggregator.Update(func(rollingData *models.ReverseRollingData) {
+			// set tracking information
+			if d.Device != "" {
+				if d.Location != "" {
+					message = fmt.Sprintf("Set location to '%s' for %s for learning with device '%s'", d.Location, d.Family, d.Device)
+					rollingData.DeviceLocation[d.Device] = d.Location
+					if d.Latitude != 0 && d.Longitude != 0 {
+						rollingData.DeviceGPS[d.Device] = models.GPS{
+							Latitude:  d.Latitude,
+							Longitude: d.Longitude,
+							Altitude:  d.Altitude,
+						}
 					}
+				} else {
+					message = fmt.Sprintf("switched to tracking for %s", d.Family)
+					delete(rollingData.DeviceLocation, d.Device)
 				}
-			} else {
-				message = fmt.Sprintf("switched to tracking for %s", d.Family)
-				delete(rollingData.DeviceLocation, d.Device)
+				message += ". "
 			}
-			message += ". "
-		}
-		message += fmt.Sprintf("Now learning on %d devices: %+v", len(rollingData.DeviceLocation), rollingData.DeviceLocation)
+			message += fmt.Sprintf("Now learning on %d devices: %+v", len(rollingData.DeviceLocation), rollingData.DeviceLocation)
 
-		// set time block information
-		if d.Window > 0 {
-			rollingData.TimeBlock = time.Duration(d.Window) * time.Second
-		}
-		message += fmt.Sprintf("with time block of %2.0f seconds", rollingData.TimeBlock.Seconds())
-
-		if d.MinimumPassive != 0 {
-			rollingData.MinimumPassive = d.MinimumPassive
-			message += fmt.Sprintf(" and set minimum passive to %d", rollingData.MinimumPassive)
-		}
+			// set time block information
+			if d.Window > 0 {
+				rollingData.TimeBlock = time.Duration(d.Window) * time.Second
+			}
+			message += fmt.Sprintf("with time block of %2.0f seconds", rollingData.TimeBlock.Seconds())
+			if d.Step > 0 {
+				rollingData.Step = time.Duration(d.Step) * time.Second
+			}
+			if rollingData.Step > rollingData.TimeBlock {
+				rollingData.Step = rollingData.TimeBlock
+			}
+			if rollingData.Step > 0 {
+				message += fmt.Sprintf(" sliding by %2.0f seconds", rollingData.Step.Seconds())
+			}
+			if d.Aggregation != "" {
+				rollingData.Aggregation = d.Aggregation
+				message += fmt.Sprintf(" and the %s of each scanner", rollingData.Aggregation)
+			}
 
-		err = db.Set("ReverseRollingData", rollingData)
+			if d.MinimumPassive != 0 {
+				rollingData.MinimumPassive = d.MinimumPassive
+				message += fmt.Sprintf(" and set minimum passive to %d", rollingData.MinimumPassive)
+			}
+		})
+		err = saveSettings(d.Family, settings)
 		logger.Debugf("[%s] %s", d.Family, message)
 		return
 	}(c)
@@ -879,53 +1497,7 @@ func handlerReverse(c *gin.Context) {
 			return
 		}
 
-		if d.Location != "" {
-			logger.Debugf("[%s] entered passive fingerprint for %s at %s", d.Family, d.Device, d.Location)
-		} else {
-			logger.Debugf("[%s] entered passive fingerprint for %s", d.Family, d.Device)
-		}
-
-		// open database
-		db, err := GetDatabase(c.Param("family"))
-		if err != nil {
-			return
-		}
-
-		var rollingData models.ReverseRollingData
-		err = db.Get("ReverseRollingData", &rollingData)
-		if err != nil {
-			// defaults
-			rollingData = models.ReverseRollingData{
-				Family:         d.Family,
-				DeviceLocation: make(map[string]string),
-				TimeBlock:      90 * time.Second,
-			}
-		}
-		if rollingData.TimeBlock.Seconds() == 0 {
-			rollingData.TimeBlock = 90 * time.Second
-		}
-
-		if !rollingData.HasData {
-			rollingData.Timestamp = time.Now().UTC()
-			rollingData.Datas = []models.SensorData{}
-			rollingData.HasData = true
-		}
-		if len(d.Sensors) == 0 {
-			err = errors.New("no fingerprints")
-			return
-		}
-
-		rollingData.Datas = append(rollingData.Datas, d)
-		numFingerprints := 0
-		for sensor := range d.Sensors {
-			numFingerprints += len(d.Sensors[sensor])
-		}
-		err = db.Set("ReverseRollingData", rollingData)
-		message = fmt.Sprintf("inserted %d fingerprints for %s", numFingerprints, d.Family)
-
-		if err == nil {
-			go parseRollingData(d.Family)
-		}
+		message, err = processPassiveData(d)
 		return
 	}(c)
 
@@ -938,75 +1510,6 @@ func handlerReverse(c *gin.Context) {
 
 }
 
-func parseRollingData(family string) (err error) {
-	db, err := GetDatabase(family)
-	if err != nil {
-		return
-	}
-
-	var rollingData models.ReverseRollingData
-	err = db.Get("ReverseRollingData", &rollingData)
-	if err != nil {
-		return
-	}
-
-	sensorMap := make(map[string]models.SensorData)
-	if rollingData.HasData && time.Since(rollingData.Timestamp) > rollingData.TimeBlock {
-		logger.Debugf("[%s] New data arrived %s", family, time.Since(rollingData.Timestamp))
-		// merge data
-		for _, data := range rollingData.Datas {
-			for sensor := range data.Sensors {
-				for mac := range data.Sensors[sensor] {
-					rssi := data.Sensors[sensor][mac]
-					trackedDeviceName := sensor + "-" + mac
-					if _, ok := sensorMap[trackedDeviceName]; !ok {
-						location := ""
-						// if there is a device+location in map, then it is currently doing learning
-						if loc, hasMac := rollingData.DeviceLocation[trackedDeviceName]; hasMac {
-							location = loc
-						}
-						var gps models.GPS
-						if g, hasMac := rollingData.DeviceGPS[trackedDeviceName]; hasMac {
-							gps = g
-						}
-						sensorMap[trackedDeviceName] = models.SensorData{
-							Family:    family,
-							Device:    trackedDeviceName,
-							Timestamp: time.Now().UTC().UnixNano() / int64(time.Millisecond),
-							Sensors:   make(map[string]map[string]interface{}),
-							Location:  location,
-							GPS:       gps,
-						}
-						time.Sleep(10 * time.Millisecond)
-						sensorMap[trackedDeviceName].Sensors[sensor] = make(map[string]interface{})
-					}
-					sensorMap[trackedDeviceName].Sensors[sensor][data.Device+"-"+sensor] = rssi
-				}
-			}
-		}
-		rollingData.HasData = false
-	}
-	db.Set("ReverseRollingData", rollingData)
-	for sensor := range sensorMap {
-		logger.Debugf("[%s] reverse sensor data: %+v", family, sensorMap[sensor])
-		numPassivePoints := 0
-		for sensorType := range sensorMap[sensor].Sensors {
-			numPassivePoints += len(sensorMap[sensor].Sensors[sensorType])
-		}
-		if numPassivePoints < rollingData.MinimumPassive {
-			logger.Debugf("[%s] skipped saving reverse sensor data for %s, not enough points (< %d)", family, sensor, rollingData.MinimumPassive)
-			continue
-		}
-		err := processSensorData(sensorMap[sensor])
-		if err != nil {
-			logger.Warnf("[%s] problem saving: %s", family, err.Error())
-		}
-		logger.Debugf("[%s] saved reverse sensor data for %s", family, sensor)
-	}
-
-	return
-}
-
 func handlerFIND(c *gin.Context) {
 	var j models.FINDFingerprint
 	var err error
@@ -1017,6 +1520,7 @@ func handlerFIND(c *gin.Context) {
 			j.Location = ""
 		}
 		d := j.Convert()
+		d.RequestID = requestID(c)
 		err2 := processSensorData(d)
 		if err2 == nil {
 			message = "inserted data"
@@ -1037,15 +1541,18 @@ func processSensorData(p models.SensorData, justSave ...bool) (err error) {
 		return
 	}
 
+	log := logger.WithFamily(p.Family).WithRequest(p.RequestID)
 	err = api.SaveSensorData(db, p)
 	if err != nil {
+		log.Warnf("problem saving sensor data of %s: %s", p.Device, err.Error())
 		return
 	}
+	log.Debugf("saved sensor data of %s", p.Device)
 
 	if len(justSave) > 0 && justSave[0] {
 		return
 	}
-	go sendOutData(p)
+	sendOut(p)
 	return
 }
 
@@ -1055,48 +1562,183 @@ func sendOutData(p models.SensorData) (analysis models.LocationAnalysis, err err
 		return
 	}
 
+	log := logger.WithFamily(p.Family).WithRequest(p.RequestID)
+	// ignored devices are neither analyzed nor sent out
+	if api.IsIgnored(db, p.Device) {
+		err = errIgnored
+		log.Debugf("not sending out %s: %s", p.Device, err.Error())
+		return
+	}
 	analysis, _ = api.AnalyzeSensorData(db, p)
 	if len(analysis.Guesses) == 0 {
 		err = errors.New("no guesses")
+		log.Debugf("not sending out %s: %s", p.Device, err.Error())
 		return
 	}
 	type Payload struct {
-		Sensors  models.SensorData           `json:"sensors"`
+		Device   string                      `json:"device"`
+		Sensors  *models.SensorData          `json:"sensors,omitempty"`
 		Guesses  []models.LocationPrediction `json:"guesses"`
 		Location string                      `json:"location"` // FIND backwards-compatability
 		Time     int64                       `json:"time"`     // FIND backwards-compatability
+		Metadata map[string]models.Location  `json:"metadata,omitempty"`
 	}
 	payload := Payload{
-		Sensors:  p,
+		Device:   p.Device,
+		Sensors:  &p,
 		Guesses:  analysis.Guesses,
 		Location: analysis.Guesses[0].Location,
 		Time:     p.Timestamp,
 	}
-	bTarget, err := json.Marshal(payload)
+
+	// location metadata is only looked up when a websocket or stream wants it
+	wantMetadata := websocketsWantMetadata(p.Family, p.Device, "all") || streams.wantMetadata(p.Family)
+	if wantMetadata {
+		payload.Metadata, err = api.GetLocationMetadataFor(db, guessedLocations(analysis.Guesses))
+		if err != nil {
+			log.Warn(err)
+		}
+	}
+	render := func(sensors bool, metadata bool) ([]byte, error) {
+		out := payload
+		if !sensors {
+			out.Sensors = nil
+		}
+		if !metadata {
+			out.Metadata = nil
+		}
+		return json.Marshal(out)
+	}
+	bTarget, err := render(true, false)
 	if err != nil {
 		return
 	}
+	var bTargetWithMetadata []byte
+	if wantMetadata {
+		bTargetWithMetadata, err = render(true, true)
+		if err != nil {
+			return
+		}
+	}
 
 	// logger.Debugf("sending data over websockets (%s/%s):%s", p.Family, p.Device, bTarget)
-	SendMessageOverWebsockets(p.Family, p.Device, bTarget)
-	SendMessageOverWebsockets(p.Family, "all", bTarget)
+	SendLocationOverWebsockets(p.Family, wsLocation{
+		Device:      p.Device,
+		Location:    payload.Location,
+		Probability: analysis.Guesses[0].Probability,
+		render:      render,
+	})
+	streams.publish(p.Family, streamEvent{
+		Device:           p.Device,
+		Location:         payload.Location,
+		Data:             bTarget,
+		DataWithMetadata: bTargetWithMetadata,
+	})
+	log.Debugf("sent out %s at %s", p.Device, payload.Location)
 
-	// if UseMQTT {
-	// 	logger.Debugf("[%s] sending data over mqtt (%s)", p.Family, p.Device)
-	// 	mqtt.Publish(p.Family, p.Device, string(bTarget))
-	// }
+	if UseMQTT {
+		log.Debugf("sending data over mqtt (%s)", p.Device)
+		if errPublish := mqtt.Publish(p.Family, p.Device, string(bTarget)); errPublish != nil {
+			log.Warn(errPublish)
+		}
+		// the entities of registered devices are published for Home
+		// Assistant the first time they are sent out, and the registry is
+		// checked again for the devices that were not registered
+		if !mqtt.Discovered(p.Family, p.Device) {
+			device, errDevice := db.GetDeviceMetadataById(p.Device)
+			if errDevice != nil {
+				device = models.Device{ID: p.Device}
+			}
+			if errPublish := mqtt.PublishDiscovery(p.Family, device); errPublish != nil {
+				log.Warn(errPublish)
+			}
+		}
+		if errPublish := mqtt.PublishState(p.Family, p.Device, payload.Location); errPublish != nil {
+			log.Warn(errPublish)
+		}
+	}
 	return
 }
 
+// removeDiscovery removes the Home Assistant entities of the registered
+// devices of a family
+func removeDiscovery(family string) {
+	if database.Exists(family) != nil {
+		return
+	}
+	db, err := GetDatabase(family)
+	if err != nil {
+		return
+	}
+	devices, err := db.GetDeviceMetadata()
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	for _, device := range devices {
+		if err = mqtt.RemoveDiscovery(strings.TrimSpace(strings.ToLower(family)), device.ID); err != nil {
+			logger.Warn(err)
+		}
+	}
+}
+
+// sendOutCalibration notifies the family's websockets that a calibration job finished
+func sendOutCalibration(job models.CalibrationJob) {
+	type Payload struct {
+		Type string                `json:"type"`
+		Job  models.CalibrationJob `json:"job"`
+	}
+	bTarget, err := json.Marshal(Payload{Type: "calibration", Job: job})
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	SendMessageOverWebsockets(job.Family, "all", bTarget)
+}
+
 func middleWareHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		t := time.Now().UTC()
 		// Add base headers
 		addCORS(c)
+		// Every request gets an id, which is logged with what it does
+		id := strings.TrimSpace(c.Request.Header.Get("X-Request-ID"))
+		if id == "" || len(id) > 64 {
+			id = logging.NewRequestID()
+		}
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
 		// Run next function
 		c.Next()
+		observeRequest(c, time.Since(t))
 		// Log request
-		logger.Infof("%v %v %v %s", c.Request.RemoteAddr, c.Request.Method, c.Request.URL, time.Since(t))
+		logger.WithFamily(c.Param("family")).WithRequest(id).
+			With("remote_addr", c.Request.RemoteAddr).
+			With("method", c.Request.Method).
+			With("path", c.Request.URL.String()).
+			With("status", c.Writer.Status()).
+			With("duration_ms", float64(time.Since(t).Nanoseconds())/1e6).
+			Info("handled request")
+	}
+}
+
+// requestID returns the id that the middleware gave the request
+func requestID(c *gin.Context) string {
+	if id, ok := c.Get("request_id"); ok {
+		return id.(string)
+	}
+	return ""
+}
+
+// gzipUnlessStreaming compresses responses, except for the event streams
+// which would otherwise be held in the gzip buffer
+func gzipUnlessStreaming(level int) gin.HandlerFunc {
+	compress := gzip.Gzip(level)
+	return func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/api/v1/stream/") {
+			return
+		}
+		compress(c)
 	}
 }
 
@@ -3,12 +3,17 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/schollz/find4/server/main/src/api"
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,3 +44,34 @@ func TestLearn(t *testing.T) {
 	fmt.Println(resp.Body.String())
 	assert.Equal(t, true, strings.Contains(resp.Body.String(), "\"success\":true"))
 }
+
+func TestSendOutIgnored(t *testing.T) {
+	folder, err := ioutil.TempDir("", "ignored")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	db, err := GetDatabase("testignored")
+	assert.Nil(t, err)
+	_, err = api.SetDeviceMetadata(db, models.Device{ID: "wifi-aa:bb:cc:dd:ee:ff", Ignore: true})
+	assert.Nil(t, err)
+	_, err = api.SetDeviceMetadata(db, models.Device{ID: "wifi-11:22:33:44:55:66", Name: "phone"})
+	assert.Nil(t, err)
+
+	// ignored devices are not analyzed or sent out
+	d := models.SensorData{
+		Timestamp: 1,
+		Family:    "testignored",
+		Device:    "wifi-aa:bb:cc:dd:ee:ff",
+		Sensors:   map[string]map[string]interface{}{"wifi": {"pi1": -50.0}},
+	}
+	analysis, err := sendOutData(d)
+	assert.Equal(t, errIgnored, err)
+	assert.Equal(t, 0, len(analysis.Guesses))
+
+	d.Device = "wifi-11:22:33:44:55:66"
+	_, err = sendOutData(d)
+	assert.NotEqual(t, errIgnored, err)
+	assert.Nil(t, DeleteDatabase("testignored"))
+}
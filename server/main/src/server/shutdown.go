@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/schollz/find4/server/main/src/mqtt"
+)
+
+var (
+	httpServer     *http.Server
+	httpServerLock sync.Mutex
+)
+
+// sending are the fingerprints that are being analyzed and sent out. No
+// more are sent out once it is stopped.
+var sending struct {
+	wg      sync.WaitGroup
+	stopped bool
+	sync.Mutex
+}
+
+// sendOut analyzes a fingerprint and sends out its location in the
+// background, unless the server is shutting down
+func sendOut(p models.SensorData) {
+	sending.Lock()
+	defer sending.Unlock()
+	if sending.stopped {
+		logger.WithFamily(p.Family).Debugf("not sending out %s: shutting down", p.Device)
+		return
+	}
+	sending.wg.Add(1)
+	go func() {
+		defer sending.wg.Done()
+		sendOutData(p)
+	}()
+}
+
+// Stop stops accepting requests and fingerprints over MQTT and ends the
+// streams, then waits for the requests in flight until the context is done
+func Stop(ctx context.Context) error {
+	if UseMQTT {
+		mqtt.Close()
+	}
+	httpServerLock.Lock()
+	srv := httpServer
+	httpServerLock.Unlock()
+	if srv == nil {
+		return nil
+	}
+	logger.Warn("Stopping http server")
+	return srv.Shutdown(ctx)
+}
+
+// StopSending stops sending out the locations of new fingerprints and waits
+// for the ones that are being sent out, until the context is done
+func StopSending(ctx context.Context) error {
+	sending.Lock()
+	sending.stopped = true
+	sending.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sending.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "locations were still being sent out")
+	}
+}
+
+// DrainDatabases waits for the write queues of the databases to be written,
+// until the context is done
+func DrainDatabases(ctx context.Context) (err error) {
+	for family, db := range databases.snapshot() {
+		if pending := db.GetPending(); pending != 0 {
+			logger.Warnf("Writing %d queued inserts of %v", pending, family)
+		}
+		if err2 := db.Drain(ctx); err2 != nil {
+			logger.Error(err2)
+			err = err2
+		}
+	}
+	return
+}
+
+// CloseWebsockets sends a close frame to the websockets and waits for
+// them to be sent, until the context is done
+func CloseWebsockets(ctx context.Context) error {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	ws.Lock()
+	count := 0
+	for _, clients := range ws.clients {
+		for _, client := range clients {
+			client.closeMessage = closeMessage
+			ws.unregister(client)
+			count++
+		}
+	}
+	ws.Unlock()
+	if count != 0 {
+		logger.Warnf("Closing %d websockets", count)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ws.writers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "websockets were not closed")
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schollz/find4/server/main/src/database"
+	"github.com/schollz/find4/server/main/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopSending(t *testing.T) {
+	folder, err := ioutil.TempDir("", "sending")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	database.DataFolder = folder
+	defer func() { database.DataFolder = database.DEFAULT_DATA_FOLDER }()
+
+	// the fingerprints of the other tests are sent out again after
+	defer func() {
+		sending.Lock()
+		sending.stopped = false
+		sending.wg = sync.WaitGroup{}
+		sending.Unlock()
+	}()
+
+	// a location that is being sent out is waited for
+	sending.wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, StopSending(ctx))
+	sending.wg.Done()
+	assert.Nil(t, StopSending(context.Background()))
+
+	// and no more are sent out
+	sendOut(models.SensorData{Family: "teststopsending", Device: "phone"})
+	sending.wg.Wait()
+	for _, family := range ListFamilies() {
+		assert.NotEqual(t, "teststopsending", family.Family)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamBufferSize is the number of events kept for each family,
+// so that a stream that reconnects can resume from its Last-Event-ID
+var StreamBufferSize = 100
+
+// StreamHeartbeat is how often a comment is sent to keep idle streams open
+var StreamHeartbeat = 15 * time.Second
+
+// streamEvent is a location payload sent to the streams of a family
+type streamEvent struct {
+	ID       int64
+	Device   string
+	Location string
+	Data     []byte
+	// DataWithMetadata includes the location metadata, if any stream wanted it
+	DataWithMetadata []byte
+}
+
+// streamSubscriber is a stream of a family, with its filters
+type streamSubscriber struct {
+	device   string
+	location string
+	metadata bool
+	events   chan streamEvent
+}
+
+func (s *streamSubscriber) wants(event streamEvent) bool {
+	return (s.device == "" || s.device == event.Device) &&
+		(s.location == "" || s.location == event.Location)
+}
+
+func (s *streamSubscriber) data(event streamEvent) []byte {
+	if s.metadata && len(event.DataWithMetadata) > 0 {
+		return event.DataWithMetadata
+	}
+	return event.Data
+}
+
+type familyStream struct {
+	lastID      int64
+	buffer      []streamEvent
+	subscribers map[*streamSubscriber]bool
+}
+
+type Streams struct {
+	families map[string]*familyStream
+	// closing is closed when the server stops, which ends the streams
+	closing   chan struct{}
+	closeOnce sync.Once
+	sync.Mutex
+}
+
+var (
+	streams Streams
+)
+
+func init() {
+	streams.Lock()
+	defer streams.Unlock()
+	streams.families = make(map[string]*familyStream)
+	streams.closing = make(chan struct{})
+}
+
+func (s *Streams) family(family string) *familyStream {
+	if _, ok := s.families[family]; !ok {
+		s.families[family] = &familyStream{subscribers: make(map[*streamSubscriber]bool)}
+	}
+	return s.families[family]
+}
+
+// subscribe adds a stream to a family and returns the buffered events
+// after lastEventID that it wants
+func (s *Streams) subscribe(family string, sub *streamSubscriber, lastEventID int64) (backlog []streamEvent) {
+	s.Lock()
+	defer s.Unlock()
+	f := s.family(family)
+	f.subscribers[sub] = true
+	if lastEventID <= 0 {
+		return
+	}
+	for _, event := range f.buffer {
+		if event.ID > lastEventID && sub.wants(event) {
+			backlog = append(backlog, event)
+		}
+	}
+	return
+}
+
+func (s *Streams) unsubscribe(family string, sub *streamSubscriber) {
+	s.Lock()
+	defer s.Unlock()
+	if f, ok := s.families[family]; ok {
+		delete(f.subscribers, sub)
+	}
+}
+
+// publish buffers an event of a family and sends it to the streams that
+// want it. Streams that are too slow to keep up miss the event.
+func (s *Streams) publish(family string, event streamEvent) {
+	s.Lock()
+	defer s.Unlock()
+	f := s.family(family)
+	f.lastID++
+	event.ID = f.lastID
+	f.buffer = append(f.buffer, event)
+	if len(f.buffer) > StreamBufferSize {
+		f.buffer = f.buffer[len(f.buffer)-StreamBufferSize:]
+	}
+	for sub := range f.subscribers {
+		if !sub.wants(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			logger.Warnf("[%s] stream is too slow, dropped event %d", family, event.ID)
+		}
+	}
+}
+
+// close ends all of the streams
+func (s *Streams) close() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
+// wantMetadata returns whether any stream of the family wants location metadata
+func (s *Streams) wantMetadata(family string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if f, ok := s.families[family]; ok {
+		for sub := range f.subscribers {
+			if sub.metadata {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handlerApiV1Stream streams the locations of a family as Server-Sent Events
+func handlerApiV1Stream(c *gin.Context) {
+	family := strings.TrimSpace(c.Param("family"))
+	sub := &streamSubscriber{
+		device:   strings.TrimSpace(strings.ToLower(c.DefaultQuery("device", ""))),
+		location: strings.TrimSpace(strings.ToLower(c.DefaultQuery("location", ""))),
+		metadata: c.DefaultQuery("metadata", "0") == "1",
+		events:   make(chan streamEvent, 16),
+	}
+	// browsers can only resume with the header, other clients may use the query
+	lastEventID, _ := strconv.ParseInt(c.Request.Header.Get("Last-Event-ID"), 10, 64)
+	if lastEventID == 0 {
+		lastEventID, _ = strconv.ParseInt(c.DefaultQuery("last_event_id", "0"), 10, 64)
+	}
+
+	backlog := streams.subscribe(family, sub, lastEventID)
+	defer streams.unsubscribe(family, sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// proxies such as nginx should not buffer the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", 3000)
+	for _, event := range backlog {
+		writeStreamEvent(c.Writer, sub, event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-sub.events:
+			writeStreamEvent(c.Writer, sub, event)
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+		case <-c.Request.Context().Done():
+			return
+		case <-streams.closing:
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeStreamEvent(w gin.ResponseWriter, sub *streamSubscriber, event streamEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: location\ndata: %s\n\n", event.ID, sub.data(event))
+}
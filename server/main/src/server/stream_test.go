@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamsResume(t *testing.T) {
+	bufferSize := StreamBufferSize
+	StreamBufferSize = 3
+	defer func() { StreamBufferSize = bufferSize }()
+
+	family := "teststreams"
+	for i, device := range []string{"a", "b", "a", "a", "b"} {
+		streams.publish(family, streamEvent{Device: device, Location: "kitchen", Data: []byte{byte(i)}})
+	}
+
+	sub := &streamSubscriber{device: "a", events: make(chan streamEvent, 1)}
+	backlog := streams.subscribe(family, sub, 1)
+	defer streams.unsubscribe(family, sub)
+	assert.Equal(t, 2, len(backlog))
+	assert.Equal(t, int64(3), backlog[0].ID)
+	assert.Empty(t, streams.subscribe(family, &streamSubscriber{}, 0))
+
+	streams.publish(family, streamEvent{Device: "b", Location: "kitchen"})
+	streams.publish(family, streamEvent{Device: "a", Location: "office", Data: []byte("data")})
+	streams.publish(family, streamEvent{Device: "a", Location: "office"})
+	event := <-sub.events
+	assert.Equal(t, int64(7), event.ID)
+	assert.Equal(t, []byte("data"), sub.data(event))
+	assert.False(t, sub.wants(streamEvent{Device: "b"}))
+}
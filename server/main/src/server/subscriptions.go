@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WebsocketSubscription filters the locations sent to a websocket. Devices
+// and locations may be names or globs, such as "phone-*". An empty list
+// matches everything.
+type WebsocketSubscription struct {
+	Devices        []string `json:"devices,omitempty"`
+	Locations      []string `json:"locations,omitempty"`
+	MinProbability float64  `json:"min_probability,omitempty"`
+	// Sensors is whether the raw sensor data is included
+	Sensors bool `json:"sensors"`
+}
+
+// defaultSubscription is the subscription of a websocket until it
+// sends its own, which gets every location with the sensor data
+var defaultSubscription = WebsocketSubscription{Sensors: true}
+
+// wsMessage is a message sent by a websocket client
+type wsMessage struct {
+	Type           string   `json:"type"`
+	Devices        []string `json:"devices"`
+	Locations      []string `json:"locations"`
+	MinProbability float64  `json:"min_probability"`
+	Sensors        *bool    `json:"sensors"`
+}
+
+// wsLocation is a location to send to the websockets. It is rendered
+// for what each subscription wants.
+type wsLocation struct {
+	Device      string
+	Location    string
+	Probability float64
+	render      func(sensors bool, metadata bool) ([]byte, error)
+}
+
+// parseSubscription reads a subscription from a message sent by a websocket client.
+// An "unsubscribe" message returns the default subscription.
+func parseSubscription(msg []byte) (subscription WebsocketSubscription, err error) {
+	var m wsMessage
+	err = json.Unmarshal(msg, &m)
+	if err != nil {
+		err = errors.Wrap(err, "could not read message")
+		return
+	}
+	switch m.Type {
+	case "unsubscribe":
+		subscription = defaultSubscription
+		return
+	case "subscribe":
+	default:
+		err = errors.Errorf("unknown message type '%s'", m.Type)
+		return
+	}
+
+	subscription = WebsocketSubscription{
+		Devices:        normalizePatterns(m.Devices),
+		Locations:      normalizePatterns(m.Locations),
+		MinProbability: m.MinProbability,
+		Sensors:        m.Sensors == nil || *m.Sensors,
+	}
+	for _, pattern := range append(subscription.Devices, subscription.Locations...) {
+		if _, err = path.Match(pattern, ""); err != nil {
+			err = errors.Errorf("bad pattern '%s'", pattern)
+			return
+		}
+	}
+	if subscription.MinProbability < 0 || subscription.MinProbability > 1 {
+		err = errors.New("min_probability must be between 0 and 1")
+	}
+	return
+}
+
+func normalizePatterns(patterns []string) (normalized []string) {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(strings.ToLower(pattern))
+		if pattern != "" {
+			normalized = append(normalized, pattern)
+		}
+	}
+	return
+}
+
+// matches returns whether the subscription wants the location
+func (s WebsocketSubscription) matches(location wsLocation) bool {
+	return matchesAny(s.Devices, location.Device) &&
+		matchesAny(s.Locations, location.Location) &&
+		location.Probability >= s.MinProbability
+}
+
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
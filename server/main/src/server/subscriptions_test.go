@@ -0,0 +1,63 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSubscription(t *testing.T) {
+	s, err := parseSubscription([]byte(`{"type":"subscribe","devices":["Phone-*"," wifi-aa:bb ",""],"locations":["kitchen"],"min_probability":0.5,"sensors":false}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"phone-*", "wifi-aa:bb"}, s.Devices)
+	assert.False(t, s.Sensors)
+
+	assert.True(t, s.matches(wsLocation{Device: "phone-zack", Location: "kitchen", Probability: 0.6}))
+	assert.True(t, s.matches(wsLocation{Device: "wifi-aa:bb", Location: "kitchen", Probability: 0.5}))
+	assert.False(t, s.matches(wsLocation{Device: "laptop", Location: "kitchen", Probability: 0.6}))
+	assert.False(t, s.matches(wsLocation{Device: "phone-zack", Location: "office", Probability: 0.6}))
+	assert.False(t, s.matches(wsLocation{Device: "phone-zack", Location: "kitchen", Probability: 0.4}))
+
+	s, err = parseSubscription([]byte(`{"type":"subscribe"}`))
+	assert.Nil(t, err)
+	assert.True(t, s.Sensors)
+	assert.True(t, s.matches(wsLocation{Device: "laptop"}))
+	s, err = parseSubscription([]byte(`{"type":"unsubscribe"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultSubscription, s)
+
+	_, err = parseSubscription([]byte(`{"type":"subscribe","devices":["[a"]}`))
+	assert.NotNil(t, err)
+	_, err = parseSubscription([]byte(`{"type":"subscribe","min_probability":2}`))
+	assert.NotNil(t, err)
+	_, err = parseSubscription([]byte(`{"type":"other"}`))
+	assert.NotNil(t, err)
+	_, err = parseSubscription([]byte(`not json`))
+	assert.NotNil(t, err)
+}
+
+func TestSendLocationOverWebsockets(t *testing.T) {
+	family := "testsubscriptions"
+	kiosk := &wsClient{id: "kiosk", family: family, device: "all", send: make(chan []byte, 2), closed: make(chan struct{}),
+		subscription: WebsocketSubscription{Locations: []string{"kitchen"}}}
+	device := &wsClient{id: "device", family: family, device: "phone", send: make(chan []byte, 2), closed: make(chan struct{}),
+		subscription: defaultSubscription}
+	ws.register(kiosk)
+	ws.register(device)
+	defer ws.remove(kiosk)
+	defer ws.remove(device)
+
+	render := func(sensors bool, metadata bool) ([]byte, error) {
+		if sensors {
+			return []byte("with sensors"), nil
+		}
+		return []byte("without sensors"), nil
+	}
+	SendLocationOverWebsockets(family, wsLocation{Device: "phone", Location: "kitchen", render: render})
+	SendLocationOverWebsockets(family, wsLocation{Device: "phone", Location: "office", render: render})
+	assert.Equal(t, 1, len(kiosk.send))
+	assert.Equal(t, []byte("without sensors"), <-kiosk.send)
+	assert.Equal(t, 2, len(device.send))
+	assert.Equal(t, []byte("with sensors"), <-device.send)
+	assert.Equal(t, int64(1), GetWebsocketStats()[family].Filtered)
+}
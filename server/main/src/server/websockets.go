@@ -1,15 +1,44 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// wsWriteWait is the time allowed to write a message to a connection
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is the time allowed to read the next pong from a connection
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod is how often pings are sent, it must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// wsMaxMessageSize is the largest message read from a connection
+	wsMaxMessageSize = 4096
+)
+
+// Policies for connections that cannot keep up with their messages
+const (
+	// WebsocketDrop drops the messages that do not fit in the send buffer
+	WebsocketDrop = "drop"
+	// WebsocketDisconnect closes the connection when its send buffer is full
+	WebsocketDisconnect = "disconnect"
+)
+
+var (
+	// WebsocketSendBuffer is the number of messages queued for each connection
+	WebsocketSendBuffer = 32
+	// WebsocketSlowPolicy is what happens to connections that cannot keep up
+	WebsocketSlowPolicy = WebsocketDrop
+)
+
 var wsupgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -18,19 +47,56 @@ var wsupgrader = websocket.Upgrader{
 	},
 }
 
+// wsClient is a websocket connection. Messages are queued on send and
+// written by the connection's own goroutine, so a slow client does not
+// hold up the others.
+type wsClient struct {
+	id     string
+	family string
+	device string
+	// metadata is whether the connection wants location metadata in its messages
+	metadata bool
+	// subscription filters the locations, it is guarded by the hub
+	subscription WebsocketSubscription
+	conn         *websocket.Conn
+	send         chan []byte
+	// closed is closed once the client is removed from the hub
+	closed chan struct{}
+	// closeMessage is sent when the client is closed, if it is set
+	// before the client is removed
+	closeMessage []byte
+}
+
+// WebsocketStats are the websocket metrics of a family
+type WebsocketStats struct {
+	Connected    int   `json:"connected"`
+	Connections  int64 `json:"connections"`
+	Sent         int64 `json:"sent"`
+	Dropped      int64 `json:"dropped"`
+	Disconnected int64 `json:"disconnected"`
+	// Filtered is the number of locations that subscriptions did not want
+	Filtered int64 `json:"filtered"`
+}
+
+// Websockets is the hub of the websocket connections, by family and device
 type Websockets struct {
-	connections map[string]map[string]*websocket.Conn
+	clients map[string]map[string]*wsClient
+	stats   map[string]*WebsocketStats
+	// writers counts the connections that are still writing
+	writers sync.WaitGroup
 	sync.Mutex
 }
 
 var (
-	ws Websockets
+	ws         Websockets
+	wsClientID int64
 )
 
 func init() {
 	ws.Lock()
 	defer ws.Unlock()
-	ws.connections = make(map[string]map[string]*websocket.Conn)
+	ws.clients = make(map[string]map[string]*wsClient)
+	ws.stats = make(map[string]*WebsocketStats)
 }
 
 func wshandler(c *gin.Context) {
@@ -54,49 +120,243 @@ func wshandler(c *gin.Context) {
 
 	conn, err := wsupgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Println("Failed to set websocket upgrade: %+v", err)
+		logger.Warnf("failed to set websocket upgrade: %+v", err)
 		return
 	}
-	ws.Lock()
-	if _, ok := ws.connections[family+"-"+device]; !ok {
-		ws.connections[family+"-"+device] = make(map[string]*websocket.Conn)
+	client := &wsClient{
+		id:           fmt.Sprintf("ws%d", atomic.AddInt64(&wsClientID, 1)),
+		family:       family,
+		device:       device,
+		metadata:     c.DefaultQuery("metadata", "0") == "1",
+		subscription: defaultSubscription,
+		conn:         conn,
+		send:         make(chan []byte, WebsocketSendBuffer),
+		closed:       make(chan struct{}),
 	}
-	ws.connections[family+"-"+device][conn.RemoteAddr().String()] = conn
-	ws.Unlock()
+	ws.register(client)
+	ws.writers.Add(1)
+	go client.writePump()
+	go client.readPump()
 	go sendOutLocation(family, device)
-	go websocketListener(family, device, conn)
-	// Listen to the websockets
+}
 
+func (h *Websockets) familyStats(family string) *WebsocketStats {
+	if _, ok := h.stats[family]; !ok {
+		h.stats[family] = &WebsocketStats{}
+	}
+	return h.stats[family]
 }
 
-func websocketListener(family string, device string, conn *websocket.Conn) {
+func (h *Websockets) register(client *wsClient) {
+	h.Lock()
+	defer h.Unlock()
+	key := client.family + "-" + client.device
+	if _, ok := h.clients[key]; !ok {
+		h.clients[key] = make(map[string]*wsClient)
+	}
+	h.clients[key][client.id] = client
+	stats := h.familyStats(client.family)
+	stats.Connected++
+	stats.Connections++
+	logger.Debugf("added %s/%s", key, client.id)
+}
+
+// unregister removes a client from the hub, which stops its goroutines.
+// It must be called with the hub locked.
+func (h *Websockets) unregister(client *wsClient) {
+	key := client.family + "-" + client.device
+	if _, ok := h.clients[key][client.id]; !ok {
+		return
+	}
+	delete(h.clients[key], client.id)
+	if len(h.clients[key]) == 0 {
+		delete(h.clients, key)
+	}
+	h.familyStats(client.family).Connected--
+	close(client.closed)
+	logger.Debugf("removed %s/%s", key, client.id)
+}
+
+func (h *Websockets) remove(client *wsClient) {
+	h.Lock()
+	defer h.Unlock()
+	h.unregister(client)
+}
+
+// readPump reads the subscriptions from the connection until it fails,
+// which also handles the pongs and notices when the client goes away
+func (client *wsClient) readPump() {
+	defer func() {
+		ws.remove(client)
+		client.conn.Close()
+	}()
+	client.conn.SetReadLimit(wsMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	client.conn.SetPongHandler(func(string) error {
+		client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
 	for {
-		_, _, err := conn.ReadMessage()
+		_, msg, err := client.conn.ReadMessage()
 		if err != nil {
-			ws.Lock()
-			if _, ok := ws.connections[family+"-"+device]; ok {
-				if _, ok2 := ws.connections[family+"-"+device][conn.RemoteAddr().String()]; ok2 {
-					delete(ws.connections[family+"-"+device], conn.RemoteAddr().String())
-				}
-				logger.Debugf("removed %s/%s", family+"-"+device, conn.RemoteAddr().String())
+			return
+		}
+		ws.subscribe(client, msg)
+	}
+}
+
+// subscribe sets the subscription of a client from its message,
+// and replies with the subscription or the error
+func (h *Websockets) subscribe(client *wsClient, msg []byte) {
+	type Reply struct {
+		Type         string                 `json:"type"`
+		Message      string                 `json:"message,omitempty"`
+		Subscription *WebsocketSubscription `json:"subscription,omitempty"`
+	}
+	reply := Reply{Type: "subscribed"}
+	subscription, err := parseSubscription(msg)
+	if err != nil {
+		reply = Reply{Type: "error", Message: err.Error()}
+	} else {
+		reply.Subscription = &subscription
+	}
+	bReply, _ := json.Marshal(reply)
+
+	h.Lock()
+	defer h.Unlock()
+	if err == nil {
+		client.subscription = subscription
+		logger.Debugf("%s-%s/%s subscribed to %+v", client.family, client.device, client.id, subscription)
+	}
+	h.queue(client, bReply)
+}
+
+// writePump writes the queued messages and the pings to the connection
+func (client *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+		ws.writers.Done()
+	}()
+	for {
+		select {
+		case msg := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := client.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				logger.Warnf("problem sending websocket: %s-%s/%s", client.family, client.device, client.id)
+				ws.remove(client)
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				ws.remove(client)
+				return
+			}
+		case <-client.closed:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			msg := client.closeMessage
+			if msg == nil {
+				msg = []byte{}
 			}
-			ws.Unlock()
+			client.conn.WriteMessage(websocket.CloseMessage, msg)
 			return
 		}
 	}
 }
 
-//  SendMessageOverWebsockets will send a message over the websockets
-func SendMessageOverWebsockets(family string, device string, msg []byte) (err error) {
+// SendMessageOverWebsockets will queue a message for the websockets of a device.
+// Connections that want location metadata get msgWithMetadata, if it is given.
+func SendMessageOverWebsockets(family string, device string, msg []byte, msgWithMetadata ...[]byte) (err error) {
 	ws.Lock()
 	defer ws.Unlock()
-	if _, ok := ws.connections[family+"-"+device]; ok {
-		for _, conn := range ws.connections[family+"-"+device] {
-			err = conn.WriteMessage(1, msg)
-			if err != nil {
-				logger.Warnf("problem sending websocket: %s/%s", family+"-"+device)
-			}
+	clients := ws.clients[family+"-"+device]
+	if len(clients) == 0 {
+		return
+	}
+	for _, client := range clients {
+		data := msg
+		if client.metadata && len(msgWithMetadata) > 0 && len(msgWithMetadata[0]) > 0 {
+			data = msgWithMetadata[0]
 		}
+		ws.queue(client, data)
 	}
 	return
 }
+
+// SendLocationOverWebsockets will queue a location for the websockets of
+// its device and of "all", that are subscribed to it
+func SendLocationOverWebsockets(family string, location wsLocation) {
+	ws.Lock()
+	defer ws.Unlock()
+	devices := []string{location.Device}
+	if location.Device != "all" {
+		devices = append(devices, "all")
+	}
+	// each variant of the location is only rendered once
+	rendered := make(map[[2]bool][]byte)
+	for _, device := range devices {
+		for _, client := range ws.clients[family+"-"+device] {
+			if !client.subscription.matches(location) {
+				ws.familyStats(family).Filtered++
+				continue
+			}
+			variant := [2]bool{client.subscription.Sensors, client.metadata}
+			if _, ok := rendered[variant]; !ok {
+				data, err := location.render(variant[0], variant[1])
+				if err != nil {
+					logger.Warn(err)
+					continue
+				}
+				rendered[variant] = data
+			}
+			ws.queue(client, rendered[variant])
+		}
+	}
+}
+
+// queue adds a message to the send queue of a client, or applies the
+// policy for slow clients when the queue is full. It must be called
+// with the hub locked.
+func (h *Websockets) queue(client *wsClient, data []byte) {
+	stats := h.familyStats(client.family)
+	select {
+	case client.send <- data:
+		stats.Sent++
+	default:
+		if WebsocketSlowPolicy == WebsocketDisconnect {
+			logger.Warnf("websocket %s-%s/%s is too slow, disconnecting", client.family, client.device, client.id)
+			stats.Disconnected++
+			h.unregister(client)
+		} else {
+			stats.Dropped++
+		}
+	}
+}
+
+// websocketsWantMetadata returns whether any connection of the
+// devices wants location metadata in its messages
+func websocketsWantMetadata(family string, devices ...string) bool {
+	ws.Lock()
+	defer ws.Unlock()
+	for _, device := range devices {
+		for _, client := range ws.clients[family+"-"+device] {
+			if client.metadata {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetWebsocketStats returns the websocket metrics of each family
+func GetWebsocketStats() map[string]WebsocketStats {
+	ws.Lock()
+	defer ws.Unlock()
+	stats := make(map[string]WebsocketStats)
+	for family, s := range ws.stats {
+		stats[family] = *s
+	}
+	return stats
+}
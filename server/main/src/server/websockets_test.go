@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebsocketsSlowClients(t *testing.T) {
+	policy := WebsocketSlowPolicy
+	defer func() { WebsocketSlowPolicy = policy }()
+
+	family := "testwebsockets"
+	slow := &wsClient{id: "slow", family: family, device: "all", send: make(chan []byte, 1), closed: make(chan struct{})}
+	other := &wsClient{id: "other", family: family, device: "all", metadata: true, send: make(chan []byte, 3), closed: make(chan struct{})}
+	ws.register(slow)
+	ws.register(other)
+	assert.True(t, websocketsWantMetadata(family, "device", "all"))
+
+	WebsocketSlowPolicy = WebsocketDrop
+	for i := 0; i < 3; i++ {
+		SendMessageOverWebsockets(family, "all", []byte("msg"), []byte("msg with metadata"))
+	}
+	assert.Equal(t, 3, len(other.send))
+	assert.Equal(t, []byte("msg with metadata"), <-other.send)
+	stats := GetWebsocketStats()[family]
+	assert.Equal(t, 2, stats.Connected)
+	assert.Equal(t, int64(4), stats.Sent)
+	assert.Equal(t, int64(2), stats.Dropped)
+
+	WebsocketSlowPolicy = WebsocketDisconnect
+	SendMessageOverWebsockets(family, "all", []byte("msg"))
+	<-slow.closed
+	stats = GetWebsocketStats()[family]
+	assert.Equal(t, 1, stats.Connected)
+	assert.Equal(t, int64(1), stats.Disconnected)
+
+	ws.remove(other)
+	ws.remove(other)
+	assert.Equal(t, 0, GetWebsocketStats()[family].Connected)
+}
+
+func TestCloseWebsockets(t *testing.T) {
+	client := &wsClient{id: "closing", family: "testclose", device: "all", send: make(chan []byte, 1), closed: make(chan struct{})}
+	ws.register(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, CloseWebsockets(ctx))
+	<-client.closed
+	assert.NotEmpty(t, client.closeMessage)
+	assert.Equal(t, 0, GetWebsocketStats()["testclose"].Connected)
+}